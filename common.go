@@ -2,6 +2,10 @@ package mls
 
 import (
 	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/chacha20"
 )
 
 func dup(in []byte) []byte {
@@ -18,3 +22,83 @@ func validateEnum(v interface{}, known ...interface{}) error {
 	}
 	return fmt.Errorf("Unknown enum value: %v", v)
 }
+
+// Run f(0), ..., f(n-1) on at most the specified number of goroutines.  Each
+// call should write its result to a slot for its index, so that the output
+// does not depend on scheduling.  If any calls fail, the error for the lowest
+// index is returned.
+func parallelFor(n, workers int, f func(i int) error) error {
+	if workers <= 1 || n <= 1 {
+		for i := 0; i < n; i++ {
+			if err := f(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if workers > n {
+		workers = n
+	}
+
+	errs := make([]error, n)
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				errs[i] = f(i)
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A stream of pseudorandom bytes, generated as a ChaCha20 keystream
+type keystreamReader struct {
+	cipher *chacha20.Cipher
+}
+
+func (ks keystreamReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	ks.cipher.XORKeyStream(p, p)
+	return len(p), nil
+}
+
+// Split a source of randomness into n independent streams, one for each index
+// of a parallelFor.  The seeds for the streams are read from r up front, so r
+// is only used from one goroutine, and the output depends only on what r
+// produces, not on scheduling.
+func splitRandom(r io.Reader, n int) ([]io.Reader, error) {
+	streams := make([]io.Reader, n)
+	for i := range streams {
+		seed := make([]byte, chacha20.KeySize)
+		if _, err := io.ReadFull(r, seed); err != nil {
+			return nil, err
+		}
+
+		cipher, err := chacha20.NewUnauthenticatedCipher(seed, make([]byte, chacha20.NonceSize))
+		if err != nil {
+			return nil, err
+		}
+
+		streams[i] = keystreamReader{cipher}
+	}
+	return streams, nil
+}
@@ -1,7 +1,10 @@
 package mls
 
 import (
+	"bytes"
 	"encoding/hex"
+	"fmt"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -23,6 +26,54 @@ func TestValidateEnum(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestParallelFor(t *testing.T) {
+	for _, workers := range []int{0, 1, 3, 100} {
+		out := make([]int, 10)
+		err := parallelFor(len(out), workers, func(i int) error {
+			out[i] = i * i
+			return nil
+		})
+		require.Nil(t, err)
+		for i := range out {
+			require.Equal(t, i*i, out[i])
+		}
+
+		// The error for the lowest failing index is reported
+		err = parallelFor(len(out), workers, func(i int) error {
+			if i >= 4 {
+				return fmt.Errorf("fail %d", i)
+			}
+			return nil
+		})
+		require.Equal(t, fmt.Errorf("fail 4"), err)
+	}
+}
+
+func TestSplitRandom(t *testing.T) {
+	seed := randomBytes(64)
+	read := func(r io.Reader) []byte {
+		out := make([]byte, 100)
+		_, err := io.ReadFull(r, out)
+		require.Nil(t, err)
+		return out
+	}
+
+	streams, err := splitRandom(bytes.NewReader(seed), 2)
+	require.Nil(t, err)
+	again, err := splitRandom(bytes.NewReader(seed), 2)
+	require.Nil(t, err)
+
+	// Streams are reproducible from the source, and distinct from each other
+	first := read(streams[0])
+	require.Equal(t, first, read(again[0]))
+	require.NotEqual(t, first, read(streams[1]))
+	require.NotEqual(t, first, read(streams[0]))
+
+	// Running out of source randomness is an error
+	_, err = splitRandom(bytes.NewReader(seed), 3)
+	require.Error(t, err)
+}
+
 //////////
 
 func unhex(h string) []byte {
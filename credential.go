@@ -1,14 +1,21 @@
 package mls
 
 import (
+	"bytes"
 	"crypto/ecdsa"
 	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
 	"fmt"
+	"net/url"
 	"reflect"
+	"strings"
+	"time"
 
 	"github.com/cisco/go-tls-syntax"
+	"github.com/cloudflare/circl/sign/ed448"
 )
 
 type CredentialType uint8
@@ -48,6 +55,8 @@ func (cred X509Credential) Scheme() SignatureScheme {
 		switch ecKey.Curve {
 		case elliptic.P256():
 			return ECDSA_SECP256R1_SHA256
+		case elliptic.P384():
+			return ECDSA_SECP384R1_SHA384
 		case elliptic.P521():
 			return ECDSA_SECP521R1_SHA512
 		default:
@@ -56,6 +65,11 @@ func (cred X509Credential) Scheme() SignatureScheme {
 
 	case x509.Ed25519:
 		return Ed25519
+
+	case x509.UnknownPublicKeyAlgorithm:
+		if _, ok := ed448PublicKey(leaf); ok {
+			return Ed448
+		}
 	}
 
 	panic("Unsupported algorithm in certificate")
@@ -71,9 +85,36 @@ func (cred X509Credential) PublicKey() *SignaturePublicKey {
 		return &SignaturePublicKey{Data: pub}
 	}
 
+	if pub, ok := ed448PublicKey(cred.Chain[0]); ok {
+		return &SignaturePublicKey{Data: pub}
+	}
+
 	panic("Unsupported public key type in certificate")
 }
 
+// The x509 package doesn't parse Ed448 keys (RFC 8410), so we pull them out
+// of the SubjectPublicKeyInfo ourselves
+var oidEd448 = asn1.ObjectIdentifier{1, 3, 101, 113}
+
+func ed448PublicKey(cert *x509.Certificate) ([]byte, bool) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+
+	rest, err := asn1.Unmarshal(cert.RawSubjectPublicKeyInfo, &spki)
+	if err != nil || len(rest) != 0 || !spki.Algorithm.Algorithm.Equal(oidEd448) {
+		return nil, false
+	}
+
+	pub := spki.PublicKey.RightAlign()
+	if len(pub) != ed448.PublicKeySize {
+		return nil, false
+	}
+
+	return pub, true
+}
+
 type certChainData struct {
 	Data []byte `tls:"head=3"`
 }
@@ -162,7 +203,7 @@ func (pool certPool) parent(cert *x509.Certificate) (*x509.Certificate, bool) {
 // complex things like name constraints are not considered.  They would be if we
 // were using x509.Certificate.Verify, but that method (1) requires a DNS name
 // as the authentication anchor, and (2) builds its own chain without strict
-// ordering.
+// ordering.  VerifyWithPolicy performs full path validation.
 func (cred X509Credential) Verify(trusted []*x509.Certificate) error {
 	pool := newCertPool(trusted)
 
@@ -195,6 +236,367 @@ func (cred X509Credential) Verify(trusted []*x509.Certificate) error {
 	return last.CheckSignatureFrom(parent)
 }
 
+///
+/// X.509 path validation
+///
+
+type X509ValidationReason uint8
+
+const (
+	X509NoTrustAnchor X509ValidationReason = iota
+	X509NameMismatch
+	X509BadSignature
+	X509NotYetValid
+	X509Expired
+	X509UnhandledCritical
+	X509NotCA
+	X509PathTooLong
+	X509KeyUsage
+	X509ExtKeyUsage
+	X509NameConstraint
+	X509Revoked
+	X509RevocationUnknown
+)
+
+var x509ValidationReasonNames = map[X509ValidationReason]string{
+	X509NoTrustAnchor:     "no trust anchor",
+	X509NameMismatch:      "issuer name mismatch",
+	X509BadSignature:      "bad signature",
+	X509NotYetValid:       "not yet valid",
+	X509Expired:           "expired",
+	X509UnhandledCritical: "unhandled critical extension",
+	X509NotCA:             "issuer is not a CA",
+	X509PathTooLong:       "path length exceeded",
+	X509KeyUsage:          "key usage not permitted",
+	X509ExtKeyUsage:       "extended key usage not permitted",
+	X509NameConstraint:    "name constraint violated",
+	X509Revoked:           "revoked",
+	X509RevocationUnknown: "revocation status unknown",
+}
+
+func (r X509ValidationReason) String() string {
+	name, ok := x509ValidationReasonNames[r]
+	if !ok {
+		return fmt.Sprintf("X509ValidationReason(%d)", r)
+	}
+	return name
+}
+
+// Describes why a certificate chain failed validation.  The depth is the
+// position of the offending certificate in the chain, starting with the leaf
+// at zero.  A depth equal to the length of the chain indicates the trust
+// anchor.
+type X509ValidationError struct {
+	Reason X509ValidationReason
+	Depth  int
+	Cert   *x509.Certificate
+	Detail string
+}
+
+func (e X509ValidationError) Error() string {
+	return fmt.Sprintf("mls.credential: X.509 %v at depth %d [%v]: %s", e.Reason, e.Depth, e.Cert.Subject, e.Detail)
+}
+
+// A policy for validating X.509 credentials.  Revocation is checked against
+// the CRLs supplied here.  A certificate whose issuer has no current CRL is
+// accepted, unless RequireCRLs is set.
+type X509Policy struct {
+	TrustAnchors []*x509.Certificate
+	Clock        Clock
+	RequiredEKUs []x509.ExtKeyUsage
+	CRLs         []*x509.RevocationList
+	RequireCRLs  bool
+}
+
+func (p X509Policy) now() time.Time {
+	if p.Clock == nil {
+		return time.Now()
+	}
+	return p.Clock.Now()
+}
+
+// An X509Policy can serve as an AuthenticationService that accepts only
+// X.509 credentials that validate under the policy
+func (p X509Policy) Authenticate(cred Credential) error {
+	if cred.Type() != CredentialTypeX509 {
+		return fmt.Errorf("mls.credential: Credential is not an X.509 credential")
+	}
+
+	return cred.X509.VerifyWithPolicy(p)
+}
+
+// Validate the credential's chain in order, from the leaf to the first
+// certificate issued by a trust anchor.  Certificates after that point are
+// ignored.  Each certificate must be correctly signed and within its validity
+// period, and must not be revoked.  Each issuer must be a CA permitted to sign
+// certificates, within its path length and name constraints.  The leaf must be
+// permitted to sign, and the chain must allow the required EKUs.
+func (cred X509Credential) VerifyWithPolicy(policy X509Policy) error {
+	if len(cred.Chain) == 0 {
+		return fmt.Errorf("mls.credential: Empty certificate chain")
+	}
+
+	// Find the path to a trust anchor
+	pool := newCertPool(policy.TrustAnchors)
+	var certs []*x509.Certificate
+	for i, cert := range cred.Chain {
+		certs = append(certs, cert)
+
+		parent, ok := pool.parent(cert)
+		if ok && checkIssuerSignature(cert, parent) == nil {
+			certs = append(certs, parent)
+			break
+		}
+
+		if i == len(cred.Chain)-1 {
+			return X509ValidationError{X509NoTrustAnchor, i, cert, "not issued by a trust anchor"}
+		}
+	}
+
+	now := policy.now()
+	path := certs[:len(certs)-1]
+	for depth, cert := range path {
+		issuer := certs[depth+1]
+		if err := policy.checkCert(depth, cert, issuer, now); err != nil {
+			return err
+		}
+	}
+
+	for depth := 1; depth < len(certs); depth++ {
+		if err := checkIssuer(depth, certs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkIssuerSignature(cert, issuer *x509.Certificate) error {
+	return issuer.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+}
+
+func (p X509Policy) checkCert(depth int, cert, issuer *x509.Certificate, now time.Time) error {
+	fail := func(reason X509ValidationReason, format string, args ...interface{}) error {
+		return X509ValidationError{reason, depth, cert, fmt.Sprintf(format, args...)}
+	}
+
+	if !bytes.Equal(cert.RawIssuer, issuer.RawSubject) {
+		return fail(X509NameMismatch, "issuer [%v] does not match [%v]", cert.Issuer, issuer.Subject)
+	}
+
+	if err := checkIssuerSignature(cert, issuer); err != nil {
+		return fail(X509BadSignature, "%v", err)
+	}
+
+	if now.Before(cert.NotBefore) {
+		return fail(X509NotYetValid, "valid from %v", cert.NotBefore)
+	}
+
+	if now.After(cert.NotAfter) {
+		return fail(X509Expired, "expired at %v", cert.NotAfter)
+	}
+
+	if len(cert.UnhandledCriticalExtensions) > 0 {
+		return fail(X509UnhandledCritical, "%v", cert.UnhandledCriticalExtensions[0])
+	}
+
+	if depth == 0 && cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return fail(X509KeyUsage, "leaf may not sign")
+	}
+
+	// The leaf must list the required EKUs.  CAs that list EKUs must also
+	// list the required ones.
+	if depth == 0 || len(cert.ExtKeyUsage) > 0 {
+		for _, eku := range p.RequiredEKUs {
+			if !hasExtKeyUsage(cert, eku) {
+				return fail(X509ExtKeyUsage, "missing EKU %v", eku)
+			}
+		}
+	}
+
+	return p.checkRevocation(depth, cert, issuer, now)
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, eku x509.ExtKeyUsage) bool {
+	for _, usage := range cert.ExtKeyUsage {
+		if usage == eku || usage == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+func (p X509Policy) checkRevocation(depth int, cert, issuer *x509.Certificate, now time.Time) error {
+	checked := false
+	for _, crl := range p.CRLs {
+		if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) {
+			continue
+		}
+
+		if crl.CheckSignatureFrom(issuer) != nil || !now.Before(crl.NextUpdate) {
+			continue
+		}
+
+		checked = true
+		for _, revoked := range crl.RevokedCertificateEntries {
+			if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				return X509ValidationError{X509Revoked, depth, cert, fmt.Sprintf("revoked at %v", revoked.RevocationTime)}
+			}
+		}
+	}
+
+	if !checked && p.RequireCRLs {
+		return X509ValidationError{X509RevocationUnknown, depth, cert, "no current CRL from issuer"}
+	}
+
+	return nil
+}
+
+// Check the constraints that the issuer at the specified depth places on the
+// certificates below it
+func checkIssuer(depth int, certs []*x509.Certificate) error {
+	ca := certs[depth]
+	fail := func(reason X509ValidationReason, format string, args ...interface{}) error {
+		return X509ValidationError{reason, depth, ca, fmt.Sprintf(format, args...)}
+	}
+
+	if !ca.BasicConstraintsValid || !ca.IsCA {
+		return fail(X509NotCA, "basic constraints do not allow issuing")
+	}
+
+	if ca.KeyUsage != 0 && ca.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return fail(X509KeyUsage, "CA may not sign certificates")
+	}
+
+	// Self-issued intermediates do not count toward the path length
+	// (RFC 5280, Section 4.2.1.9)
+	intermediates := 0
+	for _, cert := range certs[1:depth] {
+		if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+			intermediates++
+		}
+	}
+
+	if (ca.MaxPathLen > 0 || ca.MaxPathLenZero) && intermediates > ca.MaxPathLen {
+		return fail(X509PathTooLong, "%d intermediates exceeds %d", intermediates, ca.MaxPathLen)
+	}
+
+	for below := 0; below < depth; below++ {
+		if err := checkNameConstraints(ca, certs[below]); err != nil {
+			return X509ValidationError{X509NameConstraint, below, certs[below], err.Error()}
+		}
+	}
+
+	return nil
+}
+
+func checkNameConstraints(ca, cert *x509.Certificate) error {
+	for _, name := range cert.DNSNames {
+		err := checkConstraint("DNS name", name, ca.PermittedDNSDomains, ca.ExcludedDNSDomains, matchDomainConstraint)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, email := range cert.EmailAddresses {
+		err := checkConstraint("email address", email, ca.PermittedEmailAddresses, ca.ExcludedEmailAddresses, matchEmailConstraint)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, uri := range cert.URIs {
+		err := checkConstraint("URI", uri.String(), ca.PermittedURIDomains, ca.ExcludedURIDomains, matchURIConstraint)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, ip := range cert.IPAddresses {
+		for _, excluded := range ca.ExcludedIPRanges {
+			if excluded.Contains(ip) {
+				return fmt.Errorf("IP address %v is excluded by %v", ip, excluded)
+			}
+		}
+
+		permitted := len(ca.PermittedIPRanges) == 0
+		for _, allowed := range ca.PermittedIPRanges {
+			permitted = permitted || allowed.Contains(ip)
+		}
+
+		if !permitted {
+			return fmt.Errorf("IP address %v is not permitted", ip)
+		}
+	}
+
+	return nil
+}
+
+func checkConstraint(kind, name string, permitted, excluded []string, match func(name, constraint string) bool) error {
+	for _, constraint := range excluded {
+		if match(name, constraint) {
+			return fmt.Errorf("%s %q is excluded by %q", kind, name, constraint)
+		}
+	}
+
+	if len(permitted) == 0 {
+		return nil
+	}
+
+	for _, constraint := range permitted {
+		if match(name, constraint) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s %q is not permitted", kind, name)
+}
+
+// A constraint with a leading "." matches only subdomains.  Otherwise, it
+// matches the domain itself and its subdomains.
+func matchDomainConstraint(domain, constraint string) bool {
+	domain = strings.ToLower(domain)
+	constraint = strings.ToLower(constraint)
+	switch {
+	case len(constraint) == 0:
+		return true
+	case strings.HasPrefix(constraint, "."):
+		return strings.HasSuffix(domain, constraint)
+	default:
+		return domain == constraint || strings.HasSuffix(domain, "."+constraint)
+	}
+}
+
+// A constraint naming a mailbox matches only that mailbox.  One with a
+// leading "." matches mailboxes at subdomains, and one naming a host matches
+// mailboxes at that host.
+func matchEmailConstraint(email, constraint string) bool {
+	if strings.Contains(constraint, "@") {
+		return strings.EqualFold(email, constraint)
+	}
+
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	host := strings.ToLower(email[at+1:])
+	constraint = strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(host, constraint)
+	}
+	return host == constraint
+}
+
+func matchURIConstraint(uri, constraint string) bool {
+	parsed, err := url.Parse(uri)
+	if err != nil || len(parsed.Hostname()) == 0 {
+		return false
+	}
+
+	return matchDomainConstraint(parsed.Hostname(), constraint)
+}
+
 //	struct {
 //		CredentialType credential_type;
 //		select (Credential.credential_type) {
@@ -333,3 +735,42 @@ func (c *Credential) UnmarshalTLS(data []byte) (int, error) {
 	}
 	return s.Position(), nil
 }
+
+///
+/// Authentication
+///
+
+// An AuthenticationService decides whether a credential presented in a group
+// legitimately represents its holder, e.g., by checking it against a
+// directory or a set of trust anchors.
+type AuthenticationService interface {
+	Authenticate(cred Credential) error
+}
+
+// Returned when the AuthenticationService rejects the credential at a leaf
+type CredentialRejectedError struct {
+	Index LeafIndex
+	Err   error
+}
+
+func (e CredentialRejectedError) Error() string {
+	return fmt.Sprintf("mls.credential: Credential at leaf %d rejected: %v", e.Index, e.Err)
+}
+
+func (e CredentialRejectedError) Unwrap() error {
+	return e.Err
+}
+
+// Accepts X.509 credentials whose chains validate to one of the trusted
+// certificates, and rejects all others
+type X509AuthenticationService struct {
+	Trusted []*x509.Certificate
+}
+
+func (as X509AuthenticationService) Authenticate(cred Credential) error {
+	if cred.Type() != CredentialTypeX509 {
+		return fmt.Errorf("mls.credential: Credential is not an X.509 credential")
+	}
+
+	return cred.X509.Verify(as.Trusted)
+}
@@ -1,10 +1,16 @@
 package mls
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
 	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
 	"math/big"
 	"testing"
 	"time"
@@ -17,7 +23,7 @@ var (
 	caTemplate = &x509.Certificate{
 		BasicConstraintsValid: true,
 		IsCA:                  true,
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 	}
 
 	leafTemplate = &x509.Certificate{
@@ -141,6 +147,87 @@ func TestX509Credential(t *testing.T) {
 	require.Nil(t, err)
 }
 
+// The x509 package can't create certificates for Ed448 keys, so we issue one
+// for a placeholder key and swap in the Ed448 SubjectPublicKeyInfo
+func makeEd448Cert(t *testing.T, pub []byte, rootPriv ed25519.PrivateKey, root *x509.Certificate) *x509.Certificate {
+	_, placeholder := makeCert(t, leafTemplate, root, rootPriv, false)
+
+	var cert struct {
+		TBS       asn1.RawValue
+		Algorithm asn1.RawValue
+		Signature asn1.BitString
+	}
+	_, err := asn1.Unmarshal(placeholder.Raw, &cert)
+	require.Nil(t, err)
+
+	var tbs []asn1.RawValue
+	_, err = asn1.Unmarshal(placeholder.RawTBSCertificate, &tbs)
+	require.Nil(t, err)
+
+	spki, err := asn1.Marshal(struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidEd448},
+		PublicKey: asn1.BitString{Bytes: pub, BitLength: 8 * len(pub)},
+	})
+	require.Nil(t, err)
+
+	for i := range tbs {
+		if bytes.Equal(tbs[i].FullBytes, placeholder.RawSubjectPublicKeyInfo) {
+			tbs[i] = asn1.RawValue{FullBytes: spki}
+		}
+	}
+
+	tbsData, err := asn1.Marshal(tbs)
+	require.Nil(t, err)
+
+	sig := ed25519.Sign(rootPriv, tbsData)
+	cert.TBS = asn1.RawValue{FullBytes: tbsData}
+	cert.Signature = asn1.BitString{Bytes: sig, BitLength: 8 * len(sig)}
+	certData, err := asn1.Marshal(cert)
+	require.Nil(t, err)
+
+	parsed, err := x509.ParseCertificate(certData)
+	require.Nil(t, err)
+	return parsed
+}
+
+func TestX509CredentialSchemes(t *testing.T) {
+	message := []byte("attack at dawn")
+
+	// P-384
+	p384Priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.Nil(t, err)
+	_, p384Cert := makeCert(t, caTemplate, nil, p384Priv, false)
+
+	cred, err := NewX509Credential([]*x509.Certificate{p384Cert})
+	require.Nil(t, err)
+	require.Equal(t, cred.Scheme(), ECDSA_SECP384R1_SHA384)
+
+	priv := SignaturePrivateKey{Data: p384Priv.D.Bytes()}
+	sig, err := ECDSA_SECP384R1_SHA384.Sign(&priv, message)
+	require.Nil(t, err)
+	require.True(t, ECDSA_SECP384R1_SHA384.Verify(cred.PublicKey(), message, sig))
+
+	// Ed448
+	rootPriv := newEd25519(t)
+	_, root := makeCert(t, caTemplate, nil, rootPriv, false)
+	ed448Priv, err := Ed448.Generate()
+	require.Nil(t, err)
+	ed448Cert := makeEd448Cert(t, ed448Priv.PublicKey.Data, rootPriv, root)
+
+	cred, err = NewX509Credential([]*x509.Certificate{ed448Cert})
+	require.Nil(t, err)
+	require.Equal(t, cred.Scheme(), Ed448)
+	require.Equal(t, *cred.PublicKey(), ed448Priv.PublicKey)
+	require.Nil(t, cred.X509.Verify([]*x509.Certificate{root}))
+
+	sig, err = Ed448.Sign(&ed448Priv, message)
+	require.Nil(t, err)
+	require.True(t, Ed448.Verify(cred.PublicKey(), message, sig))
+}
+
 func TestX509CredentialOne(t *testing.T) {
 	cred, root := makeX509Credential(t, 1, false)
 	trusted := []*x509.Certificate{root}
@@ -159,6 +246,196 @@ func TestX509CredentialVerifyBySKI(t *testing.T) {
 	require.Nil(t, cred.X509.Verify(trusted))
 }
 
+func TestX509AuthenticationService(t *testing.T) {
+	cred, root := makeX509Credential(t, 3, true)
+	other, _ := makeX509Credential(t, 3, true)
+
+	as := X509AuthenticationService{Trusted: []*x509.Certificate{root}}
+	require.Nil(t, as.Authenticate(*cred))
+	require.Error(t, as.Authenticate(*other))
+
+	priv, err := Ed25519.Generate()
+	require.Nil(t, err)
+	require.Error(t, as.Authenticate(*NewBasicCredential(userID, Ed25519, priv.PublicKey)))
+}
+
+type testIssuer struct {
+	priv crypto.Signer
+	cert *x509.Certificate
+}
+
+func newTestIssuer(t *testing.T, template x509.Certificate, issuer *testIssuer) testIssuer {
+	if issuer == nil {
+		priv, cert := makeCert(t, &template, nil, newEd25519(t), true)
+		return testIssuer{priv, cert}
+	}
+
+	priv, cert := makeCert(t, &template, issuer.cert, issuer.priv, true)
+	return testIssuer{priv, cert}
+}
+
+func (ti testIssuer) crl(t *testing.T, revoked ...*x509.Certificate) *x509.RevocationList {
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now,
+		NextUpdate: now.Add(time.Hour),
+	}
+	for _, cert := range revoked {
+		entry := x509.RevocationListEntry{SerialNumber: cert.SerialNumber, RevocationTime: now}
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, entry)
+	}
+
+	der, err := x509.CreateRevocationList(rand.Reader, template, ti.cert, ti.priv)
+	require.Nil(t, err)
+	crl, err := x509.ParseRevocationList(der)
+	require.Nil(t, err)
+	return crl
+}
+
+func requireX509Error(t *testing.T, err error, reason X509ValidationReason, depth int) {
+	var verr X509ValidationError
+	require.True(t, errors.As(err, &verr), "%v", err)
+	require.Equal(t, reason, verr.Reason, "%v", err)
+	require.Equal(t, depth, verr.Depth, "%v", err)
+}
+
+func TestX509CredentialVerifyWithPolicy(t *testing.T) {
+	root := newTestIssuer(t, *caTemplate, nil)
+	inter := newTestIssuer(t, *caTemplate, &root)
+
+	leafTmpl := *leafTemplate
+	leafTmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	leaf := newTestIssuer(t, leafTmpl, &inter)
+
+	cred := X509Credential{Chain: []*x509.Certificate{leaf.cert, inter.cert}}
+	policy := X509Policy{
+		TrustAnchors: []*x509.Certificate{root.cert},
+		RequiredEKUs: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	require.Nil(t, cred.VerifyWithPolicy(policy))
+
+	// Validity periods are checked against the policy's clock
+	expired := policy
+	expired.Clock = fixedClock(time.Now().Add(48 * time.Hour))
+	requireX509Error(t, cred.VerifyWithPolicy(expired), X509Expired, 0)
+
+	early := policy
+	early.Clock = fixedClock(time.Now().Add(-2 * time.Hour))
+	requireX509Error(t, cred.VerifyWithPolicy(early), X509NotYetValid, 0)
+
+	// The chain must lead to a trust anchor
+	other := newTestIssuer(t, *caTemplate, nil)
+	untrusted := policy
+	untrusted.TrustAnchors = []*x509.Certificate{other.cert}
+	requireX509Error(t, cred.VerifyWithPolicy(untrusted), X509NoTrustAnchor, 1)
+
+	// The leaf must have the required EKUs
+	serverAuth := policy
+	serverAuth.RequiredEKUs = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	requireX509Error(t, cred.VerifyWithPolicy(serverAuth), X509ExtKeyUsage, 0)
+
+	// Revocation is checked against local CRLs
+	revoked := policy
+	revoked.CRLs = []*x509.RevocationList{root.crl(t, inter.cert)}
+	requireX509Error(t, cred.VerifyWithPolicy(revoked), X509Revoked, 1)
+
+	revoked.CRLs = []*x509.RevocationList{root.crl(t), inter.crl(t, leaf.cert)}
+	requireX509Error(t, cred.VerifyWithPolicy(revoked), X509Revoked, 0)
+
+	required := policy
+	required.RequireCRLs = true
+	requireX509Error(t, cred.VerifyWithPolicy(required), X509RevocationUnknown, 0)
+
+	required.CRLs = []*x509.RevocationList{inter.crl(t)}
+	requireX509Error(t, cred.VerifyWithPolicy(required), X509RevocationUnknown, 1)
+
+	required.CRLs = []*x509.RevocationList{inter.crl(t), root.crl(t)}
+	require.Nil(t, cred.VerifyWithPolicy(required))
+
+	// A CRL signed by someone else is ignored
+	required.CRLs = []*x509.RevocationList{other.crl(t, leaf.cert), root.crl(t)}
+	requireX509Error(t, cred.VerifyWithPolicy(required), X509RevocationUnknown, 0)
+
+	// The policy can be used as an AuthenticationService
+	require.Nil(t, policy.Authenticate(Credential{X509: &cred}))
+	require.Error(t, expired.Authenticate(Credential{X509: &cred}))
+}
+
+func TestX509CredentialVerifyConstraints(t *testing.T) {
+	// Intermediates must be CAs
+	root := newTestIssuer(t, *caTemplate, nil)
+	notCA := newTestIssuer(t, *leafTemplate, &root)
+	leaf := newTestIssuer(t, *leafTemplate, &notCA)
+	cred := X509Credential{Chain: []*x509.Certificate{leaf.cert, notCA.cert}}
+	policy := X509Policy{TrustAnchors: []*x509.Certificate{root.cert}}
+	requireX509Error(t, cred.VerifyWithPolicy(policy), X509NotCA, 1)
+
+	// Path length constraints are enforced
+	rootTmpl := *caTemplate
+	rootTmpl.Subject = pkix.Name{CommonName: "root"}
+	rootTmpl.MaxPathLen = 0
+	rootTmpl.MaxPathLenZero = true
+	root = newTestIssuer(t, rootTmpl, nil)
+	interTmpl := *caTemplate
+	interTmpl.Subject = pkix.Name{CommonName: "intermediate"}
+	inter := newTestIssuer(t, interTmpl, &root)
+	leaf = newTestIssuer(t, *leafTemplate, &inter)
+	cred = X509Credential{Chain: []*x509.Certificate{leaf.cert, inter.cert}}
+	policy = X509Policy{TrustAnchors: []*x509.Certificate{root.cert}}
+	requireX509Error(t, cred.VerifyWithPolicy(policy), X509PathTooLong, 2)
+
+	// ... but self-issued intermediates do not count toward the limit
+	interTmpl.Subject = rootTmpl.Subject
+	inter = newTestIssuer(t, interTmpl, &root)
+	leaf = newTestIssuer(t, *leafTemplate, &inter)
+	cred = X509Credential{Chain: []*x509.Certificate{leaf.cert, inter.cert}}
+	require.Nil(t, cred.VerifyWithPolicy(policy))
+
+	// Name constraints apply to everything below the CA
+	root = newTestIssuer(t, *caTemplate, nil)
+	interTmpl = *caTemplate
+	interTmpl.PermittedDNSDomains = []string{"example.com"}
+	interTmpl.ExcludedEmailAddresses = []string{".evil.example.com"}
+	inter = newTestIssuer(t, interTmpl, &root)
+	policy = X509Policy{TrustAnchors: []*x509.Certificate{root.cert}}
+
+	leafTmpl := *leafTemplate
+	leafTmpl.DNSNames = []string{"device.example.com"}
+	leafTmpl.EmailAddresses = []string{"alice@example.com"}
+	leaf = newTestIssuer(t, leafTmpl, &inter)
+	cred = X509Credential{Chain: []*x509.Certificate{leaf.cert, inter.cert}}
+	require.Nil(t, cred.VerifyWithPolicy(policy))
+
+	leafTmpl.DNSNames = []string{"example.org"}
+	leaf = newTestIssuer(t, leafTmpl, &inter)
+	cred = X509Credential{Chain: []*x509.Certificate{leaf.cert, inter.cert}}
+	requireX509Error(t, cred.VerifyWithPolicy(policy), X509NameConstraint, 0)
+
+	leafTmpl.DNSNames = nil
+	leafTmpl.EmailAddresses = []string{"mallory@mail.evil.example.com"}
+	leaf = newTestIssuer(t, leafTmpl, &inter)
+	cred = X509Credential{Chain: []*x509.Certificate{leaf.cert, inter.cert}}
+	requireX509Error(t, cred.VerifyWithPolicy(policy), X509NameConstraint, 0)
+}
+
+func TestNameConstraintMatching(t *testing.T) {
+	require.True(t, matchDomainConstraint("example.com", "example.com"))
+	require.True(t, matchDomainConstraint("a.Example.com", "example.com"))
+	require.False(t, matchDomainConstraint("badexample.com", "example.com"))
+	require.False(t, matchDomainConstraint("example.com", ".example.com"))
+	require.True(t, matchDomainConstraint("a.example.com", ".example.com"))
+
+	require.True(t, matchEmailConstraint("alice@example.com", "alice@example.com"))
+	require.False(t, matchEmailConstraint("bob@example.com", "alice@example.com"))
+	require.True(t, matchEmailConstraint("bob@example.com", "example.com"))
+	require.False(t, matchEmailConstraint("bob@mail.example.com", "example.com"))
+	require.True(t, matchEmailConstraint("bob@mail.example.com", ".example.com"))
+
+	require.True(t, matchURIConstraint("https://a.example.com/path", "example.com"))
+	require.False(t, matchURIConstraint("urn:example", "example.com"))
+}
+
 func TestCredentialErrorCases(t *testing.T) {
 	cred := Credential{}
 
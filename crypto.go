@@ -2,6 +2,7 @@ package mls
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
@@ -13,12 +14,17 @@ import (
 	"encoding/asn1"
 	"fmt"
 	"hash"
+	"io"
 	"math/big"
 
 	"github.com/cisco/go-hpke"
 	"github.com/cisco/go-tls-syntax"
+	"github.com/cloudflare/circl/kem"
+	"github.com/cloudflare/circl/kem/hybrid"
+	"github.com/cloudflare/circl/sign/ed448"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
 )
 
 type CipherSuite uint16
@@ -27,9 +33,14 @@ const (
 	X25519_AES128GCM_SHA256_Ed25519        CipherSuite = 0x0001
 	P256_AES128GCM_SHA256_P256             CipherSuite = 0x0002
 	X25519_CHACHA20POLY1305_SHA256_Ed25519 CipherSuite = 0x0003
-	X448_AES256GCM_SHA512_Ed448            CipherSuite = 0x0004 // UNSUPPORTED
+	X448_AES256GCM_SHA512_Ed448            CipherSuite = 0x0004
 	P521_AES256GCM_SHA512_P521             CipherSuite = 0x0005
-	X448_CHACHA20POLY1305_SHA512_Ed448     CipherSuite = 0x0006 // UNSUPPORTED
+	X448_CHACHA20POLY1305_SHA512_Ed448     CipherSuite = 0x0006
+	P384_AES256GCM_SHA384_P384             CipherSuite = 0x0007
+
+	// EXPERIMENTAL: Post-quantum hybrid KEM, using a code point from the
+	// private use range
+	X25519Kyber768_AES128GCM_SHA256_Ed25519 CipherSuite = 0xF001
 )
 
 func (cs CipherSuite) supported() bool {
@@ -37,7 +48,11 @@ func (cs CipherSuite) supported() bool {
 	case X25519_AES128GCM_SHA256_Ed25519,
 		P256_AES128GCM_SHA256_P256,
 		P521_AES256GCM_SHA512_P521,
-		X25519_CHACHA20POLY1305_SHA256_Ed25519:
+		X25519_CHACHA20POLY1305_SHA256_Ed25519,
+		X448_AES256GCM_SHA512_Ed448,
+		X448_CHACHA20POLY1305_SHA512_Ed448,
+		P384_AES256GCM_SHA384_P384,
+		X25519Kyber768_AES128GCM_SHA256_Ed25519:
 		return true
 	}
 
@@ -58,6 +73,10 @@ func (cs CipherSuite) String() string {
 		return "P521_AES256GCM_SHA512_P521"
 	case X448_CHACHA20POLY1305_SHA512_Ed448:
 		return "X448_CHACHA20POLY1305_SHA512_Ed448"
+	case P384_AES256GCM_SHA384_P384:
+		return "P384_AES256GCM_SHA384_P384"
+	case X25519Kyber768_AES128GCM_SHA256_Ed25519:
+		return "X25519Kyber768_AES128GCM_SHA256_Ed25519"
 	}
 
 	return "UnknownCipherSuite"
@@ -110,6 +129,42 @@ func (cs CipherSuite) Constants() cipherConstants {
 			HPKEKDF:    hpke.KDF_HKDF_SHA512,
 			HPKEAEAD:   hpke.AEAD_AESGCM256,
 		}
+	case X448_AES256GCM_SHA512_Ed448:
+		return cipherConstants{
+			KeySize:    32,
+			NonceSize:  12,
+			SecretSize: 64,
+			HPKEKEM:    hpke.DHKEM_X448,
+			HPKEKDF:    hpke.KDF_HKDF_SHA512,
+			HPKEAEAD:   hpke.AEAD_AESGCM256,
+		}
+	case X448_CHACHA20POLY1305_SHA512_Ed448:
+		return cipherConstants{
+			KeySize:    32,
+			NonceSize:  12,
+			SecretSize: 64,
+			HPKEKEM:    hpke.DHKEM_X448,
+			HPKEKDF:    hpke.KDF_HKDF_SHA512,
+			HPKEAEAD:   hpke.AEAD_CHACHA20POLY1305,
+		}
+	case P384_AES256GCM_SHA384_P384:
+		return cipherConstants{
+			KeySize:    32,
+			NonceSize:  12,
+			SecretSize: 48,
+			HPKEKEM:    dhkemP384,
+			HPKEKDF:    hpke.KDF_HKDF_SHA384,
+			HPKEAEAD:   hpke.AEAD_AESGCM256,
+		}
+	case X25519Kyber768_AES128GCM_SHA256_Ed25519:
+		return cipherConstants{
+			KeySize:    16,
+			NonceSize:  12,
+			SecretSize: 32,
+			HPKEKEM:    kemX25519Kyber768,
+			HPKEKDF:    hpke.KDF_HKDF_SHA256,
+			HPKEAEAD:   hpke.AEAD_AESGCM128,
+		}
 	}
 
 	panic("Unsupported ciphersuite")
@@ -123,13 +178,29 @@ func (cs CipherSuite) Scheme() SignatureScheme {
 		return ECDSA_SECP256R1_SHA256
 	case X25519_CHACHA20POLY1305_SHA256_Ed25519:
 		return Ed25519
+	case X25519Kyber768_AES128GCM_SHA256_Ed25519:
+		return Ed25519
 	case P521_AES256GCM_SHA512_P521:
 		return ECDSA_SECP521R1_SHA512
+	case X448_AES256GCM_SHA512_Ed448, X448_CHACHA20POLY1305_SHA512_Ed448:
+		return Ed448
+	case P384_AES256GCM_SHA384_P384:
+		return ECDSA_SECP384R1_SHA384
 	}
 
 	panic("Unsupported ciphersuite")
 }
 
+func (cs CipherSuite) randomSecret(r io.Reader) ([]byte, error) {
+	secret := make([]byte, cs.Constants().SecretSize)
+	_, err := io.ReadFull(r, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
 func (cs CipherSuite) zero() []byte {
 	return bytes.Repeat([]byte{0x00}, cs.newDigest().Size())
 }
@@ -137,11 +208,15 @@ func (cs CipherSuite) zero() []byte {
 func (cs CipherSuite) newDigest() hash.Hash {
 	switch cs {
 	case X25519_AES128GCM_SHA256_Ed25519, P256_AES128GCM_SHA256_P256,
-		X25519_CHACHA20POLY1305_SHA256_Ed25519:
+		X25519_CHACHA20POLY1305_SHA256_Ed25519, X25519Kyber768_AES128GCM_SHA256_Ed25519:
 		return sha256.New()
 
-	case X448_AES256GCM_SHA512_Ed448, P521_AES256GCM_SHA512_P521:
+	case X448_AES256GCM_SHA512_Ed448, P521_AES256GCM_SHA512_P521,
+		X448_CHACHA20POLY1305_SHA512_Ed448:
 		return sha512.New()
+
+	case P384_AES256GCM_SHA384_P384:
+		return sha512.New384()
 	}
 
 	panic("Unsupported ciphersuite")
@@ -159,16 +234,18 @@ func (cs CipherSuite) NewHMAC(key []byte) hash.Hash {
 
 func (cs CipherSuite) NewAEAD(key []byte) (cipher.AEAD, error) {
 	switch cs {
-	case X25519_AES128GCM_SHA256_Ed25519, P256_AES128GCM_SHA256_P256:
+	case X25519_AES128GCM_SHA256_Ed25519, P256_AES128GCM_SHA256_P256,
+		X25519Kyber768_AES128GCM_SHA256_Ed25519:
 		fallthrough
-	case X448_AES256GCM_SHA512_Ed448, P521_AES256GCM_SHA512_P521:
+	case X448_AES256GCM_SHA512_Ed448, P521_AES256GCM_SHA512_P521,
+		P384_AES256GCM_SHA384_P384:
 		block, err := aes.NewCipher(key)
 		if err != nil {
 			return nil, err
 		}
 
 		return cipher.NewGCM(block)
-	case X25519_CHACHA20POLY1305_SHA256_Ed25519:
+	case X25519_CHACHA20POLY1305_SHA256_Ed25519, X448_CHACHA20POLY1305_SHA512_Ed448:
 		return chacha20poly1305.New(key)
 	}
 
@@ -235,12 +312,28 @@ func (cs CipherSuite) deriveAppSecret(secret []byte, label string, node NodeInde
 
 func (cs CipherSuite) hpke() HPKEInstance {
 	cc := cs.Constants()
-	suite, err := hpke.AssembleCipherSuite(cc.HPKEKEM, cc.HPKEKDF, cc.HPKEAEAD)
+
+	// go-hpke doesn't know about some of our KEMs, so for those we assemble
+	// the suite around another KEM and then swap in our own
+	kemID := cc.HPKEKEM
+	switch kemID {
+	case dhkemP384, kemX25519Kyber768:
+		kemID = hpke.DHKEM_P256
+	}
+
+	suite, err := hpke.AssembleCipherSuite(kemID, cc.HPKEKDF, cc.HPKEAEAD)
 	if err != nil {
 		panic("Unable to construct HPKE ciphersuite")
 	}
 
-	return HPKEInstance{cs, suite}
+	switch cc.HPKEKEM {
+	case dhkemP384:
+		suite.KEM = &p384KEM{KEMScheme: suite.KEM}
+	case kemX25519Kyber768:
+		suite.KEM = &hybridKEM{KEMScheme: suite.KEM, scheme: hybrid.Kyber768X25519()}
+	}
+
+	return HPKEInstance{BaseSuite: cs, Suite: suite}
 }
 
 ///
@@ -268,10 +361,21 @@ type HPKECiphertext struct {
 type HPKEInstance struct {
 	BaseSuite CipherSuite
 	Suite     hpke.CipherSuite
+
+	// Source of randomness for key generation and encryption.  If nil,
+	// crypto/rand.Reader is used.
+	Rand io.Reader
+}
+
+func (h HPKEInstance) random() io.Reader {
+	if h.Rand == nil {
+		return rand.Reader
+	}
+	return h.Rand
 }
 
 func (h HPKEInstance) Generate() (HPKEPrivateKey, error) {
-	priv, pub, err := h.Suite.KEM.GenerateKeyPair(rand.Reader)
+	priv, pub, err := h.Suite.KEM.GenerateKeyPair(h.random())
 	if err != nil {
 		return HPKEPrivateKey{}, err
 	}
@@ -290,10 +394,14 @@ func (h HPKEInstance) Derive(seed []byte) (HPKEPrivateKey, error) {
 		keyPairSecretSize = 32
 	case hpke.DHKEM_P256:
 		keyPairSecretSize = 32
+	case dhkemP384:
+		keyPairSecretSize = 48
 	case hpke.DHKEM_P521:
 		keyPairSecretSize = 66
 	case hpke.DHKEM_X448:
 		keyPairSecretSize = 56
+	case kemX25519Kyber768:
+		keyPairSecretSize = hybrid.Kyber768X25519().SeedSize()
 	}
 
 	cs := h.BaseSuite
@@ -302,10 +410,12 @@ func (h HPKEInstance) Derive(seed []byte) (HPKEPrivateKey, error) {
 	var priv hpke.KEMPrivateKey
 	var err error
 	switch h.BaseSuite.Constants().HPKEKEM {
-	case hpke.DHKEM_P256, hpke.DHKEM_P521, hpke.DHKEM_X25519:
+	case hpke.DHKEM_P256, dhkemP384, hpke.DHKEM_P521, hpke.DHKEM_X25519:
 		priv, err = h.Suite.KEM.UnmarshalPrivate(keyPairSecret)
 	case hpke.DHKEM_X448:
 		priv, err = h.Suite.KEM.UnmarshalPrivate(keyPairSecret)
+	case kemX25519Kyber768:
+		priv = h.Suite.KEM.(*hybridKEM).deriveKeyPair(keyPairSecret)
 	}
 
 	if err != nil {
@@ -326,7 +436,7 @@ func (h HPKEInstance) Encrypt(pub HPKEPublicKey, aad, pt []byte) (HPKECiphertext
 		return HPKECiphertext{}, err
 	}
 
-	enc, ctx, err := hpke.SetupBaseS(h.Suite, rand.Reader, pkR, nil)
+	enc, ctx, err := hpke.SetupBaseS(h.Suite, h.random(), pkR, nil)
 	if err != nil {
 		return HPKECiphertext{}, err
 	}
@@ -349,6 +459,303 @@ func (h HPKEInstance) Decrypt(priv HPKEPrivateKey, aad []byte, ct HPKECiphertext
 	return ctx.Open(aad, ct.Ciphertext)
 }
 
+// Export a secret of the specified size to the holder of the private key
+// corresponding to pub.  Returns the KEM output that the recipient needs in
+// order to derive the same secret, together with the secret itself.
+func (h HPKEInstance) ExportTo(pub HPKEPublicKey, context []byte, size int) ([]byte, []byte, error) {
+	pkR, err := h.Suite.KEM.Unmarshal(pub.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	enc, ctx, err := hpke.SetupBaseS(h.Suite, h.random(), pkR, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return enc, ctx.Export(context, size), nil
+}
+
+func (h HPKEInstance) ExportFrom(priv HPKEPrivateKey, kemOutput, context []byte, size int) ([]byte, error) {
+	skR, err := h.Suite.KEM.UnmarshalPrivate(priv.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, err := hpke.SetupBaseR(h.Suite, skR, kemOutput, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return ctx.Export(context, size), nil
+}
+
+// DHKEM(P-384, HKDF-SHA384), which go-hpke does not provide.  The embedded
+// KEMScheme is only there to satisfy the interface; every method that HPKE
+// calls is overridden here.
+const dhkemP384 hpke.KEMID = 0x0011
+
+const p384ScalarSize = 48
+
+// Key derivation in the KEM is labeled with the KEM's own suite_id and always
+// uses HKDF-SHA384, whatever KDF the HPKE ciphersuite uses (RFC 9180, Section
+// 4.1)
+var p384KEMSuiteID = []byte{'K', 'E', 'M', 0x00, 0x11}
+
+type p384PrivateKey struct {
+	d    []byte
+	x, y *big.Int
+}
+
+func (priv p384PrivateKey) PublicKey() hpke.KEMPublicKey {
+	return &p384PublicKey{priv.x, priv.y}
+}
+
+type p384PublicKey struct {
+	x, y *big.Int
+}
+
+type p384KEM struct {
+	hpke.KEMScheme
+}
+
+func (k p384KEM) ID() hpke.KEMID {
+	return dhkemP384
+}
+
+func (k p384KEM) GenerateKeyPair(rand io.Reader) (hpke.KEMPrivateKey, hpke.KEMPublicKey, error) {
+	d, x, y, err := elliptic.GenerateKey(elliptic.P384(), rand)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	priv := &p384PrivateKey{d, x, y}
+	return priv, priv.PublicKey(), nil
+}
+
+func (k p384KEM) Marshal(pk hpke.KEMPublicKey) []byte {
+	raw, ok := pk.(*p384PublicKey)
+	if !ok {
+		return nil
+	}
+	return elliptic.Marshal(elliptic.P384(), raw.x, raw.y)
+}
+
+func (k p384KEM) Unmarshal(enc []byte) (hpke.KEMPublicKey, error) {
+	x, y := elliptic.Unmarshal(elliptic.P384(), enc)
+	if x == nil {
+		return nil, fmt.Errorf("Error unmarshaling public key")
+	}
+
+	return &p384PublicKey{x, y}, nil
+}
+
+func (k p384KEM) MarshalPrivate(sk hpke.KEMPrivateKey) []byte {
+	raw, ok := sk.(*p384PrivateKey)
+	if !ok {
+		return nil
+	}
+	return dup(raw.d)
+}
+
+func (k p384KEM) UnmarshalPrivate(enc []byte) (hpke.KEMPrivateKey, error) {
+	if len(enc) != p384ScalarSize {
+		return nil, fmt.Errorf("Invalid private key size %d", len(enc))
+	}
+
+	d := new(big.Int).SetBytes(enc)
+	if d.Sign() == 0 || d.Cmp(elliptic.P384().Params().N) >= 0 {
+		return nil, fmt.Errorf("Private key out of range")
+	}
+
+	x, y := elliptic.P384().ScalarBaseMult(enc)
+	return &p384PrivateKey{dup(enc), x, y}, nil
+}
+
+func (k p384KEM) PublicKeySize() int {
+	return 97
+}
+
+func (k p384KEM) dh(skX hpke.KEMPrivateKey, pkY hpke.KEMPublicKey) ([]byte, error) {
+	priv, ok := skX.(*p384PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key not suitable for ECDH")
+	}
+
+	pub, ok := pkY.(*p384PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Public key not suitable for ECDH")
+	}
+
+	// The shared secret is the x-coordinate of the product
+	x, _ := elliptic.P384().ScalarMult(pub.x, pub.y, priv.d)
+	return x.FillBytes(make([]byte, p384ScalarSize)), nil
+}
+
+func (k p384KEM) labeledExtract(salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := append([]byte("HPKE-v1"), p384KEMSuiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return P384_AES256GCM_SHA384_P384.hkdfExtract(salt, labeledIKM)
+}
+
+func (k p384KEM) labeledExpand(prk []byte, label string, info []byte, size int) []byte {
+	labeledInfo := []byte{byte(size >> 8), byte(size)}
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, p384KEMSuiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	return P384_AES256GCM_SHA384_P384.hkdfExpand(prk, labeledInfo, size)
+}
+
+// ExtractAndExpand from RFC 9180, Section 4.1
+func (k p384KEM) sharedSecret(dh, enc, pkRm []byte) []byte {
+	kemContext := append(dup(enc), pkRm...)
+	prk := k.labeledExtract(nil, "eae_prk", dh)
+	return k.labeledExpand(prk, "shared_secret", kemContext, sha512.Size384)
+}
+
+func (k p384KEM) Encap(rand io.Reader, pkR hpke.KEMPublicKey) ([]byte, []byte, error) {
+	skE, pkE, err := k.GenerateKeyPair(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dh, err := k.dh(skE, pkR)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	enc := k.Marshal(pkE)
+	return k.sharedSecret(dh, enc, k.Marshal(pkR)), enc, nil
+}
+
+func (k p384KEM) Decap(enc []byte, skR hpke.KEMPrivateKey) ([]byte, error) {
+	pkE, err := k.Unmarshal(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	dh, err := k.dh(skR, pkE)
+	if err != nil {
+		return nil, err
+	}
+
+	return k.sharedSecret(dh, enc, k.Marshal(skR.PublicKey())), nil
+}
+
+// Hybrid X25519+Kyber768 KEM.  The two shared secrets are concatenated and
+// fed directly into the HPKE key schedule, so the result is secure as long as
+// either component is.  As above, the embedded KEMScheme is only there to
+// satisfy the interface.  Randomness is drawn from the reader that HPKE
+// passes in, rather than circl's internal source.
+const kemX25519Kyber768 hpke.KEMID = 0x0030
+
+type hybridPrivateKey struct {
+	kem.PrivateKey
+}
+
+func (priv hybridPrivateKey) PublicKey() hpke.KEMPublicKey {
+	return priv.Public()
+}
+
+type hybridKEM struct {
+	hpke.KEMScheme
+	scheme kem.Scheme
+}
+
+func (k hybridKEM) ID() hpke.KEMID {
+	return kemX25519Kyber768
+}
+
+func (k hybridKEM) deriveKeyPair(seed []byte) hpke.KEMPrivateKey {
+	_, priv := k.scheme.DeriveKeyPair(seed)
+	return &hybridPrivateKey{priv}
+}
+
+func (k hybridKEM) GenerateKeyPair(rand io.Reader) (hpke.KEMPrivateKey, hpke.KEMPublicKey, error) {
+	seed := make([]byte, k.scheme.SeedSize())
+	_, err := io.ReadFull(rand, seed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	priv := k.deriveKeyPair(seed)
+	return priv, priv.PublicKey(), nil
+}
+
+func (k hybridKEM) Marshal(pk hpke.KEMPublicKey) []byte {
+	raw, ok := pk.(kem.PublicKey)
+	if !ok {
+		return nil
+	}
+
+	data, err := raw.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func (k hybridKEM) Unmarshal(enc []byte) (hpke.KEMPublicKey, error) {
+	return k.scheme.UnmarshalBinaryPublicKey(enc)
+}
+
+func (k hybridKEM) MarshalPrivate(sk hpke.KEMPrivateKey) []byte {
+	raw, ok := sk.(*hybridPrivateKey)
+	if !ok {
+		return nil
+	}
+
+	data, err := raw.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+func (k hybridKEM) UnmarshalPrivate(enc []byte) (hpke.KEMPrivateKey, error) {
+	priv, err := k.scheme.UnmarshalBinaryPrivateKey(enc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &hybridPrivateKey{priv}, nil
+}
+
+func (k hybridKEM) PublicKeySize() int {
+	return k.scheme.PublicKeySize()
+}
+
+func (k hybridKEM) Encap(rand io.Reader, pkR hpke.KEMPublicKey) ([]byte, []byte, error) {
+	pub, ok := pkR.(kem.PublicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("Public key not suitable for hybrid KEM")
+	}
+
+	seed := make([]byte, k.scheme.EncapsulationSeedSize())
+	_, err := io.ReadFull(rand, seed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	enc, zz, err := k.scheme.EncapsulateDeterministically(pub, seed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return zz, enc, nil
+}
+
+func (k hybridKEM) Decap(enc []byte, skR hpke.KEMPrivateKey) ([]byte, error) {
+	priv, ok := skR.(*hybridPrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Private key not suitable for hybrid KEM")
+	}
+
+	return k.scheme.Decapsulate(priv.PrivateKey, enc)
+}
+
 ///
 /// Signing
 ///
@@ -356,6 +763,9 @@ func (h HPKEInstance) Decrypt(priv HPKEPrivateKey, aad []byte, ct HPKECiphertext
 type SignaturePrivateKey struct {
 	Data      []byte `tls:"head=2"`
 	PublicKey SignaturePublicKey
+
+	// If set, signatures are made by this signer rather than with Data
+	Signer crypto.Signer `tls:"omit"`
 }
 
 type SignaturePublicKey struct {
@@ -370,13 +780,16 @@ type SignatureScheme uint16
 
 const (
 	ECDSA_SECP256R1_SHA256 SignatureScheme = 0x0403
+	ECDSA_SECP384R1_SHA384 SignatureScheme = 0x0503
 	ECDSA_SECP521R1_SHA512 SignatureScheme = 0x0603
 	Ed25519                SignatureScheme = 0x0807
+	Ed448                  SignatureScheme = 0x0808
 )
 
 func (ss SignatureScheme) supported() bool {
 	switch ss {
-	case ECDSA_SECP256R1_SHA256, ECDSA_SECP521R1_SHA512, Ed25519:
+	case ECDSA_SECP256R1_SHA256, ECDSA_SECP384R1_SHA384, ECDSA_SECP521R1_SHA512,
+		Ed25519, Ed448:
 		return true
 	}
 
@@ -387,10 +800,14 @@ func (ss SignatureScheme) String() string {
 	switch ss {
 	case ECDSA_SECP256R1_SHA256:
 		return "ECDSA_SECP256R1_SHA256"
+	case ECDSA_SECP384R1_SHA384:
+		return "ECDSA_SECP384R1_SHA384"
 	case ECDSA_SECP521R1_SHA512:
 		return "ECDSA_SECP521R1_SHA512"
 	case Ed25519:
 		return "Ed25519"
+	case Ed448:
+		return "Ed448"
 	}
 
 	return "UnknownSignatureScheme"
@@ -412,6 +829,20 @@ func (ss SignatureScheme) Derive(preSeed []byte) (SignaturePrivateKey, error) {
 		}
 		return key, nil
 
+	case ECDSA_SECP384R1_SHA384:
+		h := sha512.New384()
+		h.Write(preSeed)
+		priv := h.Sum(nil)
+
+		curve := elliptic.P384()
+		x, y := curve.Params().ScalarBaseMult(priv)
+		pub := elliptic.Marshal(curve, x, y)
+		key := SignaturePrivateKey{
+			Data:      priv,
+			PublicKey: SignaturePublicKey{pub},
+		}
+		return key, nil
+
 	case ECDSA_SECP521R1_SHA512:
 		h := sha512.New()
 		h.Write(preSeed)
@@ -437,15 +868,45 @@ func (ss SignatureScheme) Derive(preSeed []byte) (SignaturePrivateKey, error) {
 			PublicKey: SignaturePublicKey{pub},
 		}
 		return key, nil
+
+	case Ed448:
+		seed := make([]byte, ed448.SeedSize)
+		sha3.ShakeSum256(seed, preSeed)
+		priv := ed448.NewKeyFromSeed(seed)
+		pub := priv.Public().(ed448.PublicKey)
+		key := SignaturePrivateKey{
+			Data:      priv,
+			PublicKey: SignaturePublicKey{pub},
+		}
+		return key, nil
 	}
 	panic("Unsupported algorithm")
 }
 
 func (ss SignatureScheme) Generate() (SignaturePrivateKey, error) {
+	return ss.GenerateWithRand(rand.Reader)
+}
+
+// Like Generate, but draws randomness from the specified source
+func (ss SignatureScheme) GenerateWithRand(r io.Reader) (SignaturePrivateKey, error) {
 	switch ss {
 	case ECDSA_SECP256R1_SHA256:
 		curve := elliptic.P256()
-		priv, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+		priv, x, y, err := elliptic.GenerateKey(curve, r)
+		if err != nil {
+			return SignaturePrivateKey{}, err
+		}
+
+		pub := elliptic.Marshal(curve, x, y)
+		key := SignaturePrivateKey{
+			Data:      priv,
+			PublicKey: SignaturePublicKey{pub},
+		}
+		return key, nil
+
+	case ECDSA_SECP384R1_SHA384:
+		curve := elliptic.P384()
+		priv, x, y, err := elliptic.GenerateKey(curve, r)
 		if err != nil {
 			return SignaturePrivateKey{}, err
 		}
@@ -459,7 +920,7 @@ func (ss SignatureScheme) Generate() (SignaturePrivateKey, error) {
 
 	case ECDSA_SECP521R1_SHA512:
 		curve := elliptic.P521()
-		priv, x, y, err := elliptic.GenerateKey(curve, rand.Reader)
+		priv, x, y, err := elliptic.GenerateKey(curve, r)
 		if err != nil {
 			return SignaturePrivateKey{}, err
 		}
@@ -472,7 +933,19 @@ func (ss SignatureScheme) Generate() (SignaturePrivateKey, error) {
 		return key, nil
 
 	case Ed25519:
-		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		pub, priv, err := ed25519.GenerateKey(r)
+		if err != nil {
+			return SignaturePrivateKey{}, err
+		}
+
+		key := SignaturePrivateKey{
+			Data:      priv,
+			PublicKey: SignaturePublicKey{pub},
+		}
+		return key, nil
+
+	case Ed448:
+		pub, priv, err := ed448.GenerateKey(r)
 		if err != nil {
 			return SignaturePrivateKey{}, err
 		}
@@ -490,37 +963,133 @@ type ecdsaSignature struct {
 	R, S *big.Int
 }
 
-func (ss SignatureScheme) Sign(priv *SignaturePrivateKey, message []byte) ([]byte, error) {
+func (ss SignatureScheme) hash() crypto.Hash {
 	switch ss {
 	case ECDSA_SECP256R1_SHA256:
-		h := sha256.New()
-		h.Write(message)
-		digest := h.Sum(nil)
+		return crypto.SHA256
+	case ECDSA_SECP384R1_SHA384:
+		return crypto.SHA384
+	case ECDSA_SECP521R1_SHA512:
+		return crypto.SHA512
+	}
 
-		ecPriv := &ecdsa.PrivateKey{
-			D: big.NewInt(0).SetBytes(priv.Data),
-			PublicKey: ecdsa.PublicKey{
-				Curve: elliptic.P256(),
-			},
-		}
-		return ecPriv.Sign(rand.Reader, digest, nil)
+	return crypto.Hash(0)
+}
 
+func (ss SignatureScheme) curve() elliptic.Curve {
+	switch ss {
+	case ECDSA_SECP256R1_SHA256:
+		return elliptic.P256()
+	case ECDSA_SECP384R1_SHA384:
+		return elliptic.P384()
 	case ECDSA_SECP521R1_SHA512:
-		h := sha512.New()
-		h.Write(message)
-		digest := h.Sum(nil)
+		return elliptic.P521()
+	}
+
+	return nil
+}
+
+// Wrap a crypto.Signer whose private key is held elsewhere, e.g., in a
+// separate signing process.  The resulting key has no private key data, so
+// it is not preserved when a State is serialized; the caller needs to attach
+// the Signer again with State.SetIdentitySigner after unmarshaling.
+func (ss SignatureScheme) FromSigner(signer crypto.Signer) (SignaturePrivateKey, error) {
+	var pub []byte
+	switch key := signer.Public().(type) {
+	case *ecdsa.PublicKey:
+		if ss.curve() == nil || key.Curve != ss.curve() {
+			return SignaturePrivateKey{}, fmt.Errorf("Signer key does not match signature scheme %v", ss)
+		}
+		pub = elliptic.Marshal(key.Curve, key.X, key.Y)
 
+	case ed25519.PublicKey:
+		if ss != Ed25519 {
+			return SignaturePrivateKey{}, fmt.Errorf("Signer key does not match signature scheme %v", ss)
+		}
+		pub = dup(key)
+
+	case ed448.PublicKey:
+		if ss != Ed448 {
+			return SignaturePrivateKey{}, fmt.Errorf("Signer key does not match signature scheme %v", ss)
+		}
+		pub = dup(key)
+
+	default:
+		return SignaturePrivateKey{}, fmt.Errorf("Unsupported signer key type %T", key)
+	}
+
+	key := SignaturePrivateKey{
+		PublicKey: SignaturePublicKey{pub},
+		Signer:    signer,
+	}
+	return key, nil
+}
+
+// A signer for a private key held as raw bytes
+func (ss SignatureScheme) localSigner(priv *SignaturePrivateKey) (crypto.Signer, error) {
+	switch ss {
+	case ECDSA_SECP256R1_SHA256, ECDSA_SECP384R1_SHA384, ECDSA_SECP521R1_SHA512:
+		curve := ss.curve()
+		x, y := curve.ScalarBaseMult(priv.Data)
 		ecPriv := &ecdsa.PrivateKey{
 			D: big.NewInt(0).SetBytes(priv.Data),
 			PublicKey: ecdsa.PublicKey{
-				Curve: elliptic.P521(),
+				Curve: curve,
+				X:     x,
+				Y:     y,
 			},
 		}
-		return ecPriv.Sign(rand.Reader, digest, nil)
+		return ecPriv, nil
 
 	case Ed25519:
-		priv25519 := ed25519.PrivateKey(priv.Data)
-		return ed25519.Sign(priv25519, message), nil
+		if len(priv.Data) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("Invalid Ed25519 private key size")
+		}
+
+		return ed25519.PrivateKey(priv.Data), nil
+
+	case Ed448:
+		if len(priv.Data) != ed448.PrivateKeySize {
+			return nil, fmt.Errorf("Invalid Ed448 private key size")
+		}
+
+		return ed448.PrivateKey(priv.Data), nil
+	}
+	panic("Unsupported algorithm")
+}
+
+func (ss SignatureScheme) Sign(priv *SignaturePrivateKey, message []byte) ([]byte, error) {
+	return ss.SignWithRand(rand.Reader, priv, message)
+}
+
+// Like Sign, but draws any randomness the scheme needs from the specified
+// source.  Ed25519 and Ed448 signatures are deterministic in any case.
+func (ss SignatureScheme) SignWithRand(r io.Reader, priv *SignaturePrivateKey, message []byte) ([]byte, error) {
+	signer := priv.Signer
+	if signer == nil && len(priv.Data) == 0 {
+		return nil, fmt.Errorf("Private key has no key data; its signer must be re-attached")
+	}
+
+	if signer == nil {
+		var err error
+		signer, err = ss.localSigner(priv)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch ss {
+	case ECDSA_SECP256R1_SHA256, ECDSA_SECP384R1_SHA384, ECDSA_SECP521R1_SHA512:
+		h := ss.hash().New()
+		h.Write(message)
+		digest := h.Sum(nil)
+		return signer.Sign(r, digest, ss.hash())
+
+	case Ed25519:
+		return signer.Sign(r, message, crypto.Hash(0))
+
+	case Ed448:
+		return signer.Sign(r, message, ed448.SignerOptions{Scheme: ed448.ED448})
 	}
 	panic("Unsupported algorithm")
 }
@@ -544,6 +1113,23 @@ func (ss SignatureScheme) Verify(pub *SignaturePublicKey, message, signature []b
 		ecPub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
 		return ecdsa.Verify(ecPub, digest, sig.R, sig.S)
 
+	case ECDSA_SECP384R1_SHA384:
+		h := sha512.New384()
+		h.Write(message)
+		digest := h.Sum(nil)
+
+		curve := elliptic.P384()
+		x, y := elliptic.Unmarshal(curve, pub.Data)
+
+		var sig ecdsaSignature
+		_, err := asn1.Unmarshal(signature, &sig)
+		if err != nil {
+			return false
+		}
+
+		ecPub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		return ecdsa.Verify(ecPub, digest, sig.R, sig.S)
+
 	case ECDSA_SECP521R1_SHA512:
 		h := sha512.New()
 		h.Write(message)
@@ -564,6 +1150,10 @@ func (ss SignatureScheme) Verify(pub *SignaturePublicKey, message, signature []b
 	case Ed25519:
 		pub25519 := ed25519.PublicKey(pub.Data)
 		return ed25519.Verify(pub25519, message, signature)
+
+	case Ed448:
+		pub448 := ed448.PublicKey(pub.Data)
+		return ed448.Verify(pub448, message, signature, "")
 	}
 	panic("Unsupported algorithm")
 }
@@ -2,10 +2,16 @@ package mls
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
+	"io"
 	"testing"
 
 	"github.com/cisco/go-tls-syntax"
+	"github.com/cloudflare/circl/sign/ed448"
 	"github.com/stretchr/testify/require"
 )
 
@@ -14,11 +20,17 @@ var supportedSuites = []CipherSuite{
 	P256_AES128GCM_SHA256_P256,
 	X25519_CHACHA20POLY1305_SHA256_Ed25519,
 	P521_AES256GCM_SHA512_P521,
+	X448_AES256GCM_SHA512_Ed448,
+	X448_CHACHA20POLY1305_SHA512_Ed448,
+	P384_AES256GCM_SHA384_P384,
+	X25519Kyber768_AES128GCM_SHA256_Ed25519,
 }
 
 var supportedSchemes = []SignatureScheme{
 	ECDSA_SECP256R1_SHA256,
+	ECDSA_SECP384R1_SHA384,
 	Ed25519,
+	Ed448,
 }
 
 func randomBytes(size int) []byte {
@@ -33,15 +45,20 @@ func TestDigest(t *testing.T) {
 	out256 := unhex("248d6a61d20638b8e5c026930c3e6039a33ce45964ff2167f6ecedd419db06c1")
 	out512 := unhex("204a8fc6dda82f0a0ced7beb8e08a41657c16ef468b228a8279be331a703c3359" +
 		"6fd15c13b1b07f9aa1d3bea57789ca031ad85c7a71dd70354ec631238ca3445")
+	out384 := unhex("3391fdddfc8dc7393707a65b1b4709397cf8b1d162af05abfe8f450de5f36bc6" +
+		"b0455a8520bc4e6f5fe95b1fe3c8452b")
 
 	for _, suite := range supportedSuites {
 		var out []byte
 		switch suite {
 		case X25519_AES128GCM_SHA256_Ed25519, P256_AES128GCM_SHA256_P256,
-			X25519_CHACHA20POLY1305_SHA256_Ed25519:
+			X25519_CHACHA20POLY1305_SHA256_Ed25519, X25519Kyber768_AES128GCM_SHA256_Ed25519:
 			out = out256
-		case P521_AES256GCM_SHA512_P521:
+		case P521_AES256GCM_SHA512_P521, X448_AES256GCM_SHA512_Ed448,
+			X448_CHACHA20POLY1305_SHA512_Ed448:
 			out = out512
+		case P384_AES256GCM_SHA384_P384:
+			out = out384
 		}
 
 		d := suite.Digest(in)
@@ -99,11 +116,12 @@ func TestEncryptDecrypt(t *testing.T) {
 		return func(t *testing.T) {
 			var key, nonce, aad, pt, ct []byte
 			switch suite {
-			case X25519_AES128GCM_SHA256_Ed25519, P256_AES128GCM_SHA256_P256:
+			case X25519_AES128GCM_SHA256_Ed25519, P256_AES128GCM_SHA256_P256,
+				X25519Kyber768_AES128GCM_SHA256_Ed25519:
 				key, nonce, aad, pt, ct = key128, nonce128, aad128, pt128, ct128
-			case X25519_CHACHA20POLY1305_SHA256_Ed25519:
+			case X25519_CHACHA20POLY1305_SHA256_Ed25519, X448_CHACHA20POLY1305_SHA512_Ed448:
 				key, nonce, aad, pt, ct = keyChaCha, nonceChaCha, aadChaCha, ptChaCha, ctChaCha
-			case P521_AES256GCM_SHA512_P521:
+			case P521_AES256GCM_SHA512_P521, X448_AES256GCM_SHA512_Ed448, P384_AES256GCM_SHA384_P384:
 				key, nonce, aad, pt, ct = key256, nonce256, aad256, pt256, ct256
 			}
 
@@ -153,6 +171,112 @@ func TestHPKE(t *testing.T) {
 	}
 }
 
+func TestHybridKEM(t *testing.T) {
+	suite := X25519Kyber768_AES128GCM_SHA256_Ed25519
+	aad := []byte("doo-bee-doo")
+	original := []byte("Attack at dawn!")
+
+	priv, err := suite.hpke().Generate()
+	require.Nil(t, err)
+	require.Equal(t, len(priv.PublicKey.Data), 32+1184)
+
+	// Keys and ciphertexts survive a round trip through the wire encoding
+	privData, err := syntax.Marshal(priv)
+	require.Nil(t, err)
+	var priv2 HPKEPrivateKey
+	_, err = syntax.Unmarshal(privData, &priv2)
+	require.Nil(t, err)
+	require.Equal(t, priv, priv2)
+
+	encrypted, err := suite.hpke().Encrypt(priv.PublicKey, aad, original)
+	require.Nil(t, err)
+	require.Equal(t, len(encrypted.KEMOutput), 32+1088)
+
+	ctData, err := syntax.Marshal(encrypted)
+	require.Nil(t, err)
+	var encrypted2 HPKECiphertext
+	_, err = syntax.Unmarshal(ctData, &encrypted2)
+	require.Nil(t, err)
+
+	decrypted, err := suite.hpke().Decrypt(priv2, aad, encrypted2)
+	require.Nil(t, err)
+	require.Equal(t, original, decrypted)
+
+	// Another key can't decrypt
+	other, err := suite.hpke().Generate()
+	require.Nil(t, err)
+	_, err = suite.hpke().Decrypt(other, aad, encrypted)
+	require.Error(t, err)
+
+	// Key generation draws on the reader it is given
+	seed := bytes.Repeat([]byte{0xA0}, 64)
+	kem := suite.hpke().Suite.KEM
+	priv0, _, err := kem.GenerateKeyPair(bytes.NewReader(seed))
+	require.Nil(t, err)
+	priv1, _, err := kem.GenerateKeyPair(bytes.NewReader(seed))
+	require.Nil(t, err)
+	require.Equal(t, kem.MarshalPrivate(priv0), kem.MarshalPrivate(priv1))
+}
+
+func TestP384KEM(t *testing.T) {
+	// Known-answer test for DHKEM(P-384, HKDF-SHA384) as specified in RFC 9180.
+	// The keys were derived with DeriveKeyPair from fixed IKM, and the shared
+	// secret was checked against an independent RFC 9180 implementation.
+	skRm := unhex("8f4f1cf10546540611fda9f67737f83dedbc79953d86081333e7c347535528e8" +
+		"cae7fef2c301b1bfb22636c0eba6ff31")
+	pkRm := unhex("0452b67215227973c85fd681537be36e1261305ace5d8ff6281ea7269b9cd475" +
+		"bf675fd7819f960c7a4bbd8eefb67f98c103e1591739125e10b166077212bdf0" +
+		"f167ea1c92207acf2b7163df27ef67a0a57ddf6909a5bf1c52b47770976f35d81b")
+	skEm := unhex("dc655cc62e2901e4b3f1c5a03cb84444dfc750f92459230043c01516c6f8267d" +
+		"5fefac051f291981d5baf5d921e296d4")
+	pkEm := unhex("04bc7b8a76ee2ba4fc175a572af3c38450971987079ef0d04581a5e68656cc90" +
+		"df89ec27e13c8c596f9ff98c8c0e64dfca9aac6d056cb5a0bdacbf13b3096934" +
+		"97892b531419c10aa1ff4fd5491f3477abe462058c55e032bd62a56fb176b0d06a")
+	sharedSecret := unhex("913a480a48cdbc8aa3bf00c1fb3c2fc16cdd98bfad3f0feb623549466c3463ea" +
+		"0c9e03552ee332b4784c83fc8f5b7a14")
+
+	kem := P384_AES256GCM_SHA384_P384.hpke().Suite.KEM.(*p384KEM)
+
+	skR, err := kem.UnmarshalPrivate(skRm)
+	require.Nil(t, err)
+	require.Equal(t, pkRm, kem.Marshal(skR.PublicKey()))
+	require.Equal(t, skRm, kem.MarshalPrivate(skR))
+
+	skE, err := kem.UnmarshalPrivate(skEm)
+	require.Nil(t, err)
+	require.Equal(t, pkEm, kem.Marshal(skE.PublicKey()))
+
+	// Encap with the fixed ephemeral key
+	dh, err := kem.dh(skE, skR.PublicKey())
+	require.Nil(t, err)
+	require.Equal(t, sharedSecret, kem.sharedSecret(dh, pkEm, pkRm))
+
+	ss, err := kem.Decap(pkEm, skR)
+	require.Nil(t, err)
+	require.Equal(t, sharedSecret, ss)
+
+	// Encap and Decap agree with a fresh ephemeral key
+	ss, enc, err := kem.Encap(rand.Reader, skR.PublicKey())
+	require.Nil(t, err)
+	ss2, err := kem.Decap(enc, skR)
+	require.Nil(t, err)
+	require.Equal(t, ss, ss2)
+
+	// Private keys must be 48 bytes, in the range [1, n-1]
+	n := elliptic.P384().Params().N
+	badKeys := [][]byte{
+		skRm[1:],
+		append(dup(skRm), 0x00),
+		make([]byte, 48),
+		n.FillBytes(make([]byte, 48)),
+		bytes.Repeat([]byte{0xff}, 48),
+	}
+	for _, bad := range badKeys {
+		_, err = kem.UnmarshalPrivate(bad)
+		require.Error(t, err)
+	}
+}
+
 func TestSignVerify(t *testing.T) {
 	message := []byte("I promise Suhas five dollars")
 	seed := []byte("All the flowers of tomorrow are in the seeds of today")
@@ -178,6 +302,62 @@ func TestSignVerify(t *testing.T) {
 	}
 }
 
+// A signer whose private key is not visible to the library, standing in for
+// one in a separate process
+type countingSigner struct {
+	crypto.Signer
+	calls int
+}
+
+func (cs *countingSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	cs.calls += 1
+	return cs.Signer.Sign(rand, digest, opts)
+}
+
+func newTestSigner(t testing.TB, scheme SignatureScheme) *countingSigner {
+	var signer crypto.Signer
+	var err error
+	switch scheme {
+	case ECDSA_SECP256R1_SHA256, ECDSA_SECP384R1_SHA384, ECDSA_SECP521R1_SHA512:
+		signer, err = ecdsa.GenerateKey(scheme.curve(), rand.Reader)
+	case Ed25519:
+		_, signer, err = ed25519.GenerateKey(rand.Reader)
+	case Ed448:
+		_, signer, err = ed448.GenerateKey(rand.Reader)
+	}
+	require.Nil(t, err)
+	return &countingSigner{Signer: signer}
+}
+
+func TestSignVerifyWithSigner(t *testing.T) {
+	message := []byte("I promise Suhas five dollars")
+
+	for _, scheme := range supportedSchemes {
+		t.Run(scheme.String(), func(t *testing.T) {
+			signer := newTestSigner(t, scheme)
+			priv, err := scheme.FromSigner(signer)
+			require.Nil(t, err)
+			require.Empty(t, priv.Data)
+
+			signature, err := scheme.Sign(&priv, message)
+			require.Nil(t, err)
+			require.Equal(t, signer.calls, 1)
+			require.True(t, scheme.Verify(&priv.PublicKey, message, signature))
+
+			// Without the signer, there is no key to sign with
+			priv.Signer = nil
+			_, err = scheme.Sign(&priv, message)
+			require.Error(t, err)
+		})
+	}
+
+	// The signer's key has to match the scheme
+	_, err := ECDSA_SECP384R1_SHA384.FromSigner(newTestSigner(t, ECDSA_SECP256R1_SHA256))
+	require.Error(t, err)
+	_, err = Ed448.FromSigner(newTestSigner(t, Ed25519))
+	require.Error(t, err)
+}
+
 func TestCipherSuite_String(t *testing.T) {
 	for _, suite := range supportedSuites {
 		require.True(t, len(suite.String()) >  0)
@@ -217,6 +397,12 @@ func generateCryptoVectors(t *testing.T) []byte {
 		Cases: []CryptoTestCase{
 			{CipherSuite: X25519_AES128GCM_SHA256_Ed25519},
 			{CipherSuite: P256_AES128GCM_SHA256_P256},
+			{CipherSuite: X25519_CHACHA20POLY1305_SHA256_Ed25519},
+			{CipherSuite: P521_AES256GCM_SHA512_P521},
+			{CipherSuite: X448_AES256GCM_SHA512_Ed448},
+			{CipherSuite: X448_CHACHA20POLY1305_SHA512_Ed448},
+			{CipherSuite: P384_AES256GCM_SHA384_P384},
+			{CipherSuite: X25519Kyber768_AES128GCM_SHA256_Ed25519},
 		},
 	}
 
@@ -15,6 +15,10 @@ const (
 	ExtensionTypeLifetime              ExtensionType = 0x0003
 	ExtensionTypeKeyID                 ExtensionType = 0x0004
 	ExtensionTypeParentHash            ExtensionType = 0x0005
+	ExtensionTypeExternalSenders       ExtensionType = 0x0006
+	ExtensionTypeWireFormatPolicy      ExtensionType = 0x0007
+	ExtensionTypeRatchetTree           ExtensionType = 0x0008
+	ExtensionTypeSignatureSchemes      ExtensionType = 0x0009
 )
 
 type ExtensionBody interface {
@@ -65,6 +69,17 @@ func (el ExtensionList) Has(extType ExtensionType) bool {
 	return false
 }
 
+// A copy of the list with any extension of the specified type removed
+func (el ExtensionList) without(extType ExtensionType) ExtensionList {
+	out := NewExtensionList()
+	for _, ext := range el.Entries {
+		if ext.ExtensionType != extType {
+			out.Entries = append(out.Entries, ext)
+		}
+	}
+	return out
+}
+
 func (el ExtensionList) Find(dst ExtensionBody) (bool, error) {
 	for _, ext := range el.Entries {
 		if ext.ExtensionType == dst.Type() {
@@ -123,3 +138,71 @@ type ParentHashExtension struct {
 func (phe ParentHashExtension) Type() ExtensionType {
 	return ExtensionTypeParentHash
 }
+
+//////////
+
+// A key trusted to sign proposals for a group, with the scheme it signs with
+type ExternalSender struct {
+	SignatureScheme SignatureScheme
+	SignatureKey    SignaturePublicKey
+}
+
+// Keys trusted to sign Add and Remove proposals for a group without being
+// members.  A preconfigured sender is identified by its index in this list.
+// Its signature scheme must be allowed by the group's SignatureSchemesExtension.
+type ExternalSendersExtension struct {
+	Senders []ExternalSender `tls:"head=4"`
+}
+
+func (ese ExternalSendersExtension) Type() ExtensionType {
+	return ExtensionTypeExternalSenders
+}
+
+//////////
+
+type WireFormatPolicy uint8
+
+const (
+	// Members may send handshake messages as MLSPlaintext or MLSCiphertext
+	WireFormatPolicyPlaintextAllowed WireFormatPolicy = 0
+	// Members must send handshake messages as MLSCiphertext
+	WireFormatPolicyEncryptHandshake WireFormatPolicy = 1
+)
+
+func (wfp WireFormatPolicy) ValidForTLS() error {
+	return validateEnum(wfp, WireFormatPolicyPlaintextAllowed, WireFormatPolicyEncryptHandshake)
+}
+
+type WireFormatPolicyExtension struct {
+	HandshakePolicy WireFormatPolicy
+}
+
+func (wfe WireFormatPolicyExtension) Type() ExtensionType {
+	return ExtensionTypeWireFormatPolicy
+}
+
+//////////
+
+// Carries a group's ratchet tree when it is delivered separately from the
+// Welcome, e.g., by the delivery service, or in the extensions of a GroupInfo
+// whose tree is omitted
+type RatchetTreeExtension struct {
+	Tree TreeKEMPublicKey
+}
+
+func (rte RatchetTreeExtension) Type() ExtensionType {
+	return ExtensionTypeRatchetTree
+}
+
+//////////
+
+// The signature schemes that members of a group may use for their
+// credentials.  Without this extension, only the scheme of the group's
+// ciphersuite is allowed.
+type SignatureSchemesExtension struct {
+	SignatureSchemes []SignatureScheme `tls:"head=1"`
+}
+
+func (sse SignatureSchemesExtension) Type() ExtensionType {
+	return ExtensionTypeSignatureSchemes
+}
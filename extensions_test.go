@@ -117,6 +117,23 @@ var validExtensionTestCases = map[string]ExtensionTestCase{
 		unmarshaled:   &ParentHashExtension{[]byte{0x00, 0x01, 0x02, 0x03}},
 		marshaledHex:  "0400010203",
 	},
+	"SignatureSchemes": {
+		extensionType: ExtensionTypeSignatureSchemes,
+		blank:         new(SignatureSchemesExtension),
+		unmarshaled: &SignatureSchemesExtension{[]SignatureScheme{
+			ECDSA_SECP256R1_SHA256,
+			Ed25519,
+		}},
+		marshaledHex: "0404030807",
+	},
+	"ExternalSenders": {
+		extensionType: ExtensionTypeExternalSenders,
+		blank:         new(ExternalSendersExtension),
+		unmarshaled: &ExternalSendersExtension{[]ExternalSender{
+			{Ed25519, SignaturePublicKey{[]byte{0x01, 0x02}}},
+		}},
+		marshaledHex: "00000006080700020102",
+	},
 }
 
 func TestExtensionBodyMarshalUnmarshal(t *testing.T) {
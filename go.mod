@@ -1,12 +1,19 @@
 module github.com/cisco/go-mls
 
-go 1.14
+go 1.21
 
 require (
-	git.schwanenlied.me/yawning/x448.git v0.0.0-20170617130356-01b048fb03d6 // indirect
 	github.com/cisco/go-hpke v0.0.0-20200603153819-0a6c8374cd9a
 	github.com/cisco/go-tls-syntax v0.0.0-20200615170901-cc95af012391
-	github.com/cloudflare/circl v1.0.0 // indirect
+	github.com/cloudflare/circl v1.3.7
 	github.com/stretchr/testify v1.6.1
-	golang.org/x/crypto v0.0.0-20200604202706-70a84ac30bf9
+	golang.org/x/crypto v0.17.0
+)
+
+require (
+	git.schwanenlied.me/yawning/x448.git v0.0.0-20170617130356-01b048fb03d6 // indirect
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
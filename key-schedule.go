@@ -28,6 +28,49 @@ func zeroize(data []byte) {
 /// Hash ratchet
 ///
 
+// Limits on how far a hash ratchet will go to accommodate out-of-order
+// messages
+type RatchetLimits struct {
+	// The maximum number of generations that a message may skip ahead of the
+	// next expected generation
+	MaxForwardSkip uint32
+
+	// The maximum number of keys cached per sender for messages that have
+	// not yet been received
+	MaxCachedKeys uint32
+
+	// The number of generations behind the next expected generation for which
+	// keys are retained
+	ReplayWindow uint32
+}
+
+var DefaultRatchetLimits = RatchetLimits{
+	MaxForwardSkip: 1024,
+	MaxCachedKeys:  128,
+	ReplayWindow:   128,
+}
+
+type GenerationTooFarError struct {
+	Generation     uint32
+	NextGeneration uint32
+	MaxForwardSkip uint32
+}
+
+func (e GenerationTooFarError) Error() string {
+	return fmt.Sprintf("mls.ratchet: Generation %d is more than %d ahead of %d", e.Generation, e.MaxForwardSkip, e.NextGeneration)
+}
+
+// Returned when the key for a generation has been used, evicted from the
+// cache, or has fallen outside the replay window
+type GenerationExpiredError struct {
+	Generation     uint32
+	NextGeneration uint32
+}
+
+func (e GenerationExpiredError) Error() string {
+	return fmt.Sprintf("mls.ratchet: Request for expired key %d (next %d)", e.Generation, e.NextGeneration)
+}
+
 type hashRatchet struct {
 	Suite          CipherSuite
 	Node           NodeIndex
@@ -52,7 +95,7 @@ func newHashRatchet(suite CipherSuite, node NodeIndex, baseSecret []byte) *hashR
 	}
 }
 
-func (hr *hashRatchet) Next() (uint32, keyAndNonce) {
+func (hr *hashRatchet) Next(limits RatchetLimits) (uint32, keyAndNonce) {
 	key := hr.Suite.deriveAppSecret(hr.NextSecret, "app-key", hr.Node, hr.NextGeneration, int(hr.KeySize))
 	nonce := hr.Suite.deriveAppSecret(hr.NextSecret, "app-nonce", hr.Node, hr.NextGeneration, int(hr.NonceSize))
 	secret := hr.Suite.deriveAppSecret(hr.NextSecret, "app-secret", hr.Node, hr.NextGeneration, int(hr.SecretSize))
@@ -63,28 +106,58 @@ func (hr *hashRatchet) Next() (uint32, keyAndNonce) {
 	zeroize(hr.NextSecret)
 	hr.NextSecret = secret
 
+	// Pruning erases the cached copy in place, so take the output first
 	kn := keyAndNonce{key, nonce}
+	out := kn.clone()
 	hr.Cache[generation] = kn
-	return generation, kn.clone()
+	hr.prune(limits)
+	return generation, out
 }
 
-func (hr *hashRatchet) Get(generation uint32) (keyAndNonce, error) {
+func (hr *hashRatchet) Get(generation uint32, limits RatchetLimits) (keyAndNonce, error) {
 	if kn, ok := hr.Cache[generation]; ok {
-		return kn, nil
+		return kn.clone(), nil
 	}
 
 	if hr.NextGeneration > generation {
-		return keyAndNonce{}, fmt.Errorf("Request for expired key")
+		return keyAndNonce{}, GenerationExpiredError{generation, hr.NextGeneration}
+	}
+
+	if generation-hr.NextGeneration > limits.MaxForwardSkip {
+		return keyAndNonce{}, GenerationTooFarError{generation, hr.NextGeneration, limits.MaxForwardSkip}
 	}
 
 	for hr.NextGeneration < generation {
-		hr.Next()
+		hr.Next(limits)
 	}
 
-	_, kn := hr.Next()
+	_, kn := hr.Next(limits)
 	return kn, nil
 }
 
+// Evict cached keys that are outside the replay window, then the oldest keys
+// until the cache is within its maximum size.  The newest key has just been
+// derived for use, so it is never evicted.
+func (hr *hashRatchet) prune(limits RatchetLimits) {
+	newest := hr.NextGeneration - 1
+	oldest := newest
+	for generation := range hr.Cache {
+		switch {
+		case generation == newest:
+			continue
+		case hr.NextGeneration-generation > limits.ReplayWindow:
+			hr.Erase(generation)
+		case generation < oldest:
+			oldest = generation
+		}
+	}
+
+	for uint32(len(hr.Cache)) > limits.MaxCachedKeys && oldest < newest {
+		hr.Erase(oldest)
+		oldest += 1
+	}
+}
+
 func (hr *hashRatchet) Erase(generation uint32) {
 	if _, ok := hr.Cache[generation]; !ok {
 		return
@@ -95,6 +168,24 @@ func (hr *hashRatchet) Erase(generation uint32) {
 	delete(hr.Cache, generation)
 }
 
+func (hr *hashRatchet) clone() *hashRatchet {
+	next := *hr
+	next.NextSecret = dup(hr.NextSecret)
+	next.Cache = map[uint32]keyAndNonce{}
+	for generation, kn := range hr.Cache {
+		next.Cache[generation] = kn.clone()
+	}
+
+	return &next
+}
+
+func (hr *hashRatchet) zeroize() {
+	zeroize(hr.NextSecret)
+	for generation := range hr.Cache {
+		hr.Erase(generation)
+	}
+}
+
 ///
 /// Base key sources
 ///
@@ -102,6 +193,8 @@ func (hr *hashRatchet) Erase(generation uint32) {
 type baseKeySource interface {
 	Suite() CipherSuite
 	Get(sender LeafIndex) []byte
+	clone() baseKeySource
+	zeroize()
 }
 
 type noFSBaseKeySource struct {
@@ -122,6 +215,14 @@ func (nfbks *noFSBaseKeySource) Get(sender LeafIndex) []byte {
 	return nfbks.CipherSuite.deriveAppSecret(nfbks.RootSecret, "hs-secret", toNodeIndex(sender), 0, secretSize)
 }
 
+func (nfbks *noFSBaseKeySource) clone() baseKeySource {
+	return newNoFSBaseKeySource(nfbks.CipherSuite, dup(nfbks.RootSecret))
+}
+
+func (nfbks *noFSBaseKeySource) zeroize() {
+	zeroize(nfbks.RootSecret)
+}
+
 type Bytes1 []byte
 
 func (b Bytes1) MarshalTLS() ([]byte, error) {
@@ -207,6 +308,23 @@ func (tbks *treeBaseKeySource) Get(sender LeafIndex) []byte {
 	return out
 }
 
+func (tbks *treeBaseKeySource) clone() baseKeySource {
+	next := *tbks
+	next.Secrets = map[NodeIndex]Bytes1{}
+	for node, secret := range tbks.Secrets {
+		next.Secrets[node] = dup(secret)
+	}
+
+	return &next
+}
+
+func (tbks *treeBaseKeySource) zeroize() {
+	for node, secret := range tbks.Secrets {
+		zeroize(secret)
+		delete(tbks.Secrets, node)
+	}
+}
+
 func (tbks *treeBaseKeySource) dump() {
 	w := nodeWidth(tbks.Size)
 	fmt.Println("=== tbks ===")
@@ -227,6 +345,7 @@ func (tbks *treeBaseKeySource) dump() {
 type groupKeySource struct {
 	Base     baseKeySource
 	Ratchets map[LeafIndex]*hashRatchet
+	Limits   RatchetLimits
 }
 
 func (gks groupKeySource) ratchet(sender LeafIndex) *hashRatchet {
@@ -240,27 +359,64 @@ func (gks groupKeySource) ratchet(sender LeafIndex) *hashRatchet {
 }
 
 func (gks groupKeySource) Next(sender LeafIndex) (uint32, keyAndNonce) {
-	return gks.ratchet(sender).Next()
+	return gks.ratchet(sender).Next(gks.Limits)
 }
 
 func (gks groupKeySource) Get(sender LeafIndex, generation uint32) (keyAndNonce, error) {
-	return gks.ratchet(sender).Get(generation)
+	return gks.ratchet(sender).Get(generation, gks.Limits)
 }
 
 func (gks groupKeySource) Erase(sender LeafIndex, generation uint32) {
 	gks.ratchet(sender).Erase(generation)
 }
 
+// A copy of this key source that shares no secrets or state with it, so that
+// either can be used or erased without affecting the other
+func (gks groupKeySource) clone() *groupKeySource {
+	ratchets := map[LeafIndex]*hashRatchet{}
+	for sender, r := range gks.Ratchets {
+		ratchets[sender] = r.clone()
+	}
+
+	return &groupKeySource{gks.Base.clone(), ratchets, gks.Limits}
+}
+
+// Erase all of the secrets held by this key source
+func (gks groupKeySource) zeroize() {
+	gks.Base.zeroize()
+	for sender, r := range gks.Ratchets {
+		r.zeroize()
+		delete(gks.Ratchets, sender)
+	}
+}
+
 ///
 /// GroupInfo keys
 ///
 
-func groupInfoKeyAndNonce(suite CipherSuite, epochSecret []byte) keyAndNonce {
+// PSKs are injected after the joiner secret, so that new members, who receive
+// only the joiner secret, must hold the same PSKs as the rest of the group
+func (cs CipherSuite) memberSecret(joinerSecret, pskIn []byte) []byte {
+	psk := pskIn
+	if len(psk) == 0 {
+		psk = cs.zero()
+	}
+
+	return cs.hkdfExtract(psk, cs.deriveSecret(joinerSecret, "member", []byte{}))
+}
+
+// The secret protecting the GroupInfo in a Welcome.  It does not depend on the
+// group context, which new members only learn from the GroupInfo.
+func (cs CipherSuite) welcomeSecret(joinerSecret, psk []byte) []byte {
+	return cs.deriveSecret(cs.memberSecret(joinerSecret, psk), "welcome", []byte{})
+}
+
+func groupInfoKeyAndNonce(suite CipherSuite, welcomeSecret []byte) keyAndNonce {
 	secretSize := suite.Constants().SecretSize
 	keySize := suite.Constants().KeySize
 	nonceSize := suite.Constants().NonceSize
 
-	groupInfoSecret := suite.hkdfExpandLabel(epochSecret, "group info", []byte{}, secretSize)
+	groupInfoSecret := suite.hkdfExpandLabel(welcomeSecret, "group info", []byte{}, secretSize)
 	groupInfoKey := suite.hkdfExpandLabel(groupInfoSecret, "key", []byte{}, keySize)
 	groupInfoNonce := suite.hkdfExpandLabel(groupInfoSecret, "nonce", []byte{}, nonceSize)
 
@@ -286,12 +442,15 @@ type keyScheduleEpoch struct {
 	ExporterSecret    []byte `tls:"head=1"`
 	ConfirmationKey   []byte `tls:"head=1"`
 	InitSecret        []byte `tls:"head=1"`
+	ResumptionSecret  []byte `tls:"head=1"`
+	ExternalSecret    []byte `tls:"head=1"`
 
 	HandshakeBaseKeys   *noFSBaseKeySource
 	ApplicationBaseKeys *treeBaseKeySource
 
 	HandshakeRatchets   map[LeafIndex]*hashRatchet `tls:"head=4"`
 	ApplicationRatchets map[LeafIndex]*hashRatchet `tls:"head=4"`
+	Limits              RatchetLimits
 
 	ApplicationKeys *groupKeySource `tls:"omit"`
 	HandshakeKeys   *groupKeySource `tls:"omit"`
@@ -304,6 +463,8 @@ func newKeyScheduleEpoch(suite CipherSuite, size LeafCount, epochSecret, context
 	exporterSecret := suite.deriveSecret(epochSecret, "exporter", context)
 	confirmationKey := suite.deriveSecret(epochSecret, "confirm", context)
 	initSecret := suite.deriveSecret(epochSecret, "init", context)
+	resumptionSecret := suite.deriveSecret(epochSecret, "resumption", context)
+	externalSecret := suite.deriveSecret(epochSecret, "external", context)
 
 	senderDataKey := suite.hkdfExpandLabel(senderDataSecret, "sd key", []byte{}, suite.Constants().KeySize)
 	handshakeBaseKeys := newNoFSBaseKeySource(suite, handshakeSecret)
@@ -321,12 +482,15 @@ func newKeyScheduleEpoch(suite CipherSuite, size LeafCount, epochSecret, context
 		ExporterSecret:    exporterSecret,
 		ConfirmationKey:   confirmationKey,
 		InitSecret:        initSecret,
+		ResumptionSecret:  resumptionSecret,
+		ExternalSecret:    externalSecret,
 
 		HandshakeBaseKeys:   handshakeBaseKeys,
 		ApplicationBaseKeys: applicationBaseKeys,
 
 		HandshakeRatchets:   map[LeafIndex]*hashRatchet{},
 		ApplicationRatchets: map[LeafIndex]*hashRatchet{},
+		Limits:              DefaultRatchetLimits,
 	}
 
 	kse.enableKeySources()
@@ -335,20 +499,85 @@ func newKeyScheduleEpoch(suite CipherSuite, size LeafCount, epochSecret, context
 
 // Wire up the key sources as logic on top of data owned by the epoch
 func (kse *keyScheduleEpoch) enableKeySources() {
-	kse.HandshakeKeys = &groupKeySource{kse.HandshakeBaseKeys, kse.HandshakeRatchets}
-	kse.ApplicationKeys = &groupKeySource{kse.ApplicationBaseKeys, kse.ApplicationRatchets}
+	kse.HandshakeKeys = &groupKeySource{kse.HandshakeBaseKeys, kse.HandshakeRatchets, kse.Limits}
+	kse.ApplicationKeys = &groupKeySource{kse.ApplicationBaseKeys, kse.ApplicationRatchets, kse.Limits}
 }
 
-func (kse *keyScheduleEpoch) Next(size LeafCount, pskIn, commitSecret, context []byte) keyScheduleEpoch {
-	psk := pskIn
-	if len(psk) == 0 {
-		psk = kse.Suite.zero()
+// The key pair to which new members encrypt when joining via an external commit
+func (kse keyScheduleEpoch) ExternalPriv() (HPKEPrivateKey, error) {
+	return kse.Suite.hpke().Derive(kse.ExternalSecret)
+}
+
+// Start an epoch from its joiner secret, as new members do.  The joiner secret
+// is not kept in the epoch; the caller is responsible for erasing it.
+func newJoinedKeyScheduleEpoch(suite CipherSuite, size LeafCount, joinerSecret, psk, context []byte) keyScheduleEpoch {
+	memberSecret := suite.memberSecret(joinerSecret, psk)
+	epochSecret := suite.deriveSecret(memberSecret, "epoch", context)
+	zeroize(memberSecret)
+	return newKeyScheduleEpoch(suite, size, epochSecret, context)
+}
+
+// The joiner secret for the epoch following this one
+func (kse keyScheduleEpoch) joinerSecret(commitSecret []byte) []byte {
+	return kse.Suite.hkdfExtract(commitSecret, kse.InitSecret)
+}
+
+func (kse *keyScheduleEpoch) Next(size LeafCount, psk, commitSecret, context []byte) keyScheduleEpoch {
+	joinerSecret := kse.joinerSecret(commitSecret)
+	next := newJoinedKeyScheduleEpoch(kse.Suite, size, joinerSecret, psk, context)
+	zeroize(joinerSecret)
+
+	// Limits carry over from one epoch to the next
+	if kse.Limits != (RatchetLimits{}) {
+		next.setLimits(kse.Limits)
+	}
+
+	return next
+}
+
+func (kse *keyScheduleEpoch) setLimits(limits RatchetLimits) {
+	kse.Limits = limits
+	kse.enableKeySources()
+}
+
+///
+/// Pre-shared keys
+///
+
+type pskLabel struct {
+	ID    PreSharedKeyID
+	Index uint16
+	Count uint16
+}
+
+// Combine a list of PSKs into a single PSK secret for input to the key
+// schedule.  Each PSK is bound to its ID and its position in the list, so that
+// the same set of PSKs in a different order results in a different secret.
+// If no PSKs are provided, the result is nil, which the key schedule treats as
+// the all-zero PSK.
+func (cs CipherSuite) pskSecret(ids []PreSharedKeyID, psks [][]byte) ([]byte, error) {
+	if len(ids) != len(psks) {
+		return nil, fmt.Errorf("mls.psk: %d PSK IDs for %d PSKs", len(ids), len(psks))
+	}
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	secretSize := cs.Constants().SecretSize
+	pskSecret := cs.zero()
+	for i := range ids {
+		label, err := syntax.Marshal(pskLabel{ids[i], uint16(i), uint16(len(ids))})
+		if err != nil {
+			return nil, err
+		}
+
+		extracted := cs.hkdfExtract(cs.zero(), psks[i])
+		pskInput := cs.hkdfExpandLabel(extracted, "derived psk", label, secretSize)
+		pskSecret = cs.hkdfExtract(pskInput, pskSecret)
 	}
 
-	earlySecret := kse.Suite.hkdfExtract(psk, kse.InitSecret)
-	preEpochSecret := kse.Suite.deriveSecret(earlySecret, "derived", context)
-	epochSecret := kse.Suite.hkdfExtract(commitSecret, preEpochSecret)
-	return newKeyScheduleEpoch(kse.Suite, size, epochSecret, context)
+	return pskSecret, nil
 }
 
 func (kse *keyScheduleEpoch) Export(label string, context []byte, keyLength int) []byte {
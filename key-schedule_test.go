@@ -54,6 +54,8 @@ func TestKeySchedule(t *testing.T) {
 		require.Equal(t, len(epoch.ExporterSecret), secretSize)
 		require.Equal(t, len(epoch.ConfirmationKey), secretSize)
 		require.Equal(t, len(epoch.InitSecret), secretSize)
+		require.Equal(t, len(epoch.ResumptionSecret), secretSize)
+		require.Equal(t, len(epoch.ExternalSecret), secretSize)
 		require.NotNil(t, epoch.HandshakeKeys)
 		require.NotNil(t, epoch.HandshakeKeys)
 
@@ -90,6 +92,16 @@ func TestKeySchedule(t *testing.T) {
 	epoch2 := epoch1.Next(size2, psk2, commitSecret2, context2)
 	checkEpoch(&epoch2, size2)
 
+	// New members reach the same epoch from the joiner secret, but only with
+	// the same PSK
+	joinerSecret2 := epoch1.joinerSecret(commitSecret2)
+	joined := newJoinedKeyScheduleEpoch(suite, size2, joinerSecret2, psk2, context2)
+	require.Equal(t, epoch2.EpochSecret, joined.EpochSecret)
+	require.NotEqual(t, suite.welcomeSecret(joinerSecret2, psk2), suite.welcomeSecret(joinerSecret2, nil))
+
+	joined = newJoinedKeyScheduleEpoch(suite, size2, joinerSecret2, nil, context2)
+	require.NotEqual(t, epoch2.EpochSecret, joined.EpochSecret)
+
 	// Check that marshal/unmarshal works
 	epoch2m, err := syntax.Marshal(epoch2)
 	require.Nil(t, err)
@@ -113,6 +125,7 @@ func TestKeySchedule(t *testing.T) {
 	require.Equal(t, epoch2.ApplicationBaseKeys, epoch2u.ApplicationBaseKeys)
 	require.Equal(t, epoch2.HandshakeRatchets, epoch2u.HandshakeRatchets)
 	require.Equal(t, epoch2.ApplicationRatchets, epoch2u.ApplicationRatchets)
+	require.Equal(t, epoch2.Limits, epoch2u.Limits)
 
 	// Verify that we can't get a key for the target generation (because it's
 	// already consumed)
@@ -125,6 +138,96 @@ func TestKeySchedule(t *testing.T) {
 	require.Nil(t, err)
 }
 
+func TestRatchetLimits(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	baseSecret := unhex("000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f")
+	limits := RatchetLimits{
+		MaxForwardSkip: 10,
+		MaxCachedKeys:  4,
+		ReplayWindow:   8,
+	}
+
+	// Skipping too far ahead fails without advancing the ratchet
+	hr := newHashRatchet(suite, 0, baseSecret)
+	_, err := hr.Get(11, limits)
+	require.Equal(t, GenerationTooFarError{11, 0, 10}, err)
+	require.Equal(t, uint32(0), hr.NextGeneration)
+
+	// Skipping ahead caches only the most recent keys
+	_, err = hr.Get(10, limits)
+	require.Nil(t, err)
+	require.Equal(t, len(hr.Cache), 4)
+	for gen := uint32(7); gen <= 10; gen += 1 {
+		_, ok := hr.Cache[gen]
+		require.True(t, ok)
+	}
+
+	_, err = hr.Get(3, limits)
+	require.Equal(t, GenerationExpiredError{3, 11}, err)
+
+	// Used keys can't be replayed
+	hr.Erase(10)
+	_, err = hr.Get(10, limits)
+	require.Equal(t, GenerationExpiredError{10, 11}, err)
+
+	// Keys fall out of the replay window as the ratchet advances
+	limits.MaxCachedKeys = 100
+	_, err = hr.Get(15, limits)
+	require.Nil(t, err)
+	_, err = hr.Get(7, limits)
+	require.Equal(t, GenerationExpiredError{7, 16}, err)
+	_, err = hr.Get(8, limits)
+	require.Nil(t, err)
+	limits.MaxCachedKeys = 4
+
+	// The key just derived survives pruning, even with nothing cached
+	zero := make([]byte, suite.Constants().KeySize)
+	hr = newHashRatchet(suite, 0, dup(baseSecret))
+	for gen := uint32(0); gen < 3; gen += 1 {
+		_, kn := hr.Next(RatchetLimits{MaxForwardSkip: 1024})
+		require.NotEqual(t, zero, kn.Key)
+		require.Equal(t, len(hr.Cache), 1)
+	}
+
+	// Limits carry over to subsequent epochs
+	epoch := newKeyScheduleEpoch(suite, 2, baseSecret, []byte("context"))
+	require.Equal(t, DefaultRatchetLimits, epoch.Limits)
+
+	epoch.setLimits(limits)
+	next := epoch.Next(2, nil, baseSecret, []byte("context"))
+	require.Equal(t, limits, next.Limits)
+	require.Equal(t, limits, next.ApplicationKeys.Limits)
+
+	_, err = next.ApplicationKeys.Get(1, 11)
+	require.Equal(t, GenerationTooFarError{11, 0, 10}, err)
+}
+
+func TestPSKSecret(t *testing.T) {
+	suite := P256_AES128GCM_SHA256_P256
+	idA := NewExternalPSKID([]byte("a"))
+	idB := NewResumptionPSKID([]byte("group"), 3)
+	pskA := []byte("psk a")
+	pskB := []byte("psk b")
+
+	// No PSKs means no PSK secret
+	secret, err := suite.pskSecret(nil, nil)
+	require.Nil(t, err)
+	require.Nil(t, secret)
+
+	// Mismatched lists are rejected
+	_, err = suite.pskSecret([]PreSharedKeyID{idA}, nil)
+	require.Error(t, err)
+
+	// The PSK secret depends on the order of the PSKs
+	secretAB, err := suite.pskSecret([]PreSharedKeyID{idA, idB}, [][]byte{pskA, pskB})
+	require.Nil(t, err)
+	require.Equal(t, len(secretAB), suite.Constants().SecretSize)
+
+	secretBA, err := suite.pskSecret([]PreSharedKeyID{idB, idA}, [][]byte{pskB, pskA})
+	require.Nil(t, err)
+	require.NotEqual(t, secretAB, secretBA)
+}
+
 ///
 /// Vectors
 ///
@@ -134,6 +237,8 @@ type KsEpoch struct {
 	PSK          []byte `tls:"head=1"`
 	CommitSecret []byte `tls:"head=1"`
 
+	JoinerSecret     []byte        `tls:"head=1"`
+	WelcomeSecret    []byte        `tls:"head=1"`
 	EpochSecret      []byte        `tls:"head=1"`
 	SenderDataSecret []byte        `tls:"head=1"`
 	SenderDataKey    []byte        `tls:"head=1"`
@@ -166,7 +271,12 @@ type KsTestVectors struct {
 /// Gen and Verify
 func generateKeyScheduleVectors(t *testing.T) []byte {
 	var tv KsTestVectors
-	suites := []CipherSuite{P256_AES128GCM_SHA256_P256}
+	suites := []CipherSuite{
+		P256_AES128GCM_SHA256_P256,
+		X448_AES256GCM_SHA512_Ed448,
+		X448_CHACHA20POLY1305_SHA512_Ed448,
+		P384_AES256GCM_SHA384_P384,
+	}
 	baseGrpCtx := GroupContext{
 		GroupID:                 []byte{0xA0, 0xA0, 0xA0, 0xA0},
 		Epoch:                   0,
@@ -201,6 +311,7 @@ func generateKeyScheduleVectors(t *testing.T) []byte {
 
 			psk := []byte(fmt.Sprintf("psk @ %d", i))
 			commitSecret := []byte(fmt.Sprintf("commitSecret @ %d", i))
+			joinerSecret := epoch.joinerSecret(commitSecret)
 			epoch = epoch.Next(LeafCount(nMembers), psk, commitSecret, ctx)
 
 			var handshakeKeys []keyAndNonce
@@ -220,6 +331,8 @@ func generateKeyScheduleVectors(t *testing.T) []byte {
 				CommitSecret: commitSecret,
 
 				NumMembers:       LeafCount(nMembers),
+				JoinerSecret:     joinerSecret,
+				WelcomeSecret:    suite.welcomeSecret(joinerSecret, psk),
 				EpochSecret:      epoch.EpochSecret,
 				SenderDataSecret: epoch.SenderDataSecret,
 				SenderDataKey:    epoch.SenderDataKey,
@@ -260,9 +373,12 @@ func verifyKeyScheduleVectors(t *testing.T, data []byte) {
 		myEpoch.InitSecret = tv.BaseInitSecret
 		for _, epoch := range tc.Epochs {
 			ctx, _ := syntax.Marshal(grpCtx)
+			joinerSecret := myEpoch.joinerSecret(epoch.CommitSecret)
 			myEpoch = myEpoch.Next(epoch.NumMembers, epoch.PSK, epoch.CommitSecret, ctx)
 
 			// check the secrets
+			require.Equal(t, joinerSecret, epoch.JoinerSecret)
+			require.Equal(t, suite.welcomeSecret(joinerSecret, epoch.PSK), epoch.WelcomeSecret)
 			require.Equal(t, myEpoch.EpochSecret, epoch.EpochSecret)
 			require.Equal(t, myEpoch.SenderDataSecret, epoch.SenderDataSecret)
 			require.Equal(t, myEpoch.SenderDataKey, epoch.SenderDataKey)
@@ -1,7 +1,10 @@
 package mls
 
 import (
+	"bytes"
+	"crypto/rand"
 	"fmt"
+	"io"
 	"reflect"
 	"time"
 
@@ -28,10 +31,69 @@ var (
 		P256_AES128GCM_SHA256_P256,
 		X25519_CHACHA20POLY1305_SHA256_Ed25519,
 		P521_AES256GCM_SHA512_P521,
+		X448_AES256GCM_SHA512_Ed448,
+		X448_CHACHA20POLY1305_SHA512_Ed448,
+		P384_AES256GCM_SHA384_P384,
 	}
 	defaultLifetime = 30 * 24 * time.Hour
 )
 
+// Ciphersuites that are implemented but not supported by default.  A
+// KeyPackage only advertises one of these if it uses it, or if the caller lists
+// it in the KeyPackage's SupportedCipherSuitesExtension.
+var experimentalCipherSuites = []CipherSuite{
+	X25519Kyber768_AES128GCM_SHA256_Ed25519,
+}
+
+func containsCipherSuite(suites []CipherSuite, suite CipherSuite) bool {
+	for _, cs := range suites {
+		if cs == suite {
+			return true
+		}
+	}
+	return false
+}
+
+// A source of the current time, which can be replaced to control the time
+// seen by lifetime checks
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (sc systemClock) Now() time.Time {
+	return time.Now()
+}
+
+var SystemClock Clock = systemClock{}
+
+// Settings for the lifetimes of KeyPackages
+type LifetimeConfig struct {
+	// The source of the current time
+	Clock Clock
+
+	// How long a new KeyPackage is valid
+	Lifetime time.Duration
+
+	// How far the creator's clock may be off from ours when checking whether
+	// a KeyPackage is within its lifetime.  No skew is allowed unless this is
+	// set.
+	ClockSkew time.Duration
+}
+
+var DefaultLifetimeConfig = LifetimeConfig{
+	Clock:    SystemClock,
+	Lifetime: defaultLifetime,
+}
+
+func (lc LifetimeConfig) now() time.Time {
+	if lc.Clock == nil {
+		return time.Now()
+	}
+	return lc.Clock.Now()
+}
+
 type KeyPackage struct {
 	Version     ProtocolVersion
 	CipherSuite CipherSuite
@@ -96,6 +158,15 @@ func (kp *KeyPackage) SetExtensions(exts []ExtensionBody) error {
 }
 
 func (kp *KeyPackage) Sign(priv SignaturePrivateKey) error {
+	return kp.sign(priv, rand.Reader)
+}
+
+// Like Sign, but draws any randomness from the specified source
+func (kp *KeyPackage) SignWithRand(r io.Reader, priv SignaturePrivateKey) error {
+	return kp.sign(priv, r)
+}
+
+func (kp *KeyPackage) sign(priv SignaturePrivateKey, r io.Reader) error {
 	if !priv.PublicKey.Equals(*kp.Credential.PublicKey()) {
 		return fmt.Errorf("Public key mismatch")
 	}
@@ -105,7 +176,7 @@ func (kp *KeyPackage) Sign(priv SignaturePrivateKey) error {
 		return err
 	}
 
-	sig, err := kp.Credential.Scheme().Sign(&priv, tbs)
+	sig, err := kp.Credential.Scheme().SignWithRand(r, &priv, tbs)
 	if err != nil {
 		return err
 	}
@@ -114,36 +185,67 @@ func (kp *KeyPackage) Sign(priv SignaturePrivateKey) error {
 	return nil
 }
 
-func (kp KeyPackage) Verify() bool {
-	// Check for required extensions, but do not verify contents
-	var sve SupportedVersionsExtension
-	var sce SupportedCipherSuitesExtension
-	foundSV, _ := kp.Extensions.Find(&sve)
-	foundSC, _ := kp.Extensions.Find(&sce)
-	if !foundSV || !foundSC {
-		return false
-	}
-
-	// Verify that the KeyPackage has not expired
+// Verify that the current time is within the KeyPackage's lifetime, allowing
+// for the configured clock skew
+func (kp KeyPackage) VerifyLifetime(cfg LifetimeConfig) error {
 	var lifetimeExt LifetimeExtension
 	found, err := kp.Extensions.Find(&lifetimeExt)
-	if !found || err != nil {
-		return false
+	if err != nil {
+		return err
+	} else if !found {
+		return fmt.Errorf("KeyPackage has no lifetime")
 	}
 
-	now := time.Now()
-	notAfter := time.Unix(int64(lifetimeExt.NotAfter), 0)
+	now := cfg.now()
+	notAfter := time.Unix(int64(lifetimeExt.NotAfter), 0).Add(cfg.ClockSkew)
 	if now.After(notAfter) {
-		return false
+		return fmt.Errorf("KeyPackage expired at %v", notAfter)
 	}
-	notBefore := time.Unix(int64(lifetimeExt.NotBefore), 0)
+	notBefore := time.Unix(int64(lifetimeExt.NotBefore), 0).Add(-cfg.ClockSkew)
 	if now.Before(notBefore) {
+		return fmt.Errorf("KeyPackage not valid until %v", notBefore)
+	}
+
+	return nil
+}
+
+// Verify the KeyPackage against the system clock, with no allowance for clock
+// skew.  Use VerifyWithLifetime to allow for skew.
+func (kp KeyPackage) Verify() bool {
+	return kp.VerifyWithLifetime(LifetimeConfig{Clock: SystemClock})
+}
+
+// Verify the KeyPackage with the specified lifetime settings.  The credential
+// must use the signature scheme of the KeyPackage's ciphersuite.
+func (kp KeyPackage) VerifyWithLifetime(cfg LifetimeConfig) bool {
+	return kp.verify(cfg, []SignatureScheme{kp.CipherSuite.Scheme()})
+}
+
+// Like VerifyWithLifetime, but the credential may use any of the specified
+// signature schemes, e.g., those that a group allows
+func (kp KeyPackage) verify(cfg LifetimeConfig, schemes []SignatureScheme) bool {
+	// Verify that the KeyPackage has not expired
+	if kp.VerifyLifetime(cfg) != nil {
+		return false
+	}
+
+	return kp.verifySignature(schemes)
+}
+
+// Check the required extensions and the signature, but not the lifetime
+func (kp KeyPackage) verifySignature(schemes []SignatureScheme) bool {
+	// Check for required extensions, but do not verify contents
+	var sve SupportedVersionsExtension
+	var sce SupportedCipherSuitesExtension
+	foundSV, _ := kp.Extensions.Find(&sve)
+	foundSC, _ := kp.Extensions.Find(&sce)
+	if !foundSV || !foundSC {
 		return false
 	}
 
-	// Verify the signature
+	// Verify the signature with one of the allowed schemes
 	scheme := kp.Credential.Scheme()
-	if scheme != kp.CipherSuite.Scheme() {
+	if !containsScheme(schemes, scheme) || !scheme.supported() {
 		return false
 	}
 
@@ -152,19 +254,27 @@ func (kp KeyPackage) Verify() bool {
 		return false
 	}
 
-	return kp.Credential.Scheme().Verify(kp.Credential.PublicKey(), tbs, kp.Signature.Data)
+	return scheme.Verify(kp.Credential.PublicKey(), tbs, kp.Signature.Data)
 }
 
 func NewKeyPackageWithSecret(suite CipherSuite, initSecret []byte, cred *Credential, sigPriv SignaturePrivateKey) (*KeyPackage, error) {
+	return NewKeyPackageWithSecretAndLifetime(suite, initSecret, cred, sigPriv, DefaultLifetimeConfig)
+}
+
+func NewKeyPackageWithSecretAndLifetime(suite CipherSuite, initSecret []byte, cred *Credential, sigPriv SignaturePrivateKey, cfg LifetimeConfig) (*KeyPackage, error) {
 	initPriv, err := suite.hpke().Derive(initSecret)
 	if err != nil {
 		return nil, err
 	}
 
-	return NewKeyPackageWithInitKey(suite, initPriv.PublicKey, cred, sigPriv)
+	return NewKeyPackageWithInitKeyAndLifetime(suite, initPriv.PublicKey, cred, sigPriv, cfg)
 }
 
 func NewKeyPackageWithInitKey(suite CipherSuite, initKey HPKEPublicKey, cred *Credential, sigPriv SignaturePrivateKey) (*KeyPackage, error) {
+	return NewKeyPackageWithInitKeyAndLifetime(suite, initKey, cred, sigPriv, DefaultLifetimeConfig)
+}
+
+func NewKeyPackageWithInitKeyAndLifetime(suite CipherSuite, initKey HPKEPublicKey, cred *Credential, sigPriv SignaturePrivateKey, cfg LifetimeConfig) (*KeyPackage, error) {
 	kp := &KeyPackage{
 		Version:     ProtocolVersionMLS10,
 		CipherSuite: suite,
@@ -178,12 +288,17 @@ func NewKeyPackageWithInitKey(suite CipherSuite, initKey HPKEPublicKey, cred *Cr
 		return nil, err
 	}
 
-	err = kp.Extensions.Add(SupportedCipherSuitesExtension{supportedCipherSuites})
+	suites := supportedCipherSuites
+	if containsCipherSuite(experimentalCipherSuites, suite) {
+		suites = append(append([]CipherSuite{}, supportedCipherSuites...), suite)
+	}
+
+	err = kp.Extensions.Add(SupportedCipherSuitesExtension{suites})
 	if err != nil {
 		return nil, err
 	}
 
-	expiry := uint64(time.Now().Add(defaultLifetime).Unix())
+	expiry := uint64(cfg.now().Add(cfg.Lifetime).Unix())
 	err = kp.Extensions.Add(LifetimeExtension{NotBefore: 0, NotAfter: expiry})
 	if err != nil {
 		return nil, err
@@ -203,14 +318,19 @@ func NewKeyPackageWithInitKey(suite CipherSuite, initKey HPKEPublicKey, cred *Cr
 type ProposalType uint8
 
 const (
-	ProposalTypeInvalid ProposalType = 0
-	ProposalTypeAdd     ProposalType = 1
-	ProposalTypeUpdate  ProposalType = 2
-	ProposalTypeRemove  ProposalType = 3
+	ProposalTypeInvalid      ProposalType = 0
+	ProposalTypeAdd          ProposalType = 1
+	ProposalTypeUpdate       ProposalType = 2
+	ProposalTypeRemove       ProposalType = 3
+	ProposalTypePreSharedKey ProposalType = 4
+	ProposalTypeReInit       ProposalType = 5
+
+	ProposalTypeGroupContextExtensions ProposalType = 6
 )
 
 func (pt ProposalType) ValidForTLS() error {
-	return validateEnum(pt, ProposalTypeAdd, ProposalTypeUpdate, ProposalTypeRemove)
+	return validateEnum(pt, ProposalTypeAdd, ProposalTypeUpdate, ProposalTypeRemove, ProposalTypePreSharedKey, ProposalTypeReInit,
+		ProposalTypeGroupContextExtensions)
 }
 
 type AddProposal struct {
@@ -225,10 +345,29 @@ type RemoveProposal struct {
 	Removed LeafIndex
 }
 
+type PreSharedKeyProposal struct {
+	PSK PreSharedKeyID
+}
+
+type ReInitProposal struct {
+	GroupID     []byte `tls:"head=1"`
+	Version     ProtocolVersion
+	CipherSuite CipherSuite
+	Extensions  ExtensionList
+}
+
+type GroupContextExtensionsProposal struct {
+	Extensions ExtensionList
+}
+
 type Proposal struct {
-	Add    *AddProposal
-	Update *UpdateProposal
-	Remove *RemoveProposal
+	Add          *AddProposal
+	Update       *UpdateProposal
+	Remove       *RemoveProposal
+	PreSharedKey *PreSharedKeyProposal
+	ReInit       *ReInitProposal
+
+	GroupContextExtensions *GroupContextExtensionsProposal
 }
 
 func (p Proposal) Type() ProposalType {
@@ -239,6 +378,12 @@ func (p Proposal) Type() ProposalType {
 		return ProposalTypeUpdate
 	case p.Remove != nil:
 		return ProposalTypeRemove
+	case p.PreSharedKey != nil:
+		return ProposalTypePreSharedKey
+	case p.ReInit != nil:
+		return ProposalTypeReInit
+	case p.GroupContextExtensions != nil:
+		return ProposalTypeGroupContextExtensions
 	default:
 		panic("Malformed proposal")
 	}
@@ -259,6 +404,12 @@ func (p Proposal) MarshalTLS() ([]byte, error) {
 		err = s.Write(p.Update)
 	case ProposalTypeRemove:
 		err = s.Write(p.Remove)
+	case ProposalTypePreSharedKey:
+		err = s.Write(p.PreSharedKey)
+	case ProposalTypeReInit:
+		err = s.Write(p.ReInit)
+	case ProposalTypeGroupContextExtensions:
+		err = s.Write(p.GroupContextExtensions)
 	default:
 		return nil, fmt.Errorf("mls.proposal: ProposalType type not allowed: %v", err)
 	}
@@ -288,6 +439,15 @@ func (p *Proposal) UnmarshalTLS(data []byte) (int, error) {
 	case ProposalTypeRemove:
 		p.Remove = new(RemoveProposal)
 		_, err = s.Read(p.Remove)
+	case ProposalTypePreSharedKey:
+		p.PreSharedKey = new(PreSharedKeyProposal)
+		_, err = s.Read(p.PreSharedKey)
+	case ProposalTypeReInit:
+		p.ReInit = new(ReInitProposal)
+		_, err = s.Read(p.ReInit)
+	case ProposalTypeGroupContextExtensions:
+		p.GroupContextExtensions = new(GroupContextExtensionsProposal)
+		_, err = s.Read(p.GroupContextExtensions)
 	default:
 		err = fmt.Errorf("mls.proposal: ProposalType type not allowed")
 	}
@@ -299,6 +459,131 @@ func (p *Proposal) UnmarshalTLS(data []byte) (int, error) {
 	return s.Position(), nil
 }
 
+///
+/// PreSharedKeyID
+///
+type PSKType uint8
+
+const (
+	PSKTypeInvalid    PSKType = 0
+	PSKTypeExternal   PSKType = 1
+	PSKTypeResumption PSKType = 2
+)
+
+func (pt PSKType) ValidForTLS() error {
+	return validateEnum(pt, PSKTypeExternal, PSKTypeResumption)
+}
+
+type ExternalPSK struct {
+	PSKID []byte `tls:"head=1"`
+}
+
+type ResumptionPSK struct {
+	PSKGroupID []byte `tls:"head=1"`
+	PSKEpoch   Epoch
+}
+
+// struct {
+//     PSKType psktype;
+//     select (PreSharedKeyID.psktype) {
+//         case external:
+//             opaque psk_id<0..255>;
+//         case resumption:
+//             opaque psk_group_id<0..255>;
+//             uint64 psk_epoch;
+//     }
+//     opaque psk_nonce<0..255>;
+// } PreSharedKeyID;
+type PreSharedKeyID struct {
+	External   *ExternalPSK
+	Resumption *ResumptionPSK
+	PSKNonce   []byte
+}
+
+func NewExternalPSKID(id []byte) PreSharedKeyID {
+	return PreSharedKeyID{External: &ExternalPSK{PSKID: dup(id)}}
+}
+
+func NewResumptionPSKID(groupID []byte, epoch Epoch) PreSharedKeyID {
+	return PreSharedKeyID{Resumption: &ResumptionPSK{PSKGroupID: dup(groupID), PSKEpoch: epoch}}
+}
+
+func (id PreSharedKeyID) Type() PSKType {
+	switch {
+	case id.External != nil:
+		return PSKTypeExternal
+	case id.Resumption != nil:
+		return PSKTypeResumption
+	default:
+		panic("Malformed PSK ID")
+	}
+}
+
+func (id PreSharedKeyID) MarshalTLS() ([]byte, error) {
+	s := syntax.NewWriteStream()
+	pskType := id.Type()
+	err := s.Write(pskType)
+	if err != nil {
+		return nil, err
+	}
+
+	switch pskType {
+	case PSKTypeExternal:
+		err = s.Write(id.External)
+	case PSKTypeResumption:
+		err = s.Write(id.Resumption)
+	default:
+		return nil, fmt.Errorf("mls.psk: PSKType not allowed")
+	}
+
+	if err == nil {
+		err = s.Write(struct {
+			Nonce []byte `tls:"head=1"`
+		}{id.PSKNonce})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Data(), nil
+}
+
+func (id *PreSharedKeyID) UnmarshalTLS(data []byte) (int, error) {
+	s := syntax.NewReadStream(data)
+	var pskType PSKType
+	_, err := s.Read(&pskType)
+	if err != nil {
+		return 0, err
+	}
+
+	switch pskType {
+	case PSKTypeExternal:
+		id.External = new(ExternalPSK)
+		_, err = s.Read(id.External)
+	case PSKTypeResumption:
+		id.Resumption = new(ResumptionPSK)
+		_, err = s.Read(id.Resumption)
+	default:
+		err = fmt.Errorf("mls.psk: PSKType not allowed")
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	var nonce struct {
+		Nonce []byte `tls:"head=1"`
+	}
+	_, err = s.Read(&nonce)
+	if err != nil {
+		return 0, err
+	}
+
+	id.PSKNonce = nonce.Nonce
+	return s.Position(), nil
+}
+
 ///
 /// Commit
 ///
@@ -310,21 +595,36 @@ func (pid ProposalID) String() string {
 	return fmt.Sprintf("%x", pid.Hash)
 }
 
+// The KEM output from which existing members derive the init secret for an
+// external commit.  Unlike other proposals, this is always sent inline in the
+// Commit, since the sender is not yet a member of the group.
+type ExternalInit struct {
+	KEMOutput []byte `tls:"head=2"`
+}
+
 type Commit struct {
-	Updates []ProposalID `tls:"head=2"`
-	Removes []ProposalID `tls:"head=2"`
-	Adds    []ProposalID `tls:"head=2"`
+	Updates       []ProposalID `tls:"head=2"`
+	Removes       []ProposalID `tls:"head=2"`
+	Adds          []ProposalID `tls:"head=2"`
+	PreSharedKeys []ProposalID `tls:"head=2"`
+	ReInits       []ProposalID `tls:"head=2"`
+
+	GroupContextExtensions []ProposalID `tls:"head=2"`
 
-	Path *DirectPath `tls:"optional"`
+	ExternalInit *ExternalInit `tls:"optional"`
+	Path         *DirectPath   `tls:"optional"`
 }
 
 func (commit Commit) PathRequired() bool {
 	haveUpdates := len(commit.Updates) > 0
 	haveRemoves := len(commit.Removes) > 0
 	haveAdds := len(commit.Adds) > 0
+	havePSKs := len(commit.PreSharedKeys) > 0
+	haveReInits := len(commit.ReInits) > 0
+	haveGCEs := len(commit.GroupContextExtensions) > 0
 
-	nonAddProposals := haveUpdates || haveRemoves
-	noProposalsAtAll := !haveUpdates && !haveRemoves && !haveAdds
+	nonAddProposals := haveUpdates || haveRemoves || haveGCEs || commit.ExternalInit != nil
+	noProposalsAtAll := !haveUpdates && !haveRemoves && !haveAdds && !havePSKs && !haveReInits
 
 	return nonAddProposals || noProposalsAtAll
 }
@@ -491,9 +791,9 @@ func (pt MLSPlaintext) toBeSigned(ctx GroupContext) []byte {
 	return s.Data()
 }
 
-func (pt *MLSPlaintext) sign(ctx GroupContext, priv SignaturePrivateKey, scheme SignatureScheme) error {
+func (pt *MLSPlaintext) sign(ctx GroupContext, priv SignaturePrivateKey, scheme SignatureScheme, r io.Reader) error {
 	tbs := pt.toBeSigned(ctx)
-	sig, err := scheme.Sign(&priv, tbs)
+	sig, err := scheme.SignWithRand(r, &priv, tbs)
 	if err != nil {
 		return err
 	}
@@ -553,13 +853,18 @@ type MLSCiphertext struct {
 ///
 
 type GroupInfo struct {
-	GroupID                 []byte `tls:"head=1"`
-	Epoch                   Epoch
-	Tree                    TreeKEMPublicKey
+	GroupID  []byte `tls:"head=1"`
+	Epoch    Epoch
+	TreeHash []byte `tls:"head=1"`
+
+	// The ratchet tree, or an empty tree if the tree is delivered separately
+	Tree TreeKEMPublicKey
+
 	ConfirmedTranscriptHash []byte `tls:"head=1"`
 	InterimTranscriptHash   []byte `tls:"head=1"`
 	Extensions              ExtensionList
-	Confirmation            []byte `tls:"head=1"`
+	ExternalPub             *HPKEPublicKey `tls:"optional"`
+	Confirmation            []byte         `tls:"head=1"`
 	SignerIndex             LeafIndex
 	Signature               []byte `tls:"head=2"`
 }
@@ -579,30 +884,59 @@ func (gi GroupInfo) toBeSigned() ([]byte, error) {
 	return syntax.Marshal(struct {
 		GroupID                 []byte `tls:"head=1"`
 		Epoch                   Epoch
-		Tree                    TreeKEMPublicKey
+		TreeHash                []byte `tls:"head=1"`
 		ConfirmedTranscriptHash []byte `tls:"head=1"`
 		InterimTranscriptHash   []byte `tls:"head=1"`
-		Confirmation            []byte `tls:"head=1"`
+		Extensions              ExtensionList
+		ExternalPub             *HPKEPublicKey `tls:"optional"`
+		Confirmation            []byte         `tls:"head=1"`
 		SignerIndex             LeafIndex
 	}{
 		GroupID:                 gi.GroupID,
 		Epoch:                   gi.Epoch,
-		Tree:                    gi.Tree,
+		TreeHash:                gi.TreeHash,
 		ConfirmedTranscriptHash: gi.ConfirmedTranscriptHash,
 		InterimTranscriptHash:   gi.InterimTranscriptHash,
+		Extensions:              gi.Extensions,
+		ExternalPub:             gi.ExternalPub,
 		Confirmation:            gi.Confirmation,
 		SignerIndex:             gi.SignerIndex,
 	})
 }
 
-func (gi *GroupInfo) sign(index LeafIndex, priv *SignaturePrivateKey) error {
+// Whether the ratchet tree is included, as opposed to being delivered
+// separately
+func (gi GroupInfo) HasTree() bool {
+	return len(gi.Tree.Nodes) > 0
+}
+
+// Remove the ratchet tree, leaving only the signed tree hash
+func (gi *GroupInfo) omitTree() {
+	gi.Tree = TreeKEMPublicKey{Suite: gi.Tree.Suite, Nodes: []OptionalNode{}}
+}
+
+// Copy the ratchet tree into a RatchetTreeExtension, so that it can be omitted
+// from the tree field.  This must be done before the GroupInfo is signed, since
+// the signature covers the extensions.
+func (gi *GroupInfo) addTreeExtension() error {
+	ext := gi.Extensions.without(ExtensionTypeRatchetTree)
+	err := ext.Add(RatchetTreeExtension{gi.Tree})
+	if err != nil {
+		return err
+	}
+
+	gi.Extensions = ext
+	return nil
+}
+
+func (gi *GroupInfo) sign(index LeafIndex, priv *SignaturePrivateKey, r io.Reader) error {
 	// Verify that priv corresponds to tree[index]
 	kp, ok := gi.Tree.KeyPackage(index)
 	if !ok {
 		return fmt.Errorf("mls.groupInfo: Attempt to sign from unoccupied leaf")
 	}
 
-	scheme := kp.CipherSuite.Scheme()
+	scheme := kp.Credential.Scheme()
 	pub := kp.Credential.PublicKey()
 	if !pub.Equals(priv.PublicKey) {
 		return fmt.Errorf("mls.groupInfo: Incorrect private key for index")
@@ -616,7 +950,7 @@ func (gi *GroupInfo) sign(index LeafIndex, priv *SignaturePrivateKey) error {
 	}
 
 	// Sign toBeSigned() with priv -> SignerIndex, Signature
-	sig, err := scheme.Sign(priv, tbs)
+	sig, err := scheme.SignWithRand(r, priv, tbs)
 	if err != nil {
 		return err
 	}
@@ -625,14 +959,28 @@ func (gi *GroupInfo) sign(index LeafIndex, priv *SignaturePrivateKey) error {
 	return nil
 }
 
+// The signature covers the tree hash rather than the tree, so the tree must be
+// present and match the tree hash
 func (gi GroupInfo) verify() error {
+	if !gi.HasTree() {
+		return fmt.Errorf("mls.groupInfo: No ratchet tree")
+	}
+
+	if !bytes.Equal(gi.Tree.RootHash(), gi.TreeHash) {
+		return fmt.Errorf("mls.groupInfo: Ratchet tree does not match tree hash")
+	}
+
 	// Get pub from tree[SignerIndex]
+	if LeafCount(gi.SignerIndex) >= gi.Tree.Size() {
+		return fmt.Errorf("mls.groupInfo: Signer index out of range")
+	}
+
 	kp, ok := gi.Tree.KeyPackage(gi.SignerIndex)
 	if !ok {
 		return fmt.Errorf("mls.groupInfo: Attempt to sign from unoccupied leaf")
 	}
 
-	scheme := kp.CipherSuite.Scheme()
+	scheme := kp.Credential.Scheme()
 	pub := kp.Credential.PublicKey()
 
 	// Marshal the contents of the GroupInfo
@@ -657,9 +1005,12 @@ type PathSecret struct {
 	Data []byte `tls:"head=1"`
 }
 
+// The PSKs injected into the epoch are listed so that new members can inject
+// them too
 type GroupSecrets struct {
-	EpochSecret []byte      `tls:"head=1"`
-	PathSecret  *PathSecret `tls:"optional"`
+	JoinerSecret []byte           `tls:"head=1"`
+	PathSecret   *PathSecret      `tls:"optional"`
+	PSKs         []PreSharedKeyID `tls:"head=2"`
 }
 
 ///
@@ -679,60 +1030,148 @@ type Welcome struct {
 	CipherSuite        CipherSuite
 	Secrets            []EncryptedGroupSecrets `tls:"head=4"`
 	EncryptedGroupInfo []byte                  `tls:"head=4"`
-	epochSecret        []byte                  `tls:"omit"`
+	joinerSecret       []byte                  `tls:"omit"`
+	psks               []PreSharedKeyID        `tls:"omit"`
+	welcomeSecret      []byte                  `tls:"omit"`
+	groupInfo          *GroupInfo              `tls:"omit"`
+}
+
+// The Welcome header, which is authenticated as AAD on the encrypted GroupInfo
+type welcomeHeader struct {
+	Version     ProtocolVersion
+	CipherSuite CipherSuite
+	Secrets     []EncryptedGroupSecrets `tls:"head=4"`
 }
 
-// XXX(rlb): The pattern we follow here basically locks us into having empty
-// AAD.  I suspect that eventually we're going to want to have the header to the
-// message (version, cipher, encrypted key packages) as AAD.  We should consider
-// refactoring so that the API flows slightly differently:
+// A Welcome is constructed in stages:
 //
-// * newWelcome() - caches initSecret and *unencrypted* GroupInfo
-// * encrypt() for each member
+// * newWelcome() - caches the joiner secret, the IDs of the PSKs injected into
+//   the epoch, and the *unencrypted* GroupInfo
+// * encryptTo() for each member
 // * finalize() - computes AAD and encrypts GroupInfo
 //
-// This will also probably require a helper method for decryption.
-func newWelcome(cs CipherSuite, epochSecret []byte, groupInfo *GroupInfo) *Welcome {
-	// Encrypt the GroupInfo
-	pt, err := syntax.Marshal(groupInfo)
+// Once finalized, no further members can be added.  Callers outside the
+// package stage a Welcome through a WelcomeBuilder.
+func newWelcome(cs CipherSuite, joinerSecret []byte, psks []PreSharedKeyID, pskSecret []byte, groupInfo *GroupInfo) *Welcome {
+	return &Welcome{
+		Version:       ProtocolVersionMLS10,
+		CipherSuite:   cs,
+		Secrets:       []EncryptedGroupSecrets{},
+		joinerSecret:  dup(joinerSecret),
+		psks:          psks,
+		welcomeSecret: cs.welcomeSecret(joinerSecret, pskSecret),
+		groupInfo:     groupInfo,
+	}
+}
+
+func (w Welcome) headerAAD() ([]byte, error) {
+	return syntax.Marshal(welcomeHeader{
+		Version:     w.Version,
+		CipherSuite: w.CipherSuite,
+		Secrets:     w.Secrets,
+	})
+}
+
+func (w *Welcome) finalize() error {
+	if w.groupInfo == nil {
+		return fmt.Errorf("mls.welcome: Welcome already finalized")
+	}
+
+	pt, err := syntax.Marshal(w.groupInfo)
 	if err != nil {
-		panic(fmt.Errorf("mls.welcome: GroupInfo marshal failure %v", err))
+		return fmt.Errorf("mls.welcome: GroupInfo marshal failure %v", err)
 	}
 
-	kn := groupInfoKeyAndNonce(cs, epochSecret)
-	aead, err := cs.NewAEAD(kn.Key)
+	aad, err := w.headerAAD()
 	if err != nil {
-		panic(fmt.Errorf("mls.welcome: error creating AEAD: %v", err))
+		return fmt.Errorf("mls.welcome: header marshal failure %v", err)
 	}
-	ct := aead.Seal(nil, kn.Nonce, pt, []byte{})
 
-	// Assemble the Welcome
-	return &Welcome{
-		Version:            ProtocolVersionMLS10,
-		CipherSuite:        cs,
-		EncryptedGroupInfo: ct,
-		epochSecret:        epochSecret,
+	kn := groupInfoKeyAndNonce(w.CipherSuite, w.welcomeSecret)
+	aead, err := w.CipherSuite.NewAEAD(kn.Key)
+	if err != nil {
+		return fmt.Errorf("mls.welcome: error creating AEAD: %v", err)
+	}
+
+	w.EncryptedGroupInfo = aead.Seal(nil, kn.Nonce, pt, aad)
+	zeroize(w.joinerSecret)
+	zeroize(w.welcomeSecret)
+	w.groupInfo = nil
+	w.joinerSecret = nil
+	w.psks = nil
+	w.welcomeSecret = nil
+	return nil
+}
+
+// Encrypt the group secrets to a new member.  Returns an error once the Welcome
+// has been finalized.
+func (w *Welcome) encryptTo(kp KeyPackage, pathSecret []byte, r io.Reader) error {
+	if w.groupInfo == nil {
+		return fmt.Errorf("mls.welcome: Welcome already finalized")
+	}
+
+	ekp, err := w.encryptSecrets(kp, pathSecret, r)
+	if err != nil {
+		return err
+	}
+
+	w.Secrets = append(w.Secrets, *ekp)
+	return nil
+}
+
+// Encrypt to several new members at once, spreading the HPKE operations over
+// at most the specified number of goroutines.  The secrets are added in the
+// order of the KeyPackages, regardless of the number of workers.
+func (w *Welcome) encryptToAll(kps []KeyPackage, pathSecrets [][]byte, workers int, r io.Reader) error {
+	if w.groupInfo == nil {
+		return fmt.Errorf("mls.welcome: Welcome already finalized")
+	}
+
+	if len(kps) != len(pathSecrets) {
+		return fmt.Errorf("mls.welcome: %d KeyPackages but %d path secrets", len(kps), len(pathSecrets))
+	}
+
+	streams, err := splitRandom(r, len(kps))
+	if err != nil {
+		return err
+	}
+
+	secrets := make([]EncryptedGroupSecrets, len(kps))
+	err = parallelFor(len(kps), workers, func(i int) error {
+		ekp, err := w.encryptSecrets(kps[i], pathSecrets[i], streams[i])
+		if err != nil {
+			return err
+		}
+
+		secrets[i] = *ekp
+		return nil
+	})
+	if err != nil {
+		return err
 	}
+
+	w.Secrets = append(w.Secrets, secrets...)
+	return nil
 }
 
-// TODO(RLB): Return error instead of panicking
-func (w *Welcome) EncryptTo(kp KeyPackage, pathSecret []byte) {
+func (w Welcome) encryptSecrets(kp KeyPackage, pathSecret []byte, r io.Reader) (*EncryptedGroupSecrets, error) {
 	// Check that the ciphersuite is acceptable
 	if kp.CipherSuite != w.CipherSuite {
-		panic(fmt.Errorf("mls.welcome: cipher suite mismatch %v != %v", kp.CipherSuite, w.CipherSuite))
+		return nil, fmt.Errorf("mls.welcome: cipher suite mismatch %v != %v", kp.CipherSuite, w.CipherSuite)
 	}
 
 	// Compute the hash of the kp
 	data, err := syntax.Marshal(kp)
 	if err != nil {
-		panic(fmt.Errorf("mls.welcome: kp marshal failure %v", err))
+		return nil, fmt.Errorf("mls.welcome: kp marshal failure %v", err)
 	}
 
 	kpHash := w.CipherSuite.Digest(data)
 
 	// Encrypt the group init secret to new member's public key
 	gs := GroupSecrets{
-		EpochSecret: w.epochSecret,
+		JoinerSecret: w.joinerSecret,
+		PSKs:         w.psks,
 	}
 
 	if pathSecret != nil {
@@ -741,31 +1180,93 @@ func (w *Welcome) EncryptTo(kp KeyPackage, pathSecret []byte) {
 
 	pt, err := syntax.Marshal(gs)
 	if err != nil {
-		panic(fmt.Errorf("mls.welcome: KeyPackage marshal failure %v", err))
+		return nil, fmt.Errorf("mls.welcome: KeyPackage marshal failure %v", err)
 	}
 
-	egs, err := w.CipherSuite.hpke().Encrypt(kp.InitKey, []byte{}, pt)
+	instance := w.CipherSuite.hpke()
+	instance.Rand = r
+	egs, err := instance.Encrypt(kp.InitKey, []byte{}, pt)
 	if err != nil {
-		panic(fmt.Errorf("mls.welcome: encrpyting KeyPackage failure %v", err))
+		return nil, fmt.Errorf("mls.welcome: encrpyting KeyPackage failure %v", err)
 	}
 
-	// Assemble and append the key package
-	ekp := EncryptedGroupSecrets{
+	return &EncryptedGroupSecrets{
 		KeyPackageHash:        kpHash,
 		EncryptedGroupSecrets: egs,
+	}, nil
+}
+
+// Find the EncryptedGroupSecrets addressed to a KeyPackage
+func (w Welcome) findSecrets(kp KeyPackage) (*EncryptedGroupSecrets, error) {
+	data, err := syntax.Marshal(kp)
+	if err != nil {
+		return nil, fmt.Errorf("mls.welcome: kp marshal failure %v", err)
+	}
+
+	kpHash := w.CipherSuite.Digest(data)
+	for i := range w.Secrets {
+		if bytes.Equal(kpHash, w.Secrets[i].KeyPackageHash) {
+			return &w.Secrets[i], nil
+		}
 	}
-	w.Secrets = append(w.Secrets, ekp)
+
+	return nil, nil
 }
 
-func (w Welcome) Decrypt(suite CipherSuite, epochSecret []byte) (*GroupInfo, error) {
-	gikn := groupInfoKeyAndNonce(suite, epochSecret)
+// Decrypt the GroupSecrets addressed to a KeyPackage, using the private key
+// corresponding to its init key
+func (w Welcome) DecryptSecrets(kp KeyPackage, initPriv HPKEPrivateKey) (*GroupSecrets, error) {
+	if kp.CipherSuite != w.CipherSuite {
+		return nil, fmt.Errorf("mls.welcome: cipher suite mismatch %v != %v", kp.CipherSuite, w.CipherSuite)
+	}
+
+	egs, err := w.findSecrets(kp)
+	if err != nil {
+		return nil, err
+	}
+
+	if egs == nil {
+		return nil, fmt.Errorf("mls.welcome: no secrets for KeyPackage")
+	}
+
+	pt, err := w.CipherSuite.hpke().Decrypt(initPriv, []byte{}, egs.EncryptedGroupSecrets)
+	if err != nil {
+		return nil, fmt.Errorf("mls.welcome: encKeyPkg decryption failure %v", err)
+	}
+
+	gs := new(GroupSecrets)
+	_, err = syntax.Unmarshal(pt, gs)
+	if err != nil {
+		return nil, fmt.Errorf("mls.welcome: keyPkg unmarshal failure %v", err)
+	}
+
+	return gs, nil
+}
+
+func (w Welcome) Decrypt(suite CipherSuite, welcomeSecret []byte) (*GroupInfo, error) {
+	return w.decrypt(suite, welcomeSecret, nil)
+}
+
+// Decrypt a Welcome whose GroupInfo omits the ratchet tree, using a tree
+// obtained separately.  The tree is verified against the signed tree hash.
+func (w Welcome) DecryptWithTree(suite CipherSuite, welcomeSecret []byte, tree TreeKEMPublicKey) (*GroupInfo, error) {
+	return w.decrypt(suite, welcomeSecret, &tree)
+}
+
+func (w Welcome) decrypt(suite CipherSuite, welcomeSecret []byte, tree *TreeKEMPublicKey) (*GroupInfo, error) {
+	gikn := groupInfoKeyAndNonce(suite, welcomeSecret)
 
 	aead, err := suite.NewAEAD(gikn.Key)
 	if err != nil {
 		return nil, fmt.Errorf("mls.state: error creating AEAD: %v", err)
 	}
 
-	data, err := aead.Open(nil, gikn.Nonce, w.EncryptedGroupInfo, []byte{})
+	aad, err := w.headerAAD()
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: header marshal failure %v", err)
+	}
+
+	data, err := aead.Open(nil, gikn.Nonce, w.EncryptedGroupInfo, aad)
 	if err != nil {
 		return nil, fmt.Errorf("mls.state: unable to decrypt groupInfo: %v", err)
 	}
@@ -776,14 +1277,39 @@ func (w Welcome) Decrypt(suite CipherSuite, epochSecret []byte) (*GroupInfo, err
 		return nil, fmt.Errorf("mls.state: unable to unmarshal groupInfo: %v", err)
 	}
 
+	// A tree omitted from the GroupInfo may be carried in its extensions
+	var rte RatchetTreeExtension
+	hasExtTree, err := gi.Extensions.Find(&rte)
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: malformed ratchet tree extension: %v", err)
+	}
+
+	switch {
+	case (tree != nil || hasExtTree) && gi.HasTree():
+		return nil, fmt.Errorf("mls.state: GroupInfo already includes a ratchet tree")
+
+	case tree != nil:
+		gi.Tree = tree.Clone()
+		gi.Tree.clearHashAll()
+
+	case hasExtTree:
+		gi.Tree = rte.Tree
+
+	case !gi.HasTree():
+		return nil, fmt.Errorf("mls.state: GroupInfo does not include a ratchet tree")
+	}
+
 	gi.Tree.Suite = suite
 	gi.Tree.SetHashAll()
 
 	if err = gi.verify(); err != nil {
-		return nil, fmt.Errorf("mls.state: invalid groupInfo")
+		return nil, fmt.Errorf("mls.state: invalid groupInfo %v", err)
 	}
 
-	gi.Tree.Suite = suite
+	// The ratchet tree extension is not one of the group's extensions
+	if hasExtTree {
+		gi.Extensions = gi.Extensions.without(ExtensionTypeRatchetTree)
+	}
 
 	return gi, nil
 }
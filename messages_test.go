@@ -2,6 +2,7 @@ package mls
 
 import (
 	"bytes"
+	"crypto/rand"
 	"testing"
 	"time"
 
@@ -73,6 +74,41 @@ var (
 		},
 	}
 
+	externalPSKProposal = &Proposal{
+		PreSharedKey: &PreSharedKeyProposal{
+			PSK: PreSharedKeyID{
+				External: &ExternalPSK{PSKID: []byte{0x01, 0x02, 0x03}},
+				PSKNonce: []byte{0x04, 0x05, 0x06, 0x07},
+			},
+		},
+	}
+
+	resumptionPSKProposal = &Proposal{
+		PreSharedKey: &PreSharedKeyProposal{
+			PSK: PreSharedKeyID{
+				Resumption: &ResumptionPSK{PSKGroupID: []byte{0x01, 0x02}, PSKEpoch: 7},
+				PSKNonce:   []byte{0x04, 0x05, 0x06, 0x07},
+			},
+		},
+	}
+
+	reInitProposal = &Proposal{
+		ReInit: &ReInitProposal{
+			GroupID:     []byte{0x01, 0x02, 0x03, 0x04},
+			Version:     ProtocolVersionMLS10,
+			CipherSuite: P256_AES128GCM_SHA256_P256,
+			Extensions:  NewExtensionList(),
+		},
+	}
+
+	groupContextExtensionsProposal = &Proposal{
+		GroupContextExtensions: &GroupContextExtensionsProposal{
+			Extensions: ExtensionList{
+				Entries: []Extension{{ExtensionType: ExtensionTypeParentHash, ExtensionData: []byte{0x01, 0x00}}},
+			},
+		},
+	}
+
 	nodePublicKey = HPKEPublicKey{
 		Data: []byte{0x11, 0x12, 0x13, 0x14, 0x15, 0x16},
 	}
@@ -90,10 +126,15 @@ var (
 	}
 
 	commit = &Commit{
-		Updates: []ProposalID{{Hash: []byte{0x00, 0x01}}},
-		Removes: []ProposalID{{Hash: []byte{0x02, 0x03}}},
-		Adds:    []ProposalID{{Hash: []byte{0x04, 0x05}}},
-		Path:    dp,
+		Updates:       []ProposalID{{Hash: []byte{0x00, 0x01}}},
+		Removes:       []ProposalID{{Hash: []byte{0x02, 0x03}}},
+		Adds:          []ProposalID{{Hash: []byte{0x04, 0x05}}},
+		PreSharedKeys: []ProposalID{{Hash: []byte{0x06, 0x07}}},
+		ReInits:       []ProposalID{{Hash: []byte{0x08, 0x09}}},
+		ExternalInit:  &ExternalInit{KEMOutput: []byte{0x0a, 0x0b}},
+		Path:          dp,
+
+		GroupContextExtensions: []ProposalID{{Hash: []byte{0x0c, 0x0d}}},
 	}
 
 	mlsPlaintextIn = &MLSPlaintext{
@@ -164,6 +205,10 @@ func TestMessagesMarshalUnmarshal(t *testing.T) {
 	t.Run("AddProposal", roundTrip(addProposal, new(Proposal)))
 	t.Run("RemoveProposal", roundTrip(removeProposal, new(Proposal)))
 	t.Run("UpdateProposal", roundTrip(updateProposal, new(Proposal)))
+	t.Run("ExternalPSKProposal", roundTrip(externalPSKProposal, new(Proposal)))
+	t.Run("ResumptionPSKProposal", roundTrip(resumptionPSKProposal, new(Proposal)))
+	t.Run("ReInitProposal", roundTrip(reInitProposal, new(Proposal)))
+	t.Run("GroupContextExtensionsProposal", roundTrip(groupContextExtensionsProposal, new(Proposal)))
 	t.Run("Commit", roundTrip(commit, new(Commit)))
 	t.Run("MLSPlaintextContentApplication", roundTrip(mlsPlaintextIn, new(MLSPlaintext)))
 	t.Run("MLSPlaintextContentProposal", roundTrip(mlsPlaintextProposalIn, new(MLSPlaintext)))
@@ -193,13 +238,105 @@ func TestKeyPackageExpiry(t *testing.T) {
 	}
 	err = kp.SetExtensions([]ExtensionBody{alreadyExpired})
 	require.Nil(t, err)
-	err = kp.Sign(priv)
+	err = kp.SignWithRand(newTestRandom(t, 1), priv)
 	require.Nil(t, err)
 
 	ver = kp.Verify()
 	require.False(t, ver)
 }
 
+func TestKeyPackageCipherSuites(t *testing.T) {
+	advertised := func(cs CipherSuite) []CipherSuite {
+		priv, err := cs.Scheme().Generate()
+		require.Nil(t, err)
+
+		cred := NewBasicCredential(userID, cs.Scheme(), priv.PublicKey)
+		kp, err := NewKeyPackageWithSecret(cs, randomBytes(32), cred, priv)
+		require.Nil(t, err)
+
+		var sce SupportedCipherSuitesExtension
+		found, err := kp.Extensions.Find(&sce)
+		require.True(t, found)
+		require.Nil(t, err)
+		return sce.SupportedCipherSuites
+	}
+
+	// Experimental suites are not advertised by default...
+	hybrid := X25519Kyber768_AES128GCM_SHA256_Ed25519
+	require.NotContains(t, advertised(suite), hybrid)
+
+	// ... only by KeyPackages that use them
+	require.Contains(t, advertised(hybrid), hybrid)
+	require.Contains(t, advertised(hybrid), suite)
+}
+
+type fixedClock time.Time
+
+func (fc fixedClock) Now() time.Time {
+	return time.Time(fc)
+}
+
+func TestKeyPackageLifetime(t *testing.T) {
+	scheme := suite.Scheme()
+	priv, err := scheme.Generate()
+	require.Nil(t, err)
+
+	start := time.Unix(1600000000, 0)
+	cfg := LifetimeConfig{
+		Clock:     fixedClock(start),
+		Lifetime:  24 * time.Hour,
+		ClockSkew: time.Minute,
+	}
+
+	cred := NewBasicCredential(userID, scheme, priv.PublicKey)
+	kp, err := NewKeyPackageWithSecretAndLifetime(suite, randomBytes(32), cred, priv, cfg)
+	require.Nil(t, err)
+
+	var lifetime LifetimeExtension
+	found, err := kp.Extensions.Find(&lifetime)
+	require.True(t, found)
+	require.Nil(t, err)
+	require.Equal(t, uint64(0), lifetime.NotBefore)
+	require.Equal(t, uint64(start.Add(24*time.Hour).Unix()), lifetime.NotAfter)
+
+	// Check the start of the lifetime as well
+	err = kp.SetExtensions([]ExtensionBody{LifetimeExtension{
+		NotBefore: uint64(start.Unix()),
+		NotAfter:  uint64(start.Add(24 * time.Hour).Unix()),
+	}})
+	require.Nil(t, err)
+	err = kp.Sign(priv)
+	require.Nil(t, err)
+
+	// Valid within the lifetime, allowing for clock skew
+	for _, now := range []time.Time{start.Add(-time.Minute), start, start.Add(24*time.Hour + time.Minute)} {
+		cfg.Clock = fixedClock(now)
+		require.Nil(t, kp.VerifyLifetime(cfg))
+		require.True(t, kp.VerifyWithLifetime(cfg))
+	}
+
+	// Invalid outside it
+	for _, now := range []time.Time{start.Add(-2 * time.Minute), start.Add(24*time.Hour + 2*time.Minute)} {
+		cfg.Clock = fixedClock(now)
+		require.Error(t, kp.VerifyLifetime(cfg))
+		require.False(t, kp.VerifyWithLifetime(cfg))
+	}
+
+	// The default configuration uses the system clock
+	require.False(t, kp.Verify())
+
+	// Verify allows no clock skew, unless the caller opts in to it
+	now := time.Now()
+	cfg = LifetimeConfig{Clock: fixedClock(now.Add(-30 * time.Minute))}
+	recent, err := NewKeyPackageWithSecretAndLifetime(suite, randomBytes(32), cred, priv, cfg)
+	require.Nil(t, err)
+	require.False(t, recent.Verify())
+
+	cfg = LifetimeConfig{Clock: fixedClock(now), ClockSkew: time.Hour}
+	require.True(t, recent.VerifyWithLifetime(cfg))
+	require.False(t, recent.VerifyWithLifetime(DefaultLifetimeConfig))
+}
+
 func newTestRatchetTree(t *testing.T, suite CipherSuite, secrets [][]byte) *TreeKEMPublicKey {
 	scheme := suite.Scheme()
 
@@ -236,7 +373,9 @@ func TestWelcomeMarshalUnMarshalWithDecryption(t *testing.T) {
 	require.Nil(t, err)
 
 	// setup things needed to welcome c
-	epochSecret := []byte("we welcome you c")
+	joinerSecret := []byte("we welcome you c")
+	pskID := NewExternalPSKID([]byte("psk"))
+	pskID.PSKNonce = []byte{0x01, 0x02}
 	gi := &GroupInfo{
 		GroupID:                 unhex("0007"),
 		Epoch:                   121,
@@ -248,10 +387,11 @@ func TestWelcomeMarshalUnMarshalWithDecryption(t *testing.T) {
 		Signature:               []byte{0xAA, 0xBB, 0xCC},
 	}
 
-	w1 := newWelcome(suite, epochSecret, gi)
-	w1.EncryptTo(keyPackage, randomBytes(32))
-	// doing this so that test can omit this field when matching w1, w2
-	w1.epochSecret = nil
+	w1 := newWelcome(suite, joinerSecret, []PreSharedKeyID{pskID}, randomBytes(32), gi)
+	require.Nil(t, w1.encryptTo(keyPackage, randomBytes(32), rand.Reader))
+	require.Nil(t, w1.finalize())
+	require.Error(t, w1.finalize())
+	require.Error(t, w1.encryptTo(keyPackage, nil, rand.Reader))
 	w2 := new(Welcome)
 	t.Run("WelcomeOneMember", roundTrip(w1, w2))
 
@@ -264,7 +404,55 @@ func TestWelcomeMarshalUnMarshalWithDecryption(t *testing.T) {
 	w2kp := new(GroupSecrets)
 	_, err = syntax.Unmarshal(pt, w2kp)
 	require.Nil(t, err)
-	require.Equal(t, epochSecret, w2kp.EpochSecret)
+	require.Equal(t, joinerSecret, w2kp.JoinerSecret)
+	require.Equal(t, []PreSharedKeyID{pskID}, w2kp.PSKs)
+
+	gs, err := w2.DecryptSecrets(keyPackage, initKey)
+	require.Nil(t, err)
+	require.Equal(t, w2kp, gs)
+}
+
+func TestWelcomeEncryptToAll(t *testing.T) {
+	secrets := [][]byte{randomBytes(32), randomBytes(32), randomBytes(32), randomBytes(32)}
+	tree := newTestRatchetTree(t, suite, secrets)
+
+	kps := make([]KeyPackage, len(secrets))
+	pathSecrets := make([][]byte, len(secrets))
+	for i := range kps {
+		kp, ok := tree.KeyPackage(LeafIndex(i))
+		require.True(t, ok)
+		kps[i] = kp
+		pathSecrets[i] = randomBytes(32)
+	}
+
+	joinerSecret := randomBytes(32)
+	w := newWelcome(suite, joinerSecret, nil, nil, &GroupInfo{})
+	require.Error(t, w.encryptToAll(kps, pathSecrets[1:], 4, rand.Reader))
+	require.Nil(t, w.encryptToAll(kps, pathSecrets, 4, rand.Reader))
+	require.Equal(t, len(kps), len(w.Secrets))
+
+	// Secrets are in the order of the KeyPackages
+	for i, kp := range kps {
+		initPriv, err := suite.hpke().Derive(secrets[i])
+		require.Nil(t, err)
+
+		egs, err := w.findSecrets(kp)
+		require.Nil(t, err)
+		require.Equal(t, &w.Secrets[i], egs)
+
+		gs, err := w.DecryptSecrets(kp, initPriv)
+		require.Nil(t, err)
+		require.Equal(t, joinerSecret, gs.JoinerSecret)
+		require.Equal(t, pathSecrets[i], gs.PathSecret.Data)
+	}
+
+	// Encryption draws on the specified source of randomness
+	w = newWelcome(suite, joinerSecret, nil, nil, &GroupInfo{})
+	require.Error(t, w.encryptTo(kps[0], pathSecrets[0], bytes.NewReader(nil)))
+	require.Error(t, w.encryptToAll(kps, pathSecrets, 4, bytes.NewReader(nil)))
+	require.Nil(t, w.encryptTo(kps[0], pathSecrets[0], newTestRandom(t, 1)))
+	require.Nil(t, w.encryptToAll(kps[1:], pathSecrets[1:], 4, newTestRandom(t, 2)))
+	require.Equal(t, len(kps), len(w.Secrets))
 }
 
 func TestProposalErrorCases(t *testing.T) {
@@ -328,8 +516,13 @@ func generateMessageVectors(t *testing.T) []byte {
 		Cases:        []MessageTestCase{},
 	}
 
-	suites := []CipherSuite{P256_AES128GCM_SHA256_P256, X25519_AES128GCM_SHA256_Ed25519}
-	schemes := []SignatureScheme{ECDSA_SECP256R1_SHA256, Ed25519}
+	suites := []CipherSuite{
+		P256_AES128GCM_SHA256_P256,
+		X25519_AES128GCM_SHA256_Ed25519,
+		X448_AES256GCM_SHA512_Ed448,
+		P384_AES256GCM_SHA384_P384,
+	}
+	schemes := []SignatureScheme{ECDSA_SECP256R1_SHA256, Ed25519, Ed448, ECDSA_SECP384R1_SHA384}
 
 	for i := range suites {
 		suite := suites[i]
@@ -393,7 +586,8 @@ func generateMessageVectors(t *testing.T) []byte {
 		require.Nil(t, err)
 
 		gs := GroupSecrets{
-			EpochSecret: tv.Random,
+			JoinerSecret: tv.Random,
+			PSKs:         []PreSharedKeyID{},
 		}
 
 		gsM, err := syntax.Marshal(gs)
@@ -584,7 +778,8 @@ func verifyMessageVectors(t *testing.T, data []byte) {
 		require.Equal(t, marshaled, tc.GroupInfo)
 
 		gs := GroupSecrets{
-			EpochSecret: tv.Random,
+			JoinerSecret: tv.Random,
+			PSKs:         []PreSharedKeyID{},
 		}
 
 		gsM, err := syntax.Marshal(gs)
@@ -2,9 +2,13 @@ package mls
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rand"
 	"fmt"
-	"math/rand"
+	"io"
 	"reflect"
+	"sort"
+	"time"
 
 	"github.com/cisco/go-tls-syntax"
 )
@@ -39,10 +43,154 @@ type updateSecrets struct {
 	IdentityPriv *SignaturePrivateKey `tls:"optional"`
 }
 
+// A commit we have sent, but which has not yet been confirmed by the delivery
+// service.  The hash identifies the MLSPlaintext carrying the commit, and Next
+// is the state that results if the commit is accepted.
+type cachedCommit struct {
+	Hash []byte
+	Next *State
+}
+
+// The application keys for an epoch that has ended, retained so that messages
+// sent in that epoch can still be decrypted.  The tree and group context are
+// needed to verify the signatures on those messages.
+type pastEpoch struct {
+	Epoch           Epoch
+	Expiry          time.Time
+	SenderDataKey   []byte
+	ApplicationKeys *groupKeySource
+	Tree            TreeKEMPublicKey
+	GroupContext    GroupContext
+}
+
+func (pe *pastEpoch) clone() *pastEpoch {
+	next := *pe
+	next.SenderDataKey = dup(pe.SenderDataKey)
+	next.ApplicationKeys = pe.ApplicationKeys.clone()
+	return &next
+}
+
+func (pe *pastEpoch) zeroize() {
+	zeroize(pe.SenderDataKey)
+	pe.ApplicationKeys.zeroize()
+}
+
+// Resumption PSKs are located by the group and epoch in which they were
+// derived
+type resumptionPSKKey struct {
+	GroupID string
+	Epoch   Epoch
+}
+
+// The number of past epochs of this group for which we retain resumption PSKs
+const resumptionPSKWindow = 16
+
+// The HPKE exporter context used to derive the init secret for an external
+// commit
+var externalInitContext = []byte("MLS 1.0 external init secret")
+
+var errGroupFrozen = fmt.Errorf("mls.state: group is frozen pending ReInit")
+var errReInitNotAlone = fmt.Errorf("mls.state: ReInit must be committed alone")
+
+// Group extensions implemented by this library.  Every member running this
+// library understands them, so they are exempt from the check that a member's
+// KeyPackage advertises each group extension.  These extensions only make sense
+// in a group, so a KeyPackage has no reason to carry them.  Any other group
+// extension must still be advertised.
 var supportedGroupExtensions = []ExtensionType{
-	// TODO
+	ExtensionTypeExternalSenders,
+	ExtensionTypeWireFormatPolicy,
+	ExtensionTypeSignatureSchemes,
+}
+
+func checkExtensionSupport(kp KeyPackage, ext ExtensionList) error {
+	for _, e := range ext.Entries {
+		supported := kp.Extensions.Has(e.ExtensionType)
+		for _, extType := range supportedGroupExtensions {
+			supported = supported || extType == e.ExtensionType
+		}
+
+		if !supported {
+			return fmt.Errorf("Unsupported extension type [%04x]", e.ExtensionType)
+		}
+	}
+
+	return nil
+}
+
+// The signature schemes that a group's extensions allow members to use
+func allowedSignatureSchemes(suite CipherSuite, ext ExtensionList) ([]SignatureScheme, error) {
+	allowed := SignatureSchemesExtension{[]SignatureScheme{suite.Scheme()}}
+	_, err := ext.Find(&allowed)
+	if err != nil {
+		return nil, err
+	}
+
+	return allowed.SignatureSchemes, nil
+}
+
+// Check that a group's extensions allow members to use a signature scheme
+func checkSignatureScheme(suite CipherSuite, ext ExtensionList, scheme SignatureScheme) error {
+	allowed, err := allowedSignatureSchemes(suite, ext)
+	if err != nil {
+		return err
+	}
+
+	if containsScheme(allowed, scheme) {
+		return nil
+	}
+
+	return fmt.Errorf("mls.state: Signature scheme %v not allowed in group", scheme)
+}
+
+func containsScheme(schemes []SignatureScheme, scheme SignatureScheme) bool {
+	for _, ss := range schemes {
+		if ss == scheme {
+			return true
+		}
+	}
+	return false
+}
+
+// Returned when the credential at a leaf uses a signature scheme that the
+// group does not allow
+type SignatureSchemeNotAllowedError struct {
+	Index  LeafIndex
+	Scheme SignatureScheme
+}
+
+func (e SignatureSchemeNotAllowedError) Error() string {
+	return fmt.Sprintf("mls.state: Signature scheme %v at leaf %d not allowed in group", e.Scheme, e.Index)
+}
+
+// Check that a group's extensions allow the signature schemes of its
+// preconfigured senders
+func checkExternalSenders(suite CipherSuite, ext ExtensionList) error {
+	var senders ExternalSendersExtension
+	found, err := ext.Find(&senders)
+	if err != nil || !found {
+		return err
+	}
+
+	for _, sender := range senders.Senders {
+		err := checkSignatureScheme(suite, ext, sender.SignatureScheme)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
+// Where the GroupInfo in a Welcome carries the ratchet tree
+type treeDelivery uint8
+
+const (
+	treeInline      treeDelivery = 0
+	treeExternal    treeDelivery = 1
+	treeInExtension treeDelivery = 2
+)
+
 type State struct {
 	// Shared confirmed state
 	CipherSuite             CipherSuite
@@ -63,9 +211,38 @@ type State struct {
 	// Secret state
 	PendingUpdates map[ProposalRef]updateSecrets `tls:"omit"`
 	Keys           keyScheduleEpoch              `tls:"omit"`
+	ExternalPSKs   map[string][]byte             `tls:"omit"`
+	ResumptionPSKs map[resumptionPSKKey][]byte   `tls:"omit"`
+
+	// A committed ReInit, if any.  Once this is set, the group is frozen and
+	// can only be used to create its successor.
+	PendingReInit *ReInitProposal `tls:"omit"`
 
 	// Helpful information
 	NewCredentials map[LeafIndex]bool
+
+	// Our own commit for this epoch, if any, awaiting confirmation
+	pendingCommit *cachedCommit `tls:"omit"`
+
+	// Application keys for recent epochs, oldest first
+	pastEpochs        []*pastEpoch  `tls:"omit"`
+	pastEpochLimit    int           `tls:"omit"`
+	pastEpochLifetime time.Duration `tls:"omit"`
+
+	// The clock and KeyPackage lifetime settings, if not the defaults
+	lifetime *LifetimeConfig `tls:"omit"`
+
+	// How Welcome messages deliver the ratchet tree
+	treeDelivery treeDelivery `tls:"omit"`
+
+	// The number of goroutines used for HPKE encryption in commits
+	encryptionWorkers int `tls:"omit"`
+
+	// Checks new and changed credentials, if set
+	auth AuthenticationService `tls:"omit"`
+
+	// Source of randomness, if not crypto/rand.Reader
+	randomSource io.Reader `tls:"omit"`
 }
 
 func NewEmptyState(groupID []byte, leafSecret []byte, sigPriv SignaturePrivateKey, kp KeyPackage) (*State, error) {
@@ -80,11 +257,21 @@ func NewEmptyStateWithExtensions(groupID []byte, leafSecret []byte, sigPriv Sign
 
 	treePriv := NewTreeKEMPrivateKey(suite, tree.Size(), index, leafSecret)
 
-	// Verify that the creator supports the group's extensions
-	for _, ext := range ext.Entries {
-		if !kp.Extensions.Has(ext.ExtensionType) {
-			return nil, fmt.Errorf("Unsupported extension type [%04x]", ext.ExtensionType)
-		}
+	// Verify that the creator supports the group's extensions, and that they
+	// allow the creator's signature scheme
+	err := checkExtensionSupport(kp, ext)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkSignatureScheme(suite, ext, kp.Credential.Scheme())
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkExternalSenders(suite, ext)
+	if err != nil {
+		return nil, err
 	}
 
 	secret := make([]byte, suite.newDigest().Size())
@@ -104,18 +291,29 @@ func NewEmptyStateWithExtensions(groupID []byte, leafSecret []byte, sigPriv Sign
 		InterimTranscriptHash:   []byte{},
 		Extensions:              ext,
 		NewCredentials:          map[LeafIndex]bool{},
+		ExternalPSKs:            map[string][]byte{},
+		ResumptionPSKs:          map[resumptionPSKKey][]byte{},
 	}
+	s.saveResumptionPSK()
 	return s, nil
 }
 
-func NewStateFromWelcome(suite CipherSuite, epochSecret []byte, welcome Welcome) (*State, LeafIndex, []byte, error) {
+func NewStateFromWelcome(suite CipherSuite, welcomeSecret []byte, welcome Welcome) (*State, LeafIndex, []byte, error) {
+	return newStateFromWelcome(suite, welcomeSecret, welcome, nil)
+}
+
+func newStateFromWelcome(suite CipherSuite, welcomeSecret []byte, welcome Welcome, tree *TreeKEMPublicKey) (*State, LeafIndex, []byte, error) {
 	// Decrypt the GroupInfo
-	gi, err := welcome.Decrypt(suite, epochSecret)
+	gi, err := welcome.decrypt(suite, welcomeSecret, tree)
 	if err != nil {
 		return nil, 0, nil, err
 	}
 
-	// Construct the new state
+	return newStateFromGroupInfo(suite, *gi), gi.SignerIndex, gi.Confirmation, nil
+}
+
+// Construct the public part of a state from a GroupInfo
+func newStateFromGroupInfo(suite CipherSuite, gi GroupInfo) *State {
 	s := &State{
 		CipherSuite:             suite,
 		Epoch:                   gi.Epoch,
@@ -127,6 +325,8 @@ func NewStateFromWelcome(suite CipherSuite, epochSecret []byte, welcome Welcome)
 		PendingProposals:        []MLSPlaintext{},
 		PendingUpdates:          map[ProposalRef]updateSecrets{},
 		NewCredentials:          map[LeafIndex]bool{},
+		ExternalPSKs:            map[string][]byte{},
+		ResumptionPSKs:          map[resumptionPSKKey][]byte{},
 	}
 
 	// At this point, every leaf in the tree is new
@@ -135,86 +335,139 @@ func NewStateFromWelcome(suite CipherSuite, epochSecret []byte, welcome Welcome)
 		s.NewCredentials[i] = true
 	}
 
-	return s, gi.SignerIndex, gi.Confirmation, nil
+	return s
 }
 
 func NewJoinedState(initSecret []byte, sigPrivs []SignaturePrivateKey, kps []KeyPackage, welcome Welcome) (*State, error) {
-	var initPriv HPKEPrivateKey
+	return NewJoinedStateWithLifetime(initSecret, sigPrivs, kps, welcome, DefaultLifetimeConfig)
+}
+
+// Join a group from a Welcome, checking KeyPackage lifetimes and keeping time
+// with the specified settings
+func NewJoinedStateWithLifetime(initSecret []byte, sigPrivs []SignaturePrivateKey, kps []KeyPackage, welcome Welcome, cfg LifetimeConfig) (*State, error) {
+	s, _, err := newJoinedState(initSecret, sigPrivs, kps, welcome, nil, cfg, nil, nil)
+	return s, err
+}
+
+// Join a group from a Welcome whose epoch has PSKs injected into it, which are
+// looked up in the specified store
+func NewJoinedStateWithPSKs(initSecret []byte, sigPrivs []SignaturePrivateKey, kps []KeyPackage, welcome Welcome, psks PSKStore, cfg LifetimeConfig) (*State, error) {
+	s, _, err := newJoinedState(initSecret, sigPrivs, kps, welcome, nil, cfg, nil, psks)
+	return s, err
+}
+
+// Join a group from a Welcome that omits the ratchet tree, using a tree
+// obtained separately, e.g., from a RatchetTreeExtension.  The tree must match
+// the tree hash signed in the Welcome.
+func NewJoinedStateWithTree(initSecret []byte, sigPrivs []SignaturePrivateKey, kps []KeyPackage, welcome Welcome, tree TreeKEMPublicKey, cfg LifetimeConfig) (*State, error) {
+	s, _, err := newJoinedState(initSecret, sigPrivs, kps, welcome, &tree, cfg, nil, nil)
+	return s, err
+}
+
+// Join a group from a Welcome, checking the credentials of all members with
+// the specified AuthenticationService.  The service remains set on the
+// resulting state.  If the tree is nil, it is taken from the Welcome.
+func NewJoinedStateWithAuthentication(initSecret []byte, sigPrivs []SignaturePrivateKey, kps []KeyPackage, welcome Welcome, tree *TreeKEMPublicKey, cfg LifetimeConfig, auth AuthenticationService) (*State, error) {
+	s, _, err := newJoinedState(initSecret, sigPrivs, kps, welcome, tree, cfg, auth, nil)
+	return s, err
+}
+
+// Also returns the IDs of the PSKs injected into the epoch joined
+func newJoinedState(initSecret []byte, sigPrivs []SignaturePrivateKey, kps []KeyPackage, welcome Welcome, tree *TreeKEMPublicKey, cfg LifetimeConfig, auth AuthenticationService, psks PSKStore) (*State, []PreSharedKeyID, error) {
 	var sigPriv SignaturePrivateKey
 	var keyPackage KeyPackage
-	var encGroupSecrets EncryptedGroupSecrets
-	var found = false
+	var groupSecrets *GroupSecrets
 	suite := welcome.CipherSuite
 	// extract the keyPackage for init secret
 	for idx, kp := range kps {
-		data, err := syntax.Marshal(kp)
+		egs, err := welcome.findSecrets(kp)
 		if err != nil {
-			return nil, fmt.Errorf("mls.state: kp %d marshal failure %v", idx, err)
-		}
-		kphash := welcome.CipherSuite.Digest(data)
-		// parse the encryptedKeyPackage to find our right kp
-		for _, egs := range welcome.Secrets {
-			found = bytes.Equal(kphash, egs.KeyPackageHash)
-			if found {
-				initPriv, err = kp.CipherSuite.hpke().Derive(initSecret)
-				if err != nil {
-					return nil, err
-				}
+			return nil, nil, fmt.Errorf("mls.state: kp %d %v", idx, err)
+		}
 
-				if !initPriv.PublicKey.Equals(kp.InitKey) {
-					return nil, fmt.Errorf("Incorrect init secret")
-				}
+		if egs == nil {
+			continue
+		}
 
-				sigPriv = sigPrivs[idx]
-				keyPackage = kp
-				encGroupSecrets = egs
-				break
-			}
+		if kp.CipherSuite != welcome.CipherSuite {
+			return nil, nil, fmt.Errorf("mls.state: ciphersuite mismatch")
 		}
-		if found {
-			break
+
+		initPriv, err := kp.CipherSuite.hpke().Derive(initSecret)
+		if err != nil {
+			return nil, nil, err
 		}
-	}
 
-	if !found {
-		return nil, fmt.Errorf("mls.state: unable to decrypt welcome message")
-	}
+		if !initPriv.PublicKey.Equals(kp.InitKey) {
+			return nil, nil, fmt.Errorf("Incorrect init secret")
+		}
+
+		groupSecrets, err = welcome.DecryptSecrets(kp, initPriv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("mls.state: %v", err)
+		}
 
-	if keyPackage.CipherSuite != welcome.CipherSuite {
-		return nil, fmt.Errorf("mls.state: ciphersuite mismatch")
+		sigPriv = sigPrivs[idx]
+		keyPackage = kp
+		break
 	}
 
-	pt, err := suite.hpke().Decrypt(initPriv, []byte{}, encGroupSecrets.EncryptedGroupSecrets)
-	if err != nil {
-		return nil, fmt.Errorf("mls.state: encKeyPkg decryption failure %v", err)
+	if groupSecrets == nil {
+		return nil, nil, fmt.Errorf("mls.state: unable to decrypt welcome message")
 	}
+	defer zeroize(groupSecrets.JoinerSecret)
 
-	var groupSecrets GroupSecrets
-	_, err = syntax.Unmarshal(pt, &groupSecrets)
+	// Inject the same PSKs as the rest of the group
+	pskSecret, err := resolvePSKIDs(suite, psks, groupSecrets.PSKs)
 	if err != nil {
-		return nil, fmt.Errorf("mls.state: keyPkg unmarshal failure %v", err)
+		return nil, nil, err
 	}
 
 	// Construct a new state based on the GroupInfo
-	s, signerIndex, confirmation, err := NewStateFromWelcome(suite, groupSecrets.EpochSecret, welcome)
+	welcomeSecret := suite.welcomeSecret(groupSecrets.JoinerSecret, pskSecret)
+	s, signerIndex, confirmation, err := newStateFromWelcome(suite, welcomeSecret, welcome, tree)
+	zeroize(welcomeSecret)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	s.IdentityPriv = sigPriv
 	s.Scheme = keyPackage.Credential.Scheme()
+	s.SetLifetimeConfig(cfg)
+	s.auth = auth
 
 	// Verify that the joiner supports the group's extensions
-	for _, ext := range s.Extensions.Entries {
-		if !keyPackage.Extensions.Has(ext.ExtensionType) {
-			return nil, fmt.Errorf("Unsupported extension type [%04x]", ext.ExtensionType)
-		}
+	err = checkExtensionSupport(keyPackage, s.Extensions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Verify that the tree is well-formed and authentic, and that every
+	// member's KeyPackage is within its lifetime
+	schemes, err := allowedSignatureSchemes(s.CipherSuite, s.Extensions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.Tree.validate(schemes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("mls.state: Invalid tree %v", err)
+	}
+
+	err = verifyLeafLifetimes(s.Tree, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = s.authenticateTree()
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// Construct TreeKEM private key from parts provided
 	index, res := s.Tree.Find(keyPackage)
 	if !res {
-		return nil, fmt.Errorf("mls.state: new joiner not in the tree")
+		return nil, nil, fmt.Errorf("mls.state: new joiner not in the tree")
 	}
 	s.Index = index
 	commonAncestor := ancestor(s.Index, signerIndex)
@@ -230,25 +483,158 @@ func NewJoinedState(initSecret []byte, sigPrivs []SignaturePrivateKey, kps []Key
 	// Start up the key schedule
 	encGrpCtx, err := syntax.Marshal(s.groupContext())
 	if err != nil {
-		return nil, fmt.Errorf("mls.state: groupCtx marshal failure %v", err)
+		return nil, nil, fmt.Errorf("mls.state: groupCtx marshal failure %v", err)
 	}
 
-	s.Keys = newKeyScheduleEpoch(suite, LeafCount(s.Tree.Size()), groupSecrets.EpochSecret, encGrpCtx)
+	s.Keys = newJoinedKeyScheduleEpoch(suite, LeafCount(s.Tree.Size()), groupSecrets.JoinerSecret, pskSecret, encGrpCtx)
 
 	// confirmation verification
 	if !s.verifyConfirmation(confirmation) {
-		return nil, fmt.Errorf("mls.state: confirmation failed to verify")
+		return nil, nil, fmt.Errorf("mls.state: confirmation failed to verify")
 	}
 
-	return s, nil
+	s.saveResumptionPSK()
+	return s, groupSecrets.PSKs, nil
+}
+
+// Join a group by committing to a GroupInfo published with ExternalGroupInfo.
+// Returns the Commit adding the caller to the group, which should be sent to
+// the group's existing members, together with the caller's state in the new
+// epoch.
+func NewStateFromExternalCommit(leafSecret []byte, sigPriv SignaturePrivateKey, kp KeyPackage, gi GroupInfo) (*MLSPlaintext, *State, error) {
+	return NewStateFromExternalCommitWithLifetime(leafSecret, sigPriv, kp, gi, DefaultLifetimeConfig)
+}
+
+// Join a group by external commit, checking KeyPackage lifetimes and keeping
+// time with the specified settings
+func NewStateFromExternalCommitWithLifetime(leafSecret []byte, sigPriv SignaturePrivateKey, kp KeyPackage, gi GroupInfo, cfg LifetimeConfig) (*MLSPlaintext, *State, error) {
+	return NewStateFromExternalCommitWithAuthentication(leafSecret, sigPriv, kp, gi, cfg, nil)
+}
+
+// Join a group by external commit, checking the credentials of all members
+// with the specified AuthenticationService
+func NewStateFromExternalCommitWithAuthentication(leafSecret []byte, sigPriv SignaturePrivateKey, kp KeyPackage, gi GroupInfo, cfg LifetimeConfig, auth AuthenticationService) (*MLSPlaintext, *State, error) {
+	if gi.ExternalPub == nil {
+		return nil, nil, fmt.Errorf("mls.state: GroupInfo does not allow external commits")
+	}
+
+	// The GroupInfo does not state the ciphersuite, so we take it from the
+	// signer's leaf
+	signerKP, ok := gi.Tree.KeyPackage(gi.SignerIndex)
+	if !ok {
+		return nil, nil, fmt.Errorf("mls.state: GroupInfo signed from unoccupied leaf")
+	}
+
+	suite := signerKP.CipherSuite
+	if kp.CipherSuite != suite {
+		return nil, nil, fmt.Errorf("mls.state: ciphersuite mismatch")
+	}
+
+	// Hash a copy of the tree, so as not to write into the caller's nodes
+	gi.Tree = gi.Tree.Clone()
+	gi.Tree.Suite = suite
+	gi.Tree.SetHashAll()
+
+	if err := gi.verify(); err != nil {
+		return nil, nil, fmt.Errorf("mls.state: invalid groupInfo %v", err)
+	}
+
+	schemes, err := allowedSignatureSchemes(suite, gi.Extensions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := gi.Tree.validate(schemes); err != nil {
+		return nil, nil, fmt.Errorf("mls.state: Invalid tree %v", err)
+	}
+
+	if err := verifyLeafLifetimes(gi.Tree, cfg); err != nil {
+		return nil, nil, err
+	}
+
+	// Verify that the joiner supports the group's extensions
+	err = checkExtensionSupport(kp, gi.Extensions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s := &State{
+		CipherSuite:             suite,
+		GroupID:                 gi.GroupID,
+		Epoch:                   gi.Epoch,
+		Tree:                    gi.Tree.Clone(),
+		ConfirmedTranscriptHash: gi.ConfirmedTranscriptHash,
+		InterimTranscriptHash:   gi.InterimTranscriptHash,
+		Extensions:              gi.Extensions,
+		IdentityPriv:            sigPriv,
+		Scheme:                  kp.Credential.Scheme(),
+		PendingProposals:        []MLSPlaintext{},
+		PendingUpdates:          map[ProposalRef]updateSecrets{},
+		NewCredentials:          map[LeafIndex]bool{},
+		ExternalPSKs:            map[string][]byte{},
+		ResumptionPSKs:          map[resumptionPSKKey][]byte{},
+		auth:                    auth,
+	}
+	s.SetLifetimeConfig(cfg)
+
+	if err := s.authenticateTree(); err != nil {
+		return nil, nil, err
+	}
+
+	prevGrpCtx := s.groupContext()
+
+	// Derive an init secret that the existing members can reproduce
+	instance := suite.hpke()
+	instance.Rand = s.random()
+	kemOutput, initSecret, err := instance.ExportTo(*gi.ExternalPub, externalInitContext, suite.Constants().SecretSize)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.Keys = keyScheduleEpoch{Suite: suite, InitSecret: initSecret}
+
+	// Add ourselves to the tree and KEM fresh entropy to the group.  Our leaf
+	// changes in Encap, so the path context is taken from the prior tree.
+	ctx, err := syntax.Marshal(prevGrpCtx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.Index = s.Tree.AddLeaf(kp)
+	for i := LeafIndex(0); i < LeafIndex(s.Tree.Size()); i++ {
+		s.NewCredentials[i] = true
+	}
+
+	treePriv, treePath, err := s.Tree.encap(s.Index, ctx, leafSecret, sigPriv, nil, s.encryptionWorkers, s.random())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.TreePriv = *treePriv
+	commit := Commit{
+		ExternalInit: &ExternalInit{KEMOutput: kemOutput},
+		Path:         treePath,
+	}
+
+	pt, err := s.ratchetAndSign(commit, s.TreePriv.UpdateSecret, nil, prevGrpCtx, sigPriv)
+	if err != nil {
+		return nil, nil, fmt.Errorf("mls.state: racthet forward failed %v", err)
+	}
+
+	return pt, s, nil
 }
 
 func (s State) Add(kp KeyPackage) (*MLSPlaintext, error) {
-	// Verify that the new member supports the group's extensions
-	for _, ext := range s.Extensions.Entries {
-		if !kp.Extensions.Has(ext.ExtensionType) {
-			return nil, fmt.Errorf("Unsupported extension type [%04x]", ext.ExtensionType)
-		}
+	// Verify that the new member supports the group's extensions, and uses a
+	// signature scheme the group allows
+	err := checkExtensionSupport(kp, s.Extensions)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkSignatureScheme(s.CipherSuite, s.Extensions, kp.Credential.Scheme())
+	if err != nil {
+		return nil, err
 	}
 
 	addProposal := Proposal{
@@ -289,7 +675,93 @@ func (s *State) Remove(removed LeafIndex) (*MLSPlaintext, error) {
 	return pt, nil
 }
 
+func (s State) PreSharedKey(pskID PreSharedKeyID) (*MLSPlaintext, error) {
+	// Verify that we can resolve the PSK ourselves
+	if _, ok := s.PSK(pskID); !ok {
+		return nil, fmt.Errorf("mls.state: Unknown PSK")
+	}
+
+	if pskID.PSKNonce == nil {
+		nonce, err := s.CipherSuite.randomSecret(s.random())
+		if err != nil {
+			return nil, err
+		}
+
+		pskID.PSKNonce = nonce
+	}
+
+	pskProposal := Proposal{
+		PreSharedKey: &PreSharedKeyProposal{
+			PSK: pskID,
+		},
+	}
+
+	return s.sign(pskProposal)
+}
+
+func (s State) ReInit(groupID []byte, version ProtocolVersion, suite CipherSuite, ext ExtensionList) (*MLSPlaintext, error) {
+	reInit := &ReInitProposal{
+		GroupID:     dup(groupID),
+		Version:     version,
+		CipherSuite: suite,
+		Extensions:  ext,
+	}
+
+	err := s.validateReInit(reInit)
+	if err != nil {
+		return nil, err
+	}
+
+	reInitProposal := Proposal{
+		ReInit: reInit,
+	}
+
+	return s.sign(reInitProposal)
+}
+
+func (s State) GroupContextExtensions(ext ExtensionList) (*MLSPlaintext, error) {
+	// Verify that the current members support the new extensions
+	err := s.checkExtensionSupport(ext)
+	if err != nil {
+		return nil, err
+	}
+
+	gceProposal := Proposal{
+		GroupContextExtensions: &GroupContextExtensionsProposal{
+			Extensions: ext,
+		},
+	}
+
+	return s.sign(gceProposal)
+}
+
 func (s *State) Commit(leafSecret []byte) (*MLSPlaintext, *Welcome, *State, error) {
+	pt, wb, next, err := s.CommitStaged(leafSecret)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	err = wb.EncryptTo(wb.joiners)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	welcome, err := wb.Finalize()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return pt, welcome, next, nil
+}
+
+// Like Commit, but the Welcome is returned unencrypted, in a WelcomeBuilder,
+// so that the caller can encrypt the group secrets to the new members
+// separately from the commit.
+func (s *State) CommitStaged(leafSecret []byte) (*MLSPlaintext, *WelcomeBuilder, *State, error) {
+	if s.PendingReInit != nil {
+		return nil, nil, nil, errGroupFrozen
+	}
+
 	// Construct and apply a commit message
 	commit := Commit{}
 	var joiners []KeyPackage
@@ -305,9 +777,21 @@ func (s *State) Commit(leafSecret []byte) (*MLSPlaintext, *Welcome, *State, erro
 			commit.Updates = append(commit.Updates, pid)
 		case ProposalTypeRemove:
 			commit.Removes = append(commit.Removes, pid)
+		case ProposalTypePreSharedKey:
+			commit.PreSharedKeys = append(commit.PreSharedKeys, pid)
+		case ProposalTypeReInit:
+			commit.ReInits = append(commit.ReInits, pid)
+		case ProposalTypeGroupContextExtensions:
+			commit.GroupContextExtensions = append(commit.GroupContextExtensions, pid)
 		}
 	}
 
+	// A ReInit has to be committed on its own.  Rather than drop the other
+	// pending proposals, refuse to commit until they have been resolved.
+	if len(commit.ReInits) > 1 || (len(commit.ReInits) > 0 && len(s.PendingProposals) > 1) {
+		return nil, nil, nil, errReInitNotAlone
+	}
+
 	// init new state to apply commit and ratchet forward
 	next := s.Clone()
 	err := next.apply(commit)
@@ -315,6 +799,11 @@ func (s *State) Commit(leafSecret []byte) (*MLSPlaintext, *Welcome, *State, erro
 		return nil, nil, nil, err
 	}
 
+	pskIDs, pskSecret, err := next.resolvePSKs(commit.PreSharedKeys)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	// reset after commit the proposals
 	next.PendingProposals = nil
 
@@ -325,7 +814,7 @@ func (s *State) Commit(leafSecret []byte) (*MLSPlaintext, *Welcome, *State, erro
 			return nil, nil, nil, err
 		}
 
-		treePriv, treePath, err := next.Tree.Encap(s.Index, ctx, leafSecret, next.IdentityPriv, nil)
+		treePriv, treePath, err := next.Tree.encap(s.Index, ctx, leafSecret, next.IdentityPriv, nil, s.encryptionWorkers, s.random())
 		if err != nil {
 			return nil, nil, nil, err
 		}
@@ -334,8 +823,13 @@ func (s *State) Commit(leafSecret []byte) (*MLSPlaintext, *Welcome, *State, erro
 		commit.Path = treePath
 	}
 
+	// The joiner secret is only needed for the Welcome, so it is erased once
+	// the Welcome is built
+	joinerSecret := next.Keys.joinerSecret(next.TreePriv.UpdateSecret)
+	defer zeroize(joinerSecret)
+
 	// Create the Commit message and advance the transcripts / key schedule
-	pt, err := next.ratchetAndSign(commit, next.TreePriv.UpdateSecret, s.groupContext(), s.IdentityPriv)
+	pt, err := next.ratchetAndSign(commit, next.TreePriv.UpdateSecret, pskSecret, s.groupContext(), s.IdentityPriv)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("mls.state: racthet forward failed %v", err)
 	}
@@ -344,28 +838,90 @@ func (s *State) Commit(leafSecret []byte) (*MLSPlaintext, *Welcome, *State, erro
 	gi := &GroupInfo{
 		GroupID:                 next.GroupID,
 		Epoch:                   next.Epoch,
+		TreeHash:                next.Tree.RootHash(),
 		Tree:                    next.Tree,
 		ConfirmedTranscriptHash: next.ConfirmedTranscriptHash,
 		InterimTranscriptHash:   next.InterimTranscriptHash,
+		Extensions:              next.Extensions,
 		Confirmation:            pt.Content.Commit.Confirmation.Data,
 	}
-	err = gi.sign(next.Index, &next.IdentityPriv)
+	if s.treeDelivery == treeInExtension {
+		err = gi.addTreeExtension()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("mls.state: ratchet tree extension failure %v", err)
+		}
+	}
+
+	err = gi.sign(next.Index, &next.IdentityPriv, s.random())
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("mls.state: groupInfo sign failure %v", err)
 	}
 
-	welcome := newWelcome(s.CipherSuite, next.Keys.EpochSecret, gi)
-	for _, kp := range joiners {
-		leaf, ok := next.Tree.Find(kp)
-		if !ok {
-			return nil, nil, nil, fmt.Errorf("mls.state: New joiner not in tree")
+	if s.treeDelivery != treeInline {
+		gi.omitTree()
+	}
+
+	wb := &WelcomeBuilder{
+		welcome: newWelcome(s.CipherSuite, joinerSecret, pskIDs, pskSecret, gi),
+		next:    next,
+		joiners: joiners,
+	}
+
+	next.retainPastEpoch(*s)
+
+	// Cache the commit so that we can advance when it comes back to us
+	s.pendingCommit = &cachedCommit{
+		Hash: s.plaintextHash(*pt),
+		Next: next,
+	}
+
+	return pt, wb, next, nil
+}
+
+// Builds the Welcome for a commit in stages: the group secrets are encrypted
+// to the new members with one or more calls to EncryptTo, then Finalize
+// encrypts the GroupInfo and returns the Welcome.
+type WelcomeBuilder struct {
+	welcome *Welcome
+	next    *State
+	joiners []KeyPackage
+}
+
+// The KeyPackages of the members added by the commit
+func (wb *WelcomeBuilder) Joiners() []KeyPackage {
+	return append([]KeyPackage{}, wb.joiners...)
+}
+
+// Encrypt the group secrets to the specified new members, using the encryption
+// workers and source of randomness of the committer's state
+func (wb *WelcomeBuilder) EncryptTo(kps []KeyPackage) error {
+	pathSecrets := make([][]byte, len(kps))
+	for i, kp := range kps {
+		leaf, ok := wb.next.Tree.Find(kp)
+		if !ok {
+			return fmt.Errorf("mls.state: New joiner not in tree")
 		}
 
-		_, pathSecret, ok := next.TreePriv.SharedPathSecret(leaf)
-		welcome.EncryptTo(kp, pathSecret)
+		_, pathSecrets[i], _ = wb.next.TreePriv.SharedPathSecret(leaf)
 	}
 
-	return pt, welcome, next, nil
+	err := wb.welcome.encryptToAll(kps, pathSecrets, wb.next.encryptionWorkers, wb.next.random())
+	if err != nil {
+		return fmt.Errorf("mls.state: %v", err)
+	}
+
+	return nil
+}
+
+// Encrypt the GroupInfo and return the Welcome.  No further members can be
+// added after this.
+func (wb *WelcomeBuilder) Finalize() (*Welcome, error) {
+	err := wb.welcome.finalize()
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: %v", err)
+	}
+
+	return wb.welcome, nil
 }
 
 /// Proposal processing helpers
@@ -390,6 +946,34 @@ func (s *State) apply(commit Commit) error {
 		return err
 	}
 
+	err = s.applyProposals(commit.PreSharedKeys, processedProposals)
+	if err != nil {
+		return err
+	}
+
+	// Extensions are changed after the membership changes, so that they are
+	// checked against the new membership
+	if len(commit.GroupContextExtensions) > 1 {
+		return fmt.Errorf("mls.state: Multiple GroupContextExtensions in commit")
+	}
+
+	err = s.applyProposals(commit.GroupContextExtensions, processedProposals)
+	if err != nil {
+		return err
+	}
+
+	if len(commit.ReInits) > 0 {
+		otherProposals := len(commit.Updates) + len(commit.Removes) + len(commit.Adds) + len(commit.PreSharedKeys) + len(commit.GroupContextExtensions)
+		if len(commit.ReInits) > 1 || otherProposals > 0 {
+			return errReInitNotAlone
+		}
+
+		err = s.applyProposals(commit.ReInits, processedProposals)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -398,13 +982,13 @@ func (s *State) applyAddProposal(add *AddProposal) error {
 		return fmt.Errorf("mls.state: new member kp does not use group ciphersuite")
 	}
 
-	if !add.KeyPackage.Verify() {
-		return fmt.Errorf("mls.state: Invalid kp")
+	if err := s.verifyKeyPackage(s.Tree.nextLeaf(), add.KeyPackage); err != nil {
+		return err
 	}
 
 	target := s.Tree.AddLeaf(add.KeyPackage)
 	s.NewCredentials[target] = true
-	return nil
+	return s.authenticate(target, add.KeyPackage.Credential)
 }
 
 func (s *State) applyRemoveProposal(remove *RemoveProposal) {
@@ -416,8 +1000,8 @@ func (s *State) applyUpdateProposal(target LeafIndex, update *UpdateProposal) er
 		panic(fmt.Errorf("mls.state: update kp does not use group ciphersuite %v != %v", update.KeyPackage.CipherSuite, s.CipherSuite))
 	}
 
-	if !update.KeyPackage.Verify() {
-		return fmt.Errorf("mls.state: Invalid kp")
+	if err := s.verifyKeyPackage(target, update.KeyPackage); err != nil {
+		return err
 	}
 
 	currKP, ok := s.Tree.KeyPackage(target)
@@ -426,6 +1010,10 @@ func (s *State) applyUpdateProposal(target LeafIndex, update *UpdateProposal) er
 	}
 
 	if !update.KeyPackage.Credential.Equals(currKP.Credential) {
+		if err := s.authenticate(target, update.KeyPackage.Credential); err != nil {
+			return err
+		}
+
 		s.NewCredentials[target] = true
 	}
 
@@ -480,6 +1068,29 @@ func (s *State) applyProposals(ids []ProposalID, processed map[string]bool) erro
 		case ProposalTypeRemove:
 			s.applyRemoveProposal(proposal.Remove)
 
+		case ProposalTypePreSharedKey:
+			// PSKs do not change the tree; they are injected into the key
+			// schedule via resolvePSKs()
+			if _, ok := s.PSK(proposal.PreSharedKey.PSK); !ok {
+				return fmt.Errorf("mls.state: commit of unknown PSK")
+			}
+
+		case ProposalTypeReInit:
+			err := s.validateReInit(proposal.ReInit)
+			if err != nil {
+				return err
+			}
+
+			s.PendingReInit = proposal.ReInit
+
+		case ProposalTypeGroupContextExtensions:
+			err := s.checkExtensionSupport(proposal.GroupContextExtensions.Extensions)
+			if err != nil {
+				return err
+			}
+
+			s.Extensions = proposal.GroupContextExtensions.Extensions
+
 		default:
 			return fmt.Errorf("mls.state: invalid proposal type")
 		}
@@ -487,6 +1098,152 @@ func (s *State) applyProposals(ids []ProposalID, processed map[string]bool) erro
 	return nil
 }
 
+// Add the sender of an external commit to the tree, and replace the init
+// secret with the one they provided.  Returns the index of the new member.
+func (s *State) applyExternalInit(commit Commit) (LeafIndex, error) {
+	nonExternal := len(commit.Updates) + len(commit.Removes) + len(commit.Adds) + len(commit.PreSharedKeys) +
+		len(commit.ReInits) + len(commit.GroupContextExtensions)
+	if commit.ExternalInit == nil || commit.Path == nil || nonExternal > 0 {
+		return 0, fmt.Errorf("mls.state: Malformed external commit")
+	}
+
+	kp := commit.Path.LeafKeyPackage
+	if kp.CipherSuite != s.CipherSuite {
+		return 0, fmt.Errorf("mls.state: new member kp does not use group ciphersuite")
+	}
+
+	if err := s.verifyKeyPackage(s.Tree.nextLeaf(), kp); err != nil {
+		return 0, err
+	}
+
+	err := checkExtensionSupport(kp, s.Extensions)
+	if err != nil {
+		return 0, err
+	}
+
+	externalPriv, err := s.Keys.ExternalPriv()
+	if err != nil {
+		return 0, err
+	}
+
+	initSecret, err := s.CipherSuite.hpke().ExportFrom(externalPriv, commit.ExternalInit.KEMOutput, externalInitContext, s.CipherSuite.Constants().SecretSize)
+	if err != nil {
+		return 0, err
+	}
+
+	s.Keys.InitSecret = initSecret
+
+	index := s.Tree.AddLeaf(kp)
+	s.NewCredentials[index] = true
+	return index, s.authenticate(index, kp.Credential)
+}
+
+// A source of PSKs for new members, who must hold every PSK injected into the
+// epoch they join.  A State is a PSKStore holding its own PSKs.
+type PSKStore interface {
+	PSK(pskID PreSharedKeyID) ([]byte, bool)
+}
+
+// A PSKStore of external PSKs, keyed by PSK ID
+type ExternalPSKStore map[string][]byte
+
+func (eps ExternalPSKStore) PSK(pskID PreSharedKeyID) ([]byte, bool) {
+	if pskID.Type() != PSKTypeExternal {
+		return nil, false
+	}
+
+	psk, ok := eps[string(pskID.External.PSKID)]
+	return psk, ok
+}
+
+// Combine the identified PSKs into a PSK secret for the key schedule
+func resolvePSKIDs(suite CipherSuite, store PSKStore, pskIDs []PreSharedKeyID) ([]byte, error) {
+	psks := make([][]byte, len(pskIDs))
+	for i, pskID := range pskIDs {
+		var ok bool
+		if store != nil {
+			psks[i], ok = store.PSK(pskID)
+		}
+
+		if !ok {
+			return nil, fmt.Errorf("mls.state: Unknown PSK")
+		}
+	}
+
+	return suite.pskSecret(pskIDs, psks)
+}
+
+func (s State) PSK(pskID PreSharedKeyID) ([]byte, bool) {
+	var psk []byte
+	var ok bool
+	switch pskID.Type() {
+	case PSKTypeExternal:
+		psk, ok = s.ExternalPSKs[string(pskID.External.PSKID)]
+	case PSKTypeResumption:
+		key := resumptionPSKKey{string(pskID.Resumption.PSKGroupID), pskID.Resumption.PSKEpoch}
+		psk, ok = s.ResumptionPSKs[key]
+	}
+
+	return psk, ok
+}
+
+// Look up the PSKs committed by the identified proposals and combine them into
+// a PSK secret for the key schedule.  The PSK IDs are returned for new members.
+func (s State) resolvePSKs(ids []ProposalID) ([]PreSharedKeyID, []byte, error) {
+	pskIDs := make([]PreSharedKeyID, len(ids))
+	for i, id := range ids {
+		pt, ok := s.findProposal(id)
+		if !ok {
+			return nil, nil, fmt.Errorf("mls.state: commit of unknown proposal %s", id)
+		}
+
+		proposal := pt.Content.Proposal
+		if proposal.Type() != ProposalTypePreSharedKey {
+			return nil, nil, fmt.Errorf("mls.state: commit of non-PSK proposal as PSK")
+		}
+
+		pskIDs[i] = proposal.PreSharedKey.PSK
+	}
+
+	pskSecret, err := resolvePSKIDs(s.CipherSuite, s, pskIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pskIDs, pskSecret, nil
+}
+
+func (s *State) SetExternalPSK(id, psk []byte) {
+	s.ExternalPSKs[string(id)] = dup(psk)
+}
+
+func (s *State) RemoveExternalPSK(id []byte) {
+	key := string(id)
+	if psk, ok := s.ExternalPSKs[key]; ok {
+		zeroize(psk)
+		delete(s.ExternalPSKs, key)
+	}
+}
+
+// Resumption PSKs for this group are recorded automatically as the group
+// advances.  This method allows the application to provide resumption secrets
+// from other groups.
+func (s *State) SetResumptionPSK(groupID []byte, epoch Epoch, secret []byte) {
+	s.ResumptionPSKs[resumptionPSKKey{string(groupID), epoch}] = dup(secret)
+}
+
+func (s *State) saveResumptionPSK() {
+	groupID := string(s.GroupID)
+	s.ResumptionPSKs[resumptionPSKKey{groupID, s.Epoch}] = dup(s.Keys.ResumptionSecret)
+
+	for key, secret := range s.ResumptionPSKs {
+		if key.GroupID == groupID && key.Epoch+resumptionPSKWindow <= s.Epoch {
+			zeroize(secret)
+			delete(s.ResumptionPSKs, key)
+		}
+	}
+}
+
 func (s State) findProposal(id ProposalID) (MLSPlaintext, bool) {
 	for _, pt := range s.PendingProposals {
 		otherPid := s.proposalID(pt)
@@ -501,14 +1258,18 @@ func (s State) findProposal(id ProposalID) (MLSPlaintext, bool) {
 }
 
 func (s State) proposalID(plaintext MLSPlaintext) ProposalID {
+	return ProposalID{
+		Hash: s.plaintextHash(plaintext),
+	}
+}
+
+func (s State) plaintextHash(plaintext MLSPlaintext) []byte {
 	enc, err := syntax.Marshal(plaintext)
 	if err != nil {
 		panic(fmt.Errorf("mls.state: mlsPlainText marshal failure %v", err))
-
-	}
-	return ProposalID{
-		Hash: s.CipherSuite.Digest(enc),
 	}
+
+	return s.CipherSuite.Digest(enc)
 }
 
 func (s State) groupContext() GroupContext {
@@ -522,6 +1283,10 @@ func (s State) groupContext() GroupContext {
 }
 
 func (s State) sign(p Proposal) (*MLSPlaintext, error) {
+	if s.PendingReInit != nil {
+		return nil, errGroupFrozen
+	}
+
 	pt := &MLSPlaintext{
 		GroupID: s.GroupID,
 		Epoch:   s.Epoch,
@@ -531,33 +1296,58 @@ func (s State) sign(p Proposal) (*MLSPlaintext, error) {
 		},
 	}
 
-	err := pt.sign(s.groupContext(), s.IdentityPriv, s.Scheme)
+	err := pt.sign(s.groupContext(), s.IdentityPriv, s.Scheme, s.random())
 	if err != nil {
 		return nil, err
 	}
 	return pt, nil
 }
 
-func (s *State) updateEpochSecrets(secret []byte) {
-	ctx, err := syntax.Marshal(GroupContext{
-		GroupID:                 s.GroupID,
-		Epoch:                   s.Epoch,
-		TreeHash:                s.Tree.RootHash(),
-		ConfirmedTranscriptHash: s.ConfirmedTranscriptHash,
-	})
+// Sign a proposal on behalf of a preconfigured sender, i.e., one listed in the
+// group's ExternalSendersExtension at the specified index
+func SignPreconfiguredProposal(ctx GroupContext, sender uint32, p Proposal, sigPriv SignaturePrivateKey, scheme SignatureScheme) (*MLSPlaintext, error) {
+	return SignPreconfiguredProposalWithRand(rand.Reader, ctx, sender, p, sigPriv, scheme)
+}
+
+// Like SignPreconfiguredProposal, but draws any randomness from the specified
+// source
+func SignPreconfiguredProposalWithRand(r io.Reader, ctx GroupContext, sender uint32, p Proposal, sigPriv SignaturePrivateKey, scheme SignatureScheme) (*MLSPlaintext, error) {
+	pt := &MLSPlaintext{
+		GroupID: ctx.GroupID,
+		Epoch:   ctx.Epoch,
+		Sender:  Sender{SenderTypePreconfigured, sender},
+		Content: MLSPlaintextContent{
+			Proposal: &p,
+		},
+	}
+
+	err := pt.sign(ctx, sigPriv, scheme, r)
+	if err != nil {
+		return nil, err
+	}
+	return pt, nil
+}
+
+func (s *State) updateEpochSecrets(commitSecret, pskSecret []byte) {
+	ctx, err := syntax.Marshal(s.groupContext())
 	if err != nil {
 		panic(fmt.Errorf("mls.state: update epoch secret failed %v", err))
 	}
 
-	// TODO(RLB) Provide an API to provide PSKs
-	s.Keys = s.Keys.Next(LeafCount(s.Tree.Size()), nil, secret, ctx)
+	s.Keys = s.Keys.Next(LeafCount(s.Tree.Size()), pskSecret, commitSecret, ctx)
+	s.saveResumptionPSK()
 }
 
-func (s *State) ratchetAndSign(op Commit, commitSecret []byte, prevGrpCtx GroupContext, sigPriv SignaturePrivateKey) (*MLSPlaintext, error) {
+func (s *State) ratchetAndSign(op Commit, commitSecret, pskSecret []byte, prevGrpCtx GroupContext, sigPriv SignaturePrivateKey) (*MLSPlaintext, error) {
+	sender := Sender{SenderTypeMember, uint32(s.Index)}
+	if op.ExternalInit != nil {
+		sender = Sender{SenderTypeNewMember, 0}
+	}
+
 	pt := &MLSPlaintext{
 		GroupID: s.GroupID,
 		Epoch:   s.Epoch,
-		Sender:  Sender{SenderTypeMember, uint32(s.Index)},
+		Sender:  sender,
 		Content: MLSPlaintextContent{
 			Commit: &CommitData{
 				Commit: op,
@@ -573,7 +1363,7 @@ func (s *State) ratchetAndSign(op Commit, commitSecret []byte, prevGrpCtx GroupC
 
 	// Advance the key schedule
 	s.Epoch += 1
-	s.updateEpochSecrets(commitSecret)
+	s.updateEpochSecrets(commitSecret, pskSecret)
 
 	// generate the confirmation based on the new keys
 	commit := pt.Content.Commit
@@ -583,7 +1373,7 @@ func (s *State) ratchetAndSign(op Commit, commitSecret []byte, prevGrpCtx GroupC
 
 	// sign the MLSPlainText and update state hashes
 	// as a result of ratcheting.
-	err := pt.sign(prevGrpCtx, sigPriv, s.Scheme)
+	err := pt.sign(prevGrpCtx, sigPriv, s.Scheme, s.random())
 	if err != nil {
 		return nil, err
 	}
@@ -601,24 +1391,109 @@ func (s *State) ratchetAndSign(op Commit, commitSecret []byte, prevGrpCtx GroupC
 	return pt, nil
 }
 
-func (s State) signerPublicKey(sender Sender) (*SignaturePublicKey, error) {
-	switch sender.Type {
+// The key and scheme with which the sender of a message signed it.  Members
+// sign with the scheme of their own credential.
+func (s State) signerPublicKey(pt *MLSPlaintext) (*SignaturePublicKey, SignatureScheme, error) {
+	switch pt.Sender.Type {
 	case SenderTypeMember:
-		kp, ok := s.Tree.KeyPackage(LeafIndex(sender.Sender))
+		kp, ok := s.Tree.KeyPackage(LeafIndex(pt.Sender.Sender))
 		if !ok {
-			return nil, fmt.Errorf("mls.state: Received from blank leaf")
+			return nil, 0, fmt.Errorf("mls.state: Received from blank leaf")
+		}
+
+		return kp.Credential.PublicKey(), kp.Credential.Scheme(), nil
+
+	case SenderTypeNewMember:
+		// An external commit is signed with the key in the new member's leaf
+		if pt.Content.Type() != ContentTypeCommit {
+			return nil, 0, fmt.Errorf("mls.state: Non-commit from new member")
+		}
+
+		commit := pt.Content.Commit.Commit
+		if commit.ExternalInit == nil || commit.Path == nil {
+			return nil, 0, fmt.Errorf("mls.state: Malformed external commit")
+		}
+
+		cred := commit.Path.LeafKeyPackage.Credential
+		return cred.PublicKey(), cred.Scheme(), nil
+
+	case SenderTypePreconfigured:
+		// Preconfigured senders may only propose to add or remove members
+		if pt.Content.Type() != ContentTypeProposal {
+			return nil, 0, fmt.Errorf("mls.state: Non-proposal from preconfigured sender")
+		}
+
+		proposalType := pt.Content.Proposal.Type()
+		if proposalType != ProposalTypeAdd && proposalType != ProposalTypeRemove {
+			return nil, 0, fmt.Errorf("mls.state: Preconfigured sender may only Add or Remove")
+		}
+
+		var senders ExternalSendersExtension
+		found, err := s.Extensions.Find(&senders)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if !found || int(pt.Sender.Sender) >= len(senders.Senders) {
+			return nil, 0, fmt.Errorf("mls.state: Unknown preconfigured sender")
+		}
+
+		sender := senders.Senders[pt.Sender.Sender]
+		err = checkSignatureScheme(s.CipherSuite, s.Extensions, sender.SignatureScheme)
+		if err != nil {
+			return nil, 0, err
 		}
 
-		return kp.Credential.PublicKey(), nil
+		return &sender.SignatureKey, sender.SignatureScheme, nil
 
 	default:
-		// TODO(RLB): Support add sent by new member
-		// TODO(RLB): Support add/remove signed by preconfigured key
-		return nil, fmt.Errorf("mls.state: Unsupported sender type")
+		return nil, 0, fmt.Errorf("mls.state: Unsupported sender type")
 	}
 }
 
 func (s *State) Handle(pt *MLSPlaintext) (*State, error) {
+	// Non-members cannot encrypt, so the policy only applies to members
+	policy, err := s.wireFormatPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	if policy == WireFormatPolicyEncryptHandshake && pt.Sender.Type == SenderTypeMember {
+		return nil, fmt.Errorf("mls.state: Handshake message must be encrypted")
+	}
+
+	return s.handle(pt)
+}
+
+func (s *State) HandleCiphertext(ct *MLSCiphertext) (*State, error) {
+	contentType := ContentType(ct.ContentType)
+	if contentType != ContentTypeProposal && contentType != ContentTypeCommit {
+		return nil, fmt.Errorf("mls.state: HandleCiphertext on non-handshake message")
+	}
+
+	pt, err := s.decrypt(ct)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.handle(pt)
+}
+
+func (s State) wireFormatPolicy() (WireFormatPolicy, error) {
+	var policy WireFormatPolicyExtension
+	_, err := s.Extensions.Find(&policy)
+	if err != nil {
+		return 0, err
+	}
+
+	return policy.HandshakePolicy, nil
+}
+
+func (s *State) handle(pt *MLSPlaintext) (*State, error) {
+	if s.PendingReInit != nil {
+		return nil, errGroupFrozen
+	}
+
 	if !bytes.Equal(pt.GroupID, s.GroupID) {
 		return nil, fmt.Errorf("mls.state: groupId mismatch")
 	}
@@ -627,12 +1502,12 @@ func (s *State) Handle(pt *MLSPlaintext) (*State, error) {
 		return nil, fmt.Errorf("mls.state: epoch mismatch, have %v, got %v", s.Epoch, pt.Epoch)
 	}
 
-	sigPubKey, err := s.signerPublicKey(pt.Sender)
+	sigPubKey, scheme, err := s.signerPublicKey(pt)
 	if err != nil {
 		return nil, err
 	}
 
-	if !pt.verify(s.groupContext(), sigPubKey, s.Scheme) {
+	if !pt.verify(s.groupContext(), sigPubKey, scheme) {
 		return nil, fmt.Errorf("invalid handshake message signature")
 	}
 
@@ -645,12 +1520,12 @@ func (s *State) Handle(pt *MLSPlaintext) (*State, error) {
 
 	if contentType != ContentTypeCommit {
 		return nil, fmt.Errorf("mls.state: incorrect content type")
-	} else if pt.Sender.Type != SenderTypeMember {
+	} else if pt.Sender.Type != SenderTypeMember && pt.Sender.Type != SenderTypeNewMember {
 		return nil, fmt.Errorf("mls.state: commit from non-member")
 	}
 
-	if LeafIndex(pt.Sender.Sender) == s.Index {
-		return nil, fmt.Errorf("mls.state: handle own commits with caching")
+	if pt.Sender.Type == SenderTypeMember && LeafIndex(pt.Sender.Sender) == s.Index {
+		return s.handleOwnCommit(pt)
 	}
 
 	// apply the commit and discard any remaining pending proposals
@@ -662,19 +1537,44 @@ func (s *State) Handle(pt *MLSPlaintext) (*State, error) {
 		return nil, err
 	}
 
+	// the context for the direct path is computed before an external sender is
+	// added, since the sender cannot know its final leaf before encapsulating
+	ctx, err := syntax.Marshal(next.groupContext())
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: failure to create context %v", err)
+	}
+
+	// an external commit adds the sender and replaces the init secret
+	if pt.Sender.Type == SenderTypeNewMember {
+		senderIndex, err = next.applyExternalInit(commitData.Commit)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, pskSecret, err := next.resolvePSKs(commitData.Commit.PreSharedKeys)
+	if err != nil {
+		return nil, err
+	}
+
 	next.PendingProposals = next.PendingProposals[:0]
 
 	// apply the direct path, if provided
 	commitSecret := s.CipherSuite.zero()
 	if commitData.Commit.Path != nil {
-		ctx, err := syntax.Marshal(GroupContext{
-			GroupID:                 next.GroupID,
-			Epoch:                   next.Epoch,
-			TreeHash:                next.Tree.RootHash(),
-			ConfirmedTranscriptHash: next.ConfirmedTranscriptHash,
-		})
+		err = commitData.Commit.Path.LeafKeyPackage.VerifyLifetime(s.lifetimeConfig())
+		if err != nil {
+			return nil, fmt.Errorf("mls.state: Invalid committer kp %v", err)
+		}
+
+		err = commitData.Commit.Path.ParentHashValid(s.CipherSuite)
+		if err != nil {
+			return nil, fmt.Errorf("mls.state: Invalid parent hash %v", err)
+		}
+
+		err = next.authenticatePathLeaf(senderIndex, commitData.Commit.Path.LeafKeyPackage)
 		if err != nil {
-			return nil, fmt.Errorf("mls.state: failure to create context %v", err)
+			return nil, err
 		}
 
 		err = next.TreePriv.Decap(senderIndex, next.Tree, ctx, *commitData.Commit.Path)
@@ -698,7 +1598,7 @@ func (s *State) Handle(pt *MLSPlaintext) (*State, error) {
 
 	// Advance the key schedule
 	next.Epoch += 1
-	next.updateEpochSecrets(commitSecret)
+	next.updateEpochSecrets(commitSecret, pskSecret)
 
 	// Verify confirmation MAC
 	if !next.verifyConfirmation(commitData.Confirmation.Data) {
@@ -716,55 +1616,322 @@ func (s *State) Handle(pt *MLSPlaintext) (*State, error) {
 	digest.Write(authData)
 	next.InterimTranscriptHash = digest.Sum(nil)
 
+	next.retainPastEpoch(*s)
+
+	// Someone else's commit won this epoch, so ours will never be confirmed
+	s.pendingCommit = nil
+
 	return next, nil
 }
 
-///// protect/unprotect and helpers
-
-func (s State) verifyConfirmation(confirmation []byte) bool {
-	hmac := s.CipherSuite.NewHMAC(s.Keys.ConfirmationKey)
-	hmac.Write(s.ConfirmedTranscriptHash)
-	confirm := hmac.Sum(nil)
-	if !bytes.Equal(confirm, confirmation) {
-		return false
+func (s *State) handleOwnCommit(pt *MLSPlaintext) (*State, error) {
+	if s.pendingCommit == nil {
+		return nil, fmt.Errorf("mls.state: own commit with no cached state")
 	}
-	return true
-}
 
-func applyGuard(nonceIn []byte, reuseGuard [4]byte) []byte {
-	nonceOut := dup(nonceIn)
-	for i := range reuseGuard {
-		nonceOut[i] ^= reuseGuard[i]
+	if !bytes.Equal(s.plaintextHash(*pt), s.pendingCommit.Hash) {
+		return nil, fmt.Errorf("mls.state: own commit does not match cached commit")
 	}
-	return nonceOut
+
+	next := s.pendingCommit.Next
+	s.pendingCommit = nil
+	return next, nil
 }
 
-func (s *State) encrypt(pt *MLSPlaintext) (*MLSCiphertext, error) {
-	var generation uint32
-	var keys keyAndNonce
-	switch pt.Content.Type() {
-	case ContentTypeApplication:
-		generation, keys = s.Keys.ApplicationKeys.Next(s.Index)
-	case ContentTypeProposal, ContentTypeCommit:
-		generation, keys = s.Keys.HandshakeKeys.Next(s.Index)
-	default:
-		return nil, fmt.Errorf("mls.state: encrypt unknown content type")
+// Produce a signed GroupInfo for the current epoch that allows non-members to
+// join the group via NewStateFromExternalCommit
+func (s State) ExternalGroupInfo() (*GroupInfo, error) {
+	if s.PendingReInit != nil {
+		return nil, errGroupFrozen
 	}
 
-	var reuseGuard [4]byte
-	rand.Read(reuseGuard[:])
-
-	stream := syntax.NewWriteStream()
-	err := stream.WriteAll(s.Index, generation, reuseGuard)
+	externalPriv, err := s.Keys.ExternalPriv()
 	if err != nil {
-		return nil, fmt.Errorf("mls.state: sender data marshal failure %v", err)
+		return nil, err
 	}
 
-	senderData := stream.Data()
-	senderDataNonce := make([]byte, s.CipherSuite.Constants().NonceSize)
-	rand.Read(senderDataNonce)
-	senderDataAADVal := senderDataAAD(s.GroupID, s.Epoch, pt.Content.Type(), senderDataNonce)
-	sdAead, _ := s.CipherSuite.NewAEAD(s.Keys.SenderDataKey)
+	gi := &GroupInfo{
+		GroupID:                 s.GroupID,
+		Epoch:                   s.Epoch,
+		TreeHash:                s.Tree.RootHash(),
+		Tree:                    s.Tree.Clone(),
+		ConfirmedTranscriptHash: s.ConfirmedTranscriptHash,
+		InterimTranscriptHash:   s.InterimTranscriptHash,
+		Extensions:              s.Extensions,
+		ExternalPub:             &externalPriv.PublicKey,
+	}
+
+	err = gi.sign(s.Index, &s.IdentityPriv, s.random())
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: groupInfo sign failure %v", err)
+	}
+
+	return gi, nil
+}
+
+///// ReInit
+
+// An experimental ciphersuite is only accepted if every member has opted in to
+// it by advertising it in its KeyPackage
+func (s State) validateReInit(reInit *ReInitProposal) error {
+	versionOK := false
+	for _, v := range supportedVersions {
+		versionOK = versionOK || v == reInit.Version
+	}
+
+	suiteOK := containsCipherSuite(supportedCipherSuites, reInit.CipherSuite)
+	if !suiteOK && containsCipherSuite(experimentalCipherSuites, reInit.CipherSuite) {
+		suiteOK = s.membersAdvertise(reInit.CipherSuite)
+	}
+
+	if !versionOK || !suiteOK {
+		return fmt.Errorf("mls.state: Unsupported ReInit parameters %v %v", reInit.Version, reInit.CipherSuite)
+	}
+
+	return nil
+}
+
+func extensionsEqual(a, b ExtensionList) (bool, error) {
+	encA, err := syntax.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+
+	encB, err := syntax.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+
+	return bytes.Equal(encA, encB), nil
+}
+
+// Check that every member of the group supports a set of extensions, and that
+// they allow the signature schemes of every member and preconfigured sender
+func (s State) checkExtensionSupport(ext ExtensionList) error {
+	for i := LeafIndex(0); i < LeafIndex(s.Tree.Size()); i++ {
+		kp, ok := s.Tree.KeyPackage(i)
+		if !ok {
+			continue
+		}
+
+		err := checkExtensionSupport(kp, ext)
+		if err != nil {
+			return err
+		}
+
+		err = checkSignatureScheme(s.CipherSuite, ext, kp.Credential.Scheme())
+		if err != nil {
+			return err
+		}
+	}
+
+	return checkExternalSenders(s.CipherSuite, ext)
+}
+
+// The identities of members of the group, with the number of leaves holding
+// each identity
+// Whether every member's KeyPackage lists the ciphersuite as supported
+func (s State) membersAdvertise(suite CipherSuite) bool {
+	for i := LeafIndex(0); i < LeafIndex(s.Tree.Size()); i++ {
+		kp, ok := s.Tree.KeyPackage(i)
+		if !ok {
+			continue
+		}
+
+		var sce SupportedCipherSuitesExtension
+		found, err := kp.Extensions.Find(&sce)
+		if !found || err != nil || !containsCipherSuite(sce.SupportedCipherSuites, suite) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s State) roster() map[string]int {
+	roster := map[string]int{}
+	for i := LeafIndex(0); i < LeafIndex(s.Tree.Size()); i++ {
+		kp, ok := s.Tree.KeyPackage(i)
+		if !ok {
+			continue
+		}
+
+		roster[string(kp.Credential.Identity())] += 1
+	}
+	return roster
+}
+
+// Create the successor to a group frozen by a ReInit.  The key package kp is
+// the caller's in the new group; kps must provide one key package for each
+// other member of the current group.  The new group is tied to this one by
+// injecting the resumption secret of the current epoch as a PSK.
+func (s State) NewStateFromReInit(leafSecret []byte, sigPriv SignaturePrivateKey, kp KeyPackage, kps []KeyPackage) (*State, *Welcome, error) {
+	reInit := s.PendingReInit
+	if reInit == nil {
+		return nil, nil, fmt.Errorf("mls.state: No ReInit has been committed")
+	}
+
+	// The new group must have the same membership as the old one
+	newRoster := map[string]int{}
+	for _, memberKP := range append([]KeyPackage{kp}, kps...) {
+		if memberKP.Version != reInit.Version || memberKP.CipherSuite != reInit.CipherSuite {
+			return nil, nil, fmt.Errorf("mls.state: ReInit kp does not match ReInit parameters")
+		}
+
+		newRoster[string(memberKP.Credential.Identity())] += 1
+	}
+
+	if !reflect.DeepEqual(newRoster, s.roster()) {
+		return nil, nil, fmt.Errorf("mls.state: ReInit kps do not match roster")
+	}
+
+	next, err := NewEmptyStateWithExtensions(reInit.GroupID, leafSecret, sigPriv, kp, reInit.Extensions)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	next.lifetime = s.lifetime
+	next.encryptionWorkers = s.encryptionWorkers
+	next.auth = s.auth
+	next.randomSource = s.randomSource
+	next.SetResumptionPSK(s.GroupID, s.Epoch, s.Keys.ResumptionSecret)
+
+	var proposals []*MLSPlaintext
+	for _, memberKP := range kps {
+		add, err := next.Add(memberKP)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		proposals = append(proposals, add)
+	}
+
+	psk, err := next.PreSharedKey(NewResumptionPSKID(s.GroupID, s.Epoch))
+	if err != nil {
+		return nil, nil, err
+	}
+	proposals = append(proposals, psk)
+
+	for _, pt := range proposals {
+		_, err = next.handle(pt)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// The leaf secret has already been used for the initial leaf, so the
+	// commit path gets its own secret derived from it
+	commitSecret := next.CipherSuite.deriveSecret(leafSecret, "reinit commit", nil)
+	defer zeroize(commitSecret)
+
+	_, welcome, next, err := next.Commit(commitSecret)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return next, welcome, nil
+}
+
+// Join the successor to a group frozen by a ReInit, verifying that the new
+// group matches the committed ReInit parameters and the current roster.
+func (s State) JoinReInit(initSecret []byte, sigPrivs []SignaturePrivateKey, kps []KeyPackage, welcome Welcome) (*State, error) {
+	reInit := s.PendingReInit
+	if reInit == nil {
+		return nil, fmt.Errorf("mls.state: No ReInit has been committed")
+	}
+
+	// The new group's key schedule must include the resumption PSK for the
+	// current epoch, which only members of this group hold
+	next, psks, err := newJoinedState(initSecret, sigPrivs, kps, welcome, nil, s.lifetimeConfig(), s.auth, s)
+	if err != nil {
+		return nil, err
+	}
+
+	resumption := false
+	for _, pskID := range psks {
+		if pskID.Type() == PSKTypeResumption {
+			sameGroup := bytes.Equal(pskID.Resumption.PSKGroupID, s.GroupID)
+			resumption = resumption || (sameGroup && pskID.Resumption.PSKEpoch == s.Epoch)
+		}
+	}
+
+	if !resumption {
+		return nil, fmt.Errorf("mls.state: New group is not tied to this one by a resumption PSK")
+	}
+
+	next.lifetime = s.lifetime
+	next.encryptionWorkers = s.encryptionWorkers
+	next.randomSource = s.randomSource
+	groupID := bytes.Equal(next.GroupID, reInit.GroupID)
+	version := welcome.Version == reInit.Version
+	suite := next.CipherSuite == reInit.CipherSuite
+	extensions, err := extensionsEqual(next.Extensions, reInit.Extensions)
+	if err != nil {
+		return nil, err
+	}
+
+	if !groupID || !version || !suite || !extensions {
+		return nil, fmt.Errorf("mls.state: New group does not match ReInit parameters")
+	}
+
+	if !reflect.DeepEqual(next.roster(), s.roster()) {
+		return nil, fmt.Errorf("mls.state: New group does not match roster")
+	}
+
+	next.SetResumptionPSK(s.GroupID, s.Epoch, s.Keys.ResumptionSecret)
+	return next, nil
+}
+
+///// protect/unprotect and helpers
+
+func (s State) verifyConfirmation(confirmation []byte) bool {
+	hmac := s.CipherSuite.NewHMAC(s.Keys.ConfirmationKey)
+	hmac.Write(s.ConfirmedTranscriptHash)
+	confirm := hmac.Sum(nil)
+	if !bytes.Equal(confirm, confirmation) {
+		return false
+	}
+	return true
+}
+
+func applyGuard(nonceIn []byte, reuseGuard [4]byte) []byte {
+	nonceOut := dup(nonceIn)
+	for i := range reuseGuard {
+		nonceOut[i] ^= reuseGuard[i]
+	}
+	return nonceOut
+}
+
+func (s *State) encrypt(pt *MLSPlaintext) (*MLSCiphertext, error) {
+	var generation uint32
+	var keys keyAndNonce
+	switch pt.Content.Type() {
+	case ContentTypeApplication:
+		generation, keys = s.Keys.ApplicationKeys.Next(s.Index)
+	case ContentTypeProposal, ContentTypeCommit:
+		generation, keys = s.Keys.HandshakeKeys.Next(s.Index)
+	default:
+		return nil, fmt.Errorf("mls.state: encrypt unknown content type")
+	}
+
+	var reuseGuard [4]byte
+	if _, err := io.ReadFull(s.random(), reuseGuard[:]); err != nil {
+		return nil, fmt.Errorf("mls.state: reuse guard generation failure %v", err)
+	}
+
+	stream := syntax.NewWriteStream()
+	err := stream.WriteAll(s.Index, generation, reuseGuard)
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: sender data marshal failure %v", err)
+	}
+
+	senderData := stream.Data()
+	senderDataNonce := make([]byte, s.CipherSuite.Constants().NonceSize)
+	if _, err := io.ReadFull(s.random(), senderDataNonce); err != nil {
+		return nil, fmt.Errorf("mls.state: sender data nonce generation failure %v", err)
+	}
+	senderDataAADVal := senderDataAAD(s.GroupID, s.Epoch, pt.Content.Type(), senderDataNonce)
+	sdAead, _ := s.CipherSuite.NewAEAD(s.Keys.SenderDataKey)
 	sdCt := sdAead.Seal(nil, senderDataNonce, senderData, senderDataAADVal)
 
 	// content data
@@ -806,9 +1973,15 @@ func (s *State) decrypt(ct *MLSCiphertext) (*MLSPlaintext, error) {
 		return nil, fmt.Errorf("mls.state: ciphertext not from this epoch")
 	}
 
+	return decryptWithKeys(s.CipherSuite, ct, s.Keys.SenderDataKey, s.Keys.ApplicationKeys, s.Keys.HandshakeKeys)
+}
+
+// Decrypt a ciphertext using the keys for its epoch.  The handshake keys may be
+// nil, in which case only application messages can be decrypted.
+func decryptWithKeys(suite CipherSuite, ct *MLSCiphertext, senderDataKey []byte, appKeys, hsKeys *groupKeySource) (*MLSPlaintext, error) {
 	// handle sender data
 	sdAAD := senderDataAAD(ct.GroupID, ct.Epoch, ContentType(ct.ContentType), ct.SenderDataNonce)
-	sdAead, _ := s.CipherSuite.NewAEAD(s.Keys.SenderDataKey)
+	sdAead, _ := suite.NewAEAD(senderDataKey)
 	sd, err := sdAead.Open(nil, ct.SenderDataNonce, ct.EncryptedSenderData, sdAAD)
 	if err != nil {
 		return nil, fmt.Errorf("mls.state: senderData decryption failure %v", err)
@@ -828,24 +2001,28 @@ func (s *State) decrypt(ct *MLSCiphertext) (*MLSPlaintext, error) {
 	contentType := ContentType(ct.ContentType)
 	switch contentType {
 	case ContentTypeApplication:
-		keys, err = s.Keys.ApplicationKeys.Get(sender, generation)
+		keys, err = appKeys.Get(sender, generation)
 		if err != nil {
-			return nil, fmt.Errorf("mls.state: application keys extraction failed %v", err)
+			return nil, fmt.Errorf("mls.state: application keys extraction failed %w", err)
 		}
-		s.Keys.ApplicationKeys.Erase(sender, generation)
+		appKeys.Erase(sender, generation)
 	case ContentTypeProposal, ContentTypeCommit:
-		keys, err = s.Keys.HandshakeKeys.Get(sender, generation)
+		if hsKeys == nil {
+			return nil, fmt.Errorf("mls.state: no handshake keys for epoch")
+		}
+
+		keys, err = hsKeys.Get(sender, generation)
 		if err != nil {
-			return nil, fmt.Errorf("mls.state: handshake keys extraction failed %v", err)
+			return nil, fmt.Errorf("mls.state: handshake keys extraction failed %w", err)
 		}
-		s.Keys.HandshakeKeys.Erase(sender, generation)
+		hsKeys.Erase(sender, generation)
 	default:
 		return nil, fmt.Errorf("mls.state: unsupported content type")
 	}
 
 	aad := contentAAD(ct.GroupID, ct.Epoch, ContentType(ct.ContentType),
 		ct.AuthenticatedData, ct.SenderDataNonce, ct.EncryptedSenderData)
-	aead, _ := s.CipherSuite.NewAEAD(keys.Key)
+	aead, _ := suite.NewAEAD(keys.Key)
 	content, err := aead.Open(nil, applyGuard(keys.Nonce, reuseGuard), ct.Ciphertext, aad)
 	if err != nil {
 		return nil, fmt.Errorf("mls.state: content decryption failure %v", err)
@@ -865,8 +2042,8 @@ func (s *State) decrypt(ct *MLSCiphertext) (*MLSPlaintext, error) {
 	_, _ = syntax.Unmarshal(content, &mlsContent)
 
 	pt := &MLSPlaintext{
-		GroupID:           s.GroupID,
-		Epoch:             s.Epoch,
+		GroupID:           ct.GroupID,
+		Epoch:             ct.Epoch,
 		Sender:            Sender{SenderTypeMember, uint32(sender)},
 		AuthenticatedData: ct.AuthenticatedData,
 		Content:           mlsContent,
@@ -876,6 +2053,10 @@ func (s *State) decrypt(ct *MLSCiphertext) (*MLSPlaintext, error) {
 }
 
 func (s *State) Protect(data []byte) (*MLSCiphertext, error) {
+	if s.PendingReInit != nil {
+		return nil, errGroupFrozen
+	}
+
 	pt := &MLSPlaintext{
 		GroupID: s.GroupID,
 		Epoch:   s.Epoch,
@@ -887,25 +2068,47 @@ func (s *State) Protect(data []byte) (*MLSCiphertext, error) {
 		},
 	}
 
-	err := pt.sign(s.groupContext(), s.IdentityPriv, s.Scheme)
+	err := pt.sign(s.groupContext(), s.IdentityPriv, s.Scheme, s.random())
 	if err != nil {
 		return nil, err
 	}
 	return s.encrypt(pt)
 }
 
+// Encrypt a proposal or commit produced by this member in the current epoch
+func (s *State) ProtectHandshake(pt *MLSPlaintext) (*MLSCiphertext, error) {
+	contentType := pt.Content.Type()
+	if contentType != ContentTypeProposal && contentType != ContentTypeCommit {
+		return nil, fmt.Errorf("mls.state: ProtectHandshake on non-handshake message")
+	}
+
+	if !bytes.Equal(pt.GroupID, s.GroupID) || pt.Epoch != s.Epoch {
+		return nil, fmt.Errorf("mls.state: handshake message not from this group and epoch")
+	}
+
+	if pt.Sender != (Sender{SenderTypeMember, uint32(s.Index)}) {
+		return nil, fmt.Errorf("mls.state: handshake message not sent by this member")
+	}
+
+	return s.encrypt(pt)
+}
+
 func (s *State) Unprotect(ct *MLSCiphertext) ([]byte, error) {
+	if bytes.Equal(ct.GroupID, s.GroupID) && ct.Epoch < s.Epoch {
+		return s.unprotectPast(ct)
+	}
+
 	pt, err := s.decrypt(ct)
 	if err != nil {
 		return nil, err
 	}
 
-	sigPubKey, err := s.signerPublicKey(pt.Sender)
+	sigPubKey, scheme, err := s.signerPublicKey(pt)
 	if err != nil {
 		return nil, err
 	}
 
-	if !pt.verify(s.groupContext(), sigPubKey, s.Scheme) {
+	if !pt.verify(s.groupContext(), sigPubKey, scheme) {
 		return nil, fmt.Errorf("invalid message signature")
 	}
 
@@ -915,6 +2118,282 @@ func (s *State) Unprotect(ct *MLSCiphertext) ([]byte, error) {
 	return pt.Content.Application.Data, nil
 }
 
+// Decrypt an application message from an earlier epoch, using retained keys
+func (s *State) unprotectPast(ct *MLSCiphertext) ([]byte, error) {
+	s.prunePastEpochs()
+
+	var past *pastEpoch
+	for _, pe := range s.pastEpochs {
+		if pe.Epoch == ct.Epoch {
+			past = pe
+		}
+	}
+
+	if past == nil {
+		return nil, fmt.Errorf("mls.state: ciphertext not from a retained epoch")
+	}
+
+	if ContentType(ct.ContentType) != ContentTypeApplication {
+		return nil, fmt.Errorf("unprotect attempted on non-application message")
+	}
+
+	pt, err := decryptWithKeys(s.CipherSuite, ct, past.SenderDataKey, past.ApplicationKeys, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	kp, ok := past.Tree.KeyPackage(LeafIndex(pt.Sender.Sender))
+	if !ok {
+		return nil, fmt.Errorf("mls.state: Received from blank leaf")
+	}
+
+	if !pt.verify(past.GroupContext, kp.Credential.PublicKey(), kp.Credential.Scheme()) {
+		return nil, fmt.Errorf("invalid message signature")
+	}
+
+	if pt.Content.Type() != ContentTypeApplication {
+		return nil, fmt.Errorf("unprotect attempted on non-application message")
+	}
+	return pt.Content.Application.Data, nil
+}
+
+// Limit how far the key ratchets for this epoch and subsequent epochs will
+// skip forward, how many keys they cache, and how far behind the newest
+// generation a message can be and still be decrypted.  A zero MaxCachedKeys or
+// ReplayWindow is replaced with the value from DefaultRatchetLimits.
+func (s *State) SetRatchetLimits(limits RatchetLimits) {
+	if limits.MaxCachedKeys == 0 {
+		limits.MaxCachedKeys = DefaultRatchetLimits.MaxCachedKeys
+	}
+
+	if limits.ReplayWindow == 0 {
+		limits.ReplayWindow = DefaultRatchetLimits.ReplayWindow
+	}
+
+	s.Keys.setLimits(limits)
+}
+
+// When enabled, the GroupInfo in Welcome messages carries only the tree hash,
+// and new members must obtain the ratchet tree separately and join with
+// NewJoinedStateWithTree.  This keeps Welcome messages small in large groups.
+func (s *State) SetExternalTreeDelivery(enabled bool) {
+	s.setTreeDelivery(treeExternal, enabled)
+}
+
+// When enabled, the GroupInfo in Welcome messages carries the ratchet tree in
+// a RatchetTreeExtension instead of inline, and new members read it from there.
+// This replaces external tree delivery, and vice versa.
+func (s *State) SetRatchetTreeExtension(enabled bool) {
+	s.setTreeDelivery(treeInExtension, enabled)
+}
+
+func (s *State) setTreeDelivery(mode treeDelivery, enabled bool) {
+	switch {
+	case enabled:
+		s.treeDelivery = mode
+	case s.treeDelivery == mode:
+		s.treeDelivery = treeInline
+	}
+}
+
+// Spread the HPKE encryptions in commits created by this state and its
+// successors over at most the specified number of goroutines.  Values less
+// than two encrypt serially.
+func (s *State) SetEncryptionWorkers(workers int) {
+	s.encryptionWorkers = workers
+}
+
+// Check every new or changed credential in this state and its successors with
+// the specified AuthenticationService.  A credential it rejects causes the
+// proposal, commit, or join presenting it to fail with a
+// CredentialRejectedError.
+func (s *State) SetAuthenticationService(auth AuthenticationService) {
+	s.auth = auth
+}
+
+// Attach the crypto.Signer that holds this state's identity key.  A key
+// backed by a Signer is not serialized by Marshal, so a restored state cannot
+// sign until its Signer is attached again.
+func (s *State) SetIdentitySigner(signer crypto.Signer) error {
+	priv, err := s.Scheme.FromSigner(signer)
+	if err != nil {
+		return fmt.Errorf("mls.state: %v", err)
+	}
+
+	if !priv.PublicKey.Equals(s.IdentityPriv.PublicKey) {
+		return fmt.Errorf("mls.state: Signer does not match the identity key")
+	}
+
+	s.IdentityPriv = priv
+	return nil
+}
+
+// Draw all of the randomness used by this state and its successors from the
+// specified source, instead of crypto/rand.Reader.  This is mainly useful for
+// producing reproducible transcripts in tests; the source must be
+// cryptographically secure otherwise.  A nil source restores the default.
+func (s *State) SetRandomSource(r io.Reader) {
+	s.randomSource = r
+}
+
+func (s State) random() io.Reader {
+	if s.randomSource == nil {
+		return rand.Reader
+	}
+	return s.randomSource
+}
+
+// Verify a KeyPackage presented for the specified leaf.  Its credential may
+// use any signature scheme the group allows.
+func (s State) verifyKeyPackage(index LeafIndex, kp KeyPackage) error {
+	schemes, err := allowedSignatureSchemes(s.CipherSuite, s.Extensions)
+	if err != nil {
+		return err
+	}
+
+	if !containsScheme(schemes, kp.Credential.Scheme()) {
+		return SignatureSchemeNotAllowedError{index, kp.Credential.Scheme()}
+	}
+
+	if !kp.verify(s.lifetimeConfig(), schemes) {
+		return fmt.Errorf("mls.state: Invalid kp")
+	}
+
+	return nil
+}
+
+func (s State) authenticate(index LeafIndex, cred Credential) error {
+	schemes, err := allowedSignatureSchemes(s.CipherSuite, s.Extensions)
+	if err != nil {
+		return err
+	}
+
+	if !containsScheme(schemes, cred.Scheme()) {
+		return SignatureSchemeNotAllowedError{index, cred.Scheme()}
+	}
+
+	if s.auth == nil {
+		return nil
+	}
+
+	if err := s.auth.Authenticate(cred); err != nil {
+		return CredentialRejectedError{index, err}
+	}
+
+	return nil
+}
+
+// A committer's leaf may present a new credential
+func (s *State) authenticatePathLeaf(index LeafIndex, kp KeyPackage) error {
+	currKP, ok := s.Tree.KeyPackage(index)
+	if ok && kp.Credential.Equals(currKP.Credential) {
+		return nil
+	}
+
+	if err := s.authenticate(index, kp.Credential); err != nil {
+		return err
+	}
+
+	s.NewCredentials[index] = true
+	return nil
+}
+
+// On joining, every member's credential is new
+func (s State) authenticateTree() error {
+	for i := LeafIndex(0); i < LeafIndex(s.Tree.Size()); i++ {
+		kp, ok := s.Tree.KeyPackage(i)
+		if !ok {
+			continue
+		}
+
+		if err := s.authenticate(i, kp.Credential); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Use the specified clock and KeyPackage lifetime settings for this state and
+// its successors
+func (s *State) SetLifetimeConfig(cfg LifetimeConfig) {
+	s.lifetime = &cfg
+}
+
+func (s State) lifetimeConfig() LifetimeConfig {
+	if s.lifetime == nil {
+		return DefaultLifetimeConfig
+	}
+	return *s.lifetime
+}
+
+func verifyLeafLifetimes(tree TreeKEMPublicKey, cfg LifetimeConfig) error {
+	for i := LeafIndex(0); i < LeafIndex(tree.Size()); i++ {
+		kp, ok := tree.KeyPackage(i)
+		if !ok {
+			continue
+		}
+
+		if err := kp.VerifyLifetime(cfg); err != nil {
+			return fmt.Errorf("mls.state: Invalid kp at leaf %d: %v", i, err)
+		}
+	}
+
+	return nil
+}
+
+// Retain application keys for up to the specified number of past epochs, each
+// for at most the specified lifetime after the epoch ends.  A lifetime of zero
+// means that retained keys do not expire.  Keys that are no longer retained
+// are erased.  Expiry is checked lazily, so expired keys are only erased on
+// the next call to Unprotect or SetPastEpochRetention, or when an epoch ends.
+func (s *State) SetPastEpochRetention(epochs int, lifetime time.Duration) {
+	s.pastEpochLimit = epochs
+	s.pastEpochLifetime = lifetime
+	s.prunePastEpochs()
+}
+
+// Retain the application keys of prev, which is the epoch before this one.  The
+// keys are copied, so that erasing them does not affect prev.
+func (s *State) retainPastEpoch(prev State) {
+	if s.pastEpochLimit == 0 {
+		return
+	}
+
+	past := &pastEpoch{
+		Epoch:           prev.Epoch,
+		SenderDataKey:   dup(prev.Keys.SenderDataKey),
+		ApplicationKeys: prev.Keys.ApplicationKeys.clone(),
+		Tree:            prev.Tree,
+		GroupContext:    prev.groupContext(),
+	}
+
+	if s.pastEpochLifetime > 0 {
+		past.Expiry = s.lifetimeConfig().now().Add(s.pastEpochLifetime)
+	}
+
+	s.pastEpochs = append(s.pastEpochs, past)
+	s.prunePastEpochs()
+}
+
+// Erase the keys for epochs that are too old or have expired
+func (s *State) prunePastEpochs() {
+	now := s.lifetimeConfig().now()
+	kept := []*pastEpoch{}
+	for i, past := range s.pastEpochs {
+		tooOld := len(s.pastEpochs)-i > s.pastEpochLimit
+		expired := !past.Expiry.IsZero() && now.After(past.Expiry)
+		if tooOld || expired {
+			past.zeroize()
+			continue
+		}
+
+		kept = append(kept, past)
+	}
+
+	s.pastEpochs = kept
+}
+
 func senderDataAAD(gid []byte, epoch Epoch, contentType ContentType, nonce []byte) []byte {
 	s := syntax.NewWriteStream()
 	err := s.Write(struct {
@@ -971,8 +2450,9 @@ func (s State) Clone() *State {
 		GroupID:                 dup(s.GroupID),
 		Epoch:                   s.Epoch,
 		Tree:                    s.Tree.Clone(),
-		ConfirmedTranscriptHash: nil,
+		ConfirmedTranscriptHash: dup(s.ConfirmedTranscriptHash),
 		InterimTranscriptHash:   dup(s.InterimTranscriptHash),
+		Extensions:              s.Extensions,
 		Keys:                    s.Keys,
 		Index:                   s.Index,
 		IdentityPriv:            s.IdentityPriv,
@@ -981,9 +2461,33 @@ func (s State) Clone() *State {
 		PendingUpdates:          s.PendingUpdates,
 		PendingProposals:        make([]MLSPlaintext, len(s.PendingProposals)),
 		NewCredentials:          map[LeafIndex]bool{},
+		ExternalPSKs:            map[string][]byte{},
+		ResumptionPSKs:          map[resumptionPSKKey][]byte{},
+		PendingReInit:           s.PendingReInit,
+		pastEpochs:              make([]*pastEpoch, len(s.pastEpochs)),
+		pastEpochLimit:          s.pastEpochLimit,
+		pastEpochLifetime:       s.pastEpochLifetime,
+		lifetime:                s.lifetime,
+		treeDelivery:            s.treeDelivery,
+		encryptionWorkers:       s.encryptionWorkers,
+		auth:                    s.auth,
+		randomSource:            s.randomSource,
+	}
+
+	for i, past := range s.pastEpochs {
+		clone.pastEpochs[i] = past.clone()
 	}
 
 	copy(clone.PendingProposals, s.PendingProposals)
+
+	for id, psk := range s.ExternalPSKs {
+		clone.ExternalPSKs[id] = dup(psk)
+	}
+
+	for key, psk := range s.ResumptionPSKs {
+		clone.ResumptionPSKs[key] = dup(psk)
+	}
+
 	return clone
 }
 
@@ -1021,21 +2525,28 @@ type StateSecrets struct {
 	TreePriv       TreeKEMPrivateKey
 }
 
-func NewStateFromWelcomeAndSecrets(welcome Welcome, ss StateSecrets) (*State, error) {
-	// Import the base data using some information from the secrets
-	suite := ss.CipherSuite
-	epochSecret := ss.Keys.EpochSecret
-	s, _, confirmation, err := NewStateFromWelcome(suite, epochSecret, welcome)
-	if err != nil {
-		return nil, err
+// Restore a state from the secrets saved with GetSecrets and a GroupInfo for
+// the same epoch, e.g., one produced by ExternalGroupInfo.  The Welcome for the
+// epoch cannot be used, since its key is not kept once the Welcome is built.
+func NewStateFromGroupInfoAndSecrets(gi GroupInfo, ss StateSecrets) (*State, error) {
+	gi.Tree = gi.Tree.Clone()
+	if err := gi.verify(); err != nil {
+		return nil, fmt.Errorf("mls.state: invalid groupInfo %v", err)
 	}
 
-	// Import the secrets
+	// Import the base data, then the secrets
+	s := newStateFromGroupInfo(ss.CipherSuite, gi)
 	s.SetSecrets(ss)
+	s.saveResumptionPSK()
 
-	// Verify the confirmation
-	if !s.verifyConfirmation(confirmation) {
-		return nil, fmt.Errorf("mls.state: Confirmation failed to verify")
+	// Verify that the secrets belong to this epoch of this group
+	ctx, err := syntax.Marshal(s.groupContext())
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: groupCtx marshal failure %v", err)
+	}
+
+	if !bytes.Equal(ctx, s.Keys.GroupContext) || !s.TreePriv.ConsistentPub(s.Tree) {
+		return nil, fmt.Errorf("mls.state: Secrets do not match the GroupInfo")
 	}
 
 	return s, nil
@@ -1075,3 +2586,277 @@ func (s State) GetSecrets() StateSecrets {
 		TreePriv:         s.TreePriv,
 	}
 }
+
+///// Serialization
+
+// The version of the format produced by State.Marshal.  This must change
+// whenever the format changes, so that stale state is rejected rather than
+// misread.
+const stateFormatVersion uint8 = 1
+
+type serializedPSK struct {
+	ID     []byte `tls:"head=1"`
+	Secret []byte `tls:"head=1"`
+}
+
+type serializedResumptionPSK struct {
+	GroupID []byte `tls:"head=1"`
+	Epoch   Epoch
+	Secret  []byte `tls:"head=1"`
+}
+
+type serializedCommit struct {
+	Hash []byte `tls:"head=1"`
+	Next []byte `tls:"head=4"`
+}
+
+type serializedPastEpoch struct {
+	Epoch               Epoch
+	Expiry              uint64 // Unix nanoseconds, zero if none
+	SenderDataKey       []byte `tls:"head=1"`
+	ApplicationBaseKeys *treeBaseKeySource
+	ApplicationRatchets map[LeafIndex]*hashRatchet `tls:"head=4"`
+	Limits              RatchetLimits
+	Tree                TreeKEMPublicKey
+	GroupContext        GroupContext
+}
+
+type serializedState struct {
+	// Shared confirmed state
+	CipherSuite             CipherSuite
+	GroupID                 []byte `tls:"head=1"`
+	Epoch                   Epoch
+	Tree                    TreeKEMPublicKey
+	ConfirmedTranscriptHash []byte `tls:"head=1"`
+	InterimTranscriptHash   []byte `tls:"head=1"`
+	Extensions              ExtensionList
+
+	// Per-participant state
+	Index            LeafIndex
+	IdentityPriv     SignaturePrivateKey
+	TreePriv         TreeKEMPrivateKey
+	Scheme           SignatureScheme
+	PendingProposals []MLSPlaintext                `tls:"head=4"`
+	PendingUpdates   map[ProposalRef]updateSecrets `tls:"head=4"`
+	Keys             keyScheduleEpoch
+	ExternalPSKs     []serializedPSK           `tls:"head=4"`
+	ResumptionPSKs   []serializedResumptionPSK `tls:"head=4"`
+	PendingReInit    *ReInitProposal           `tls:"optional"`
+	NewCredentials   []LeafIndex               `tls:"head=4"`
+	PendingCommit    *serializedCommit         `tls:"optional"`
+
+	// Retained past epochs
+	PastEpochs        []serializedPastEpoch `tls:"head=4"`
+	PastEpochLimit    uint32
+	PastEpochLifetime uint64
+
+	TreeDelivery treeDelivery
+}
+
+// Serialize the complete state of this member, including all of its secrets,
+// so that it can be restored with UnmarshalState.  The result must be stored
+// as securely as the member's private keys.  Lifetime settings are not
+// serialized, since they include a Clock; they must be set again after
+// unmarshaling.
+func (s State) Marshal() ([]byte, error) {
+	ss := serializedState{
+		CipherSuite:             s.CipherSuite,
+		GroupID:                 s.GroupID,
+		Epoch:                   s.Epoch,
+		Tree:                    s.Tree,
+		ConfirmedTranscriptHash: s.ConfirmedTranscriptHash,
+		InterimTranscriptHash:   s.InterimTranscriptHash,
+		Extensions:              s.Extensions,
+		Index:                   s.Index,
+		IdentityPriv:            s.IdentityPriv,
+		TreePriv:                s.TreePriv,
+		Scheme:                  s.Scheme,
+		PendingProposals:        s.PendingProposals,
+		PendingUpdates:          s.PendingUpdates,
+		Keys:                    s.Keys,
+		ExternalPSKs:            []serializedPSK{},
+		ResumptionPSKs:          []serializedResumptionPSK{},
+		PendingReInit:           s.PendingReInit,
+		NewCredentials:          []LeafIndex{},
+		PastEpochs:              []serializedPastEpoch{},
+		PastEpochLimit:          uint32(s.pastEpochLimit),
+		PastEpochLifetime:       uint64(s.pastEpochLifetime),
+		TreeDelivery:            s.treeDelivery,
+	}
+
+	if ss.PendingProposals == nil {
+		ss.PendingProposals = []MLSPlaintext{}
+	}
+
+	if ss.PendingUpdates == nil {
+		ss.PendingUpdates = map[ProposalRef]updateSecrets{}
+	}
+
+	// Map iteration order is random, so sort to make the output deterministic
+	for id, psk := range s.ExternalPSKs {
+		ss.ExternalPSKs = append(ss.ExternalPSKs, serializedPSK{[]byte(id), psk})
+	}
+	sort.Slice(ss.ExternalPSKs, func(i, j int) bool {
+		return bytes.Compare(ss.ExternalPSKs[i].ID, ss.ExternalPSKs[j].ID) < 0
+	})
+
+	for key, psk := range s.ResumptionPSKs {
+		ss.ResumptionPSKs = append(ss.ResumptionPSKs, serializedResumptionPSK{[]byte(key.GroupID), key.Epoch, psk})
+	}
+	sort.Slice(ss.ResumptionPSKs, func(i, j int) bool {
+		a, b := ss.ResumptionPSKs[i], ss.ResumptionPSKs[j]
+		if cmp := bytes.Compare(a.GroupID, b.GroupID); cmp != 0 {
+			return cmp < 0
+		}
+		return a.Epoch < b.Epoch
+	})
+
+	for index, isNew := range s.NewCredentials {
+		if isNew {
+			ss.NewCredentials = append(ss.NewCredentials, index)
+		}
+	}
+	sort.Slice(ss.NewCredentials, func(i, j int) bool {
+		return ss.NewCredentials[i] < ss.NewCredentials[j]
+	})
+
+	if s.pendingCommit != nil {
+		next, err := s.pendingCommit.Next.Marshal()
+		if err != nil {
+			return nil, err
+		}
+
+		ss.PendingCommit = &serializedCommit{s.pendingCommit.Hash, next}
+	}
+
+	for _, past := range s.pastEpochs {
+		base, ok := past.ApplicationKeys.Base.(*treeBaseKeySource)
+		if !ok {
+			return nil, fmt.Errorf("mls.state: Unexpected key source for past epoch")
+		}
+
+		expiry := uint64(0)
+		if !past.Expiry.IsZero() {
+			expiry = uint64(past.Expiry.UnixNano())
+		}
+
+		ss.PastEpochs = append(ss.PastEpochs, serializedPastEpoch{
+			Epoch:               past.Epoch,
+			Expiry:              expiry,
+			SenderDataKey:       past.SenderDataKey,
+			ApplicationBaseKeys: base,
+			ApplicationRatchets: past.ApplicationKeys.Ratchets,
+			Limits:              past.ApplicationKeys.Limits,
+			Tree:                past.Tree,
+			GroupContext:        past.GroupContext,
+		})
+	}
+
+	stream := syntax.NewWriteStream()
+	err := stream.WriteAll(stateFormatVersion, ss)
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: Marshal failed %v", err)
+	}
+
+	return stream.Data(), nil
+}
+
+// Restore a state serialized with State.Marshal
+func UnmarshalState(data []byte) (*State, error) {
+	stream := syntax.NewReadStream(data)
+
+	var version uint8
+	_, err := stream.Read(&version)
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: Unmarshal failed %v", err)
+	}
+
+	if version != stateFormatVersion {
+		return nil, fmt.Errorf("mls.state: Unsupported state format version %d", version)
+	}
+
+	var ss serializedState
+	_, err = stream.Read(&ss)
+	if err != nil {
+		return nil, fmt.Errorf("mls.state: Unmarshal failed %v", err)
+	}
+
+	if stream.Position() != len(data) {
+		return nil, fmt.Errorf("mls.state: Unmarshal failed to consume all data")
+	}
+
+	s := &State{
+		CipherSuite:             ss.CipherSuite,
+		GroupID:                 ss.GroupID,
+		Epoch:                   ss.Epoch,
+		Tree:                    ss.Tree,
+		ConfirmedTranscriptHash: ss.ConfirmedTranscriptHash,
+		InterimTranscriptHash:   ss.InterimTranscriptHash,
+		Extensions:              ss.Extensions,
+		Index:                   ss.Index,
+		IdentityPriv:            ss.IdentityPriv,
+		TreePriv:                ss.TreePriv,
+		Scheme:                  ss.Scheme,
+		PendingProposals:        ss.PendingProposals,
+		PendingUpdates:          ss.PendingUpdates,
+		Keys:                    ss.Keys,
+		ExternalPSKs:            map[string][]byte{},
+		ResumptionPSKs:          map[resumptionPSKKey][]byte{},
+		PendingReInit:           ss.PendingReInit,
+		NewCredentials:          map[LeafIndex]bool{},
+		pastEpochs:              []*pastEpoch{},
+		pastEpochLimit:          int(ss.PastEpochLimit),
+		pastEpochLifetime:       time.Duration(ss.PastEpochLifetime),
+		treeDelivery:            ss.TreeDelivery,
+	}
+
+	s.Tree.Suite = s.CipherSuite
+	s.Tree.SetHashAll()
+	s.TreePriv.privateKeyCache = map[NodeIndex]HPKEPrivateKey{}
+	s.Keys.enableKeySources()
+
+	for _, psk := range ss.ExternalPSKs {
+		s.ExternalPSKs[string(psk.ID)] = psk.Secret
+	}
+
+	for _, psk := range ss.ResumptionPSKs {
+		s.ResumptionPSKs[resumptionPSKKey{string(psk.GroupID), psk.Epoch}] = psk.Secret
+	}
+
+	for _, index := range ss.NewCredentials {
+		s.NewCredentials[index] = true
+	}
+
+	if ss.PendingCommit != nil {
+		next, err := UnmarshalState(ss.PendingCommit.Next)
+		if err != nil {
+			return nil, err
+		}
+
+		s.pendingCommit = &cachedCommit{ss.PendingCommit.Hash, next}
+	}
+
+	for _, sp := range ss.PastEpochs {
+		past := &pastEpoch{
+			Epoch:         sp.Epoch,
+			SenderDataKey: sp.SenderDataKey,
+			ApplicationKeys: &groupKeySource{
+				Base:     sp.ApplicationBaseKeys,
+				Ratchets: sp.ApplicationRatchets,
+				Limits:   sp.Limits,
+			},
+			Tree:         sp.Tree,
+			GroupContext: sp.GroupContext,
+		}
+
+		if sp.Expiry != 0 {
+			past.Expiry = time.Unix(0, int64(sp.Expiry))
+		}
+
+		past.Tree.Suite = s.CipherSuite
+		past.Tree.SetHashAll()
+		s.pastEpochs = append(s.pastEpochs, past)
+	}
+
+	return s, nil
+}
@@ -1,7 +1,13 @@
 package mls
 
 import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/cisco/go-tls-syntax"
 	"github.com/stretchr/testify/require"
@@ -52,10 +58,14 @@ func setup(t *testing.T) StateTest {
 }
 
 func setupGroup(t *testing.T) StateTest {
+	return setupGroupWithExtensions(t, NewExtensionList())
+}
+
+func setupGroupWithExtensions(t *testing.T, ext ExtensionList) StateTest {
 	stateTest := setup(t)
 	var states []State
 	// start with the group creator
-	s0, err := NewEmptyState(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0])
+	s0, err := NewEmptyStateWithExtensions(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0], ext)
 	require.Nil(t, err)
 	states = append(states, *s0)
 
@@ -124,6 +134,61 @@ func TestStateTwoPerson(t *testing.T) {
 	require.Equal(t, pt, testMessage)
 }
 
+func TestStateCipherSuites(t *testing.T) {
+	suites := []CipherSuite{
+		X448_AES256GCM_SHA512_Ed448,
+		X448_CHACHA20POLY1305_SHA512_Ed448,
+		P384_AES256GCM_SHA384_P384,
+		X25519Kyber768_AES128GCM_SHA256_Ed25519,
+	}
+
+	for _, cs := range suites {
+		t.Run(cs.String(), func(t *testing.T) {
+			secrets := [][]byte{randomBytes(32), randomBytes(32)}
+			sigPrivs := make([]SignaturePrivateKey, 2)
+			kps := make([]KeyPackage, 2)
+			for i := range secrets {
+				sigPriv, err := cs.Scheme().Derive(secrets[i])
+				require.Nil(t, err)
+
+				cred := NewBasicCredential(userID, cs.Scheme(), sigPriv.PublicKey)
+				kp, err := NewKeyPackageWithSecret(cs, secrets[i], cred, sigPriv)
+				require.Nil(t, err)
+
+				sigPrivs[i], kps[i] = sigPriv, *kp
+			}
+
+			first0, err := NewEmptyState(groupID, secrets[0], sigPrivs[0], kps[0])
+			require.Nil(t, err)
+
+			add, err := first0.Add(kps[1])
+			require.Nil(t, err)
+			_, err = first0.Handle(add)
+			require.Nil(t, err)
+
+			_, welcome, first1, err := first0.Commit(randomBytes(32))
+			require.Nil(t, err)
+
+			second1, err := NewJoinedState(secrets[1], sigPrivs[1:], kps[1:], *welcome)
+			require.Nil(t, err)
+			require.True(t, first1.Equals(*second1))
+
+			// A commit with a path exercises the suite's HPKE
+			commit, _, second2, err := second1.Commit(randomBytes(32))
+			require.Nil(t, err)
+			first2, err := first1.Handle(commit)
+			require.Nil(t, err)
+			require.True(t, first2.Equals(*second2))
+
+			ct, err := first2.Protect(testMessage)
+			require.Nil(t, err)
+			pt, err := second2.Unprotect(ct)
+			require.Nil(t, err)
+			require.Equal(t, pt, testMessage)
+		})
+	}
+}
+
 const ExtensionTypeGroupTest ExtensionType = 0xFFFF
 
 type GroupTestExtension struct{}
@@ -168,6 +233,33 @@ func TestStateExtensions(t *testing.T) {
 	_, err = alice0.Add(kpB)
 	require.Nil(t, err)
 
+	// Check that the group extensions implemented by the library need not be
+	// advertised, but are otherwise checked in the same places
+	kpC := stateTest.keyPackages[2]
+	libraryExtensions := []ExtensionBody{
+		ExternalSendersExtension{Senders: []ExternalSender{}},
+		WireFormatPolicyExtension{HandshakePolicy: WireFormatPolicyEncryptHandshake},
+		SignatureSchemesExtension{SignatureSchemes: []SignatureScheme{suite.Scheme()}},
+	}
+	for _, body := range libraryExtensions {
+		require.Contains(t, supportedGroupExtensions, body.Type())
+
+		ext := NewExtensionList()
+		err = ext.Add(body)
+		require.Nil(t, err)
+		require.Nil(t, checkExtensionSupport(stateTest.keyPackages[0], ext))
+
+		state, err := NewEmptyStateWithExtensions(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0], ext)
+		require.Nil(t, err)
+
+		_, err = state.Add(kpC)
+		require.Nil(t, err)
+
+		err = ext.Add(GroupTestExtension{})
+		require.Nil(t, err)
+		require.Error(t, checkExtensionSupport(kpC, ext))
+	}
+
 	// TODO(RLB) Test extension verification in NewJoinedState
 }
 
@@ -186,9 +278,11 @@ func TestStateMarshalUnmarshal(t *testing.T) {
 	_, welcome1, alice1, err := alice0.Commit(secret)
 	require.Nil(t, err)
 
-	// Marshal Alice's secret state
+	// Marshal Alice's secret state, and publish a GroupInfo for the epoch
 	alice1priv, err := syntax.Marshal(alice1.GetSecrets())
 	require.Nil(t, err)
+	gi1, err := alice1.ExternalGroupInfo()
+	require.Nil(t, err)
 
 	// Initialize Bob generate an Update+Commit
 	bob1, err := NewJoinedState(stateTest.initSecrets[1], stateTest.identityPrivs[1:2], stateTest.keyPackages[1:2], *welcome1)
@@ -206,14 +300,20 @@ func TestStateMarshalUnmarshal(t *testing.T) {
 	commit, _, bob2, err := bob1.Commit(secret)
 	require.Nil(t, err)
 
-	// Recreate Alice from Welcome and secrets
+	// Recreate Alice from the GroupInfo and secrets
 	alice1aPriv := StateSecrets{}
 	_, err = syntax.Unmarshal(alice1priv, &alice1aPriv)
 	require.Nil(t, err)
 
-	alice1a, err := NewStateFromWelcomeAndSecrets(*welcome1, alice1aPriv)
+	alice1a, err := NewStateFromGroupInfoAndSecrets(*gi1, alice1aPriv)
 	require.Nil(t, err)
 
+	// ... but only if they are for the same epoch
+	gi0, err := alice0.ExternalGroupInfo()
+	require.Nil(t, err)
+	_, err = NewStateFromGroupInfoAndSecrets(*gi0, alice1aPriv)
+	require.Error(t, err)
+
 	require.True(t, alice1a.TreePriv.ConsistentPub(alice1.Tree))
 	require.True(t, alice1.TreePriv.ConsistentPub(alice1a.Tree))
 
@@ -348,3 +448,1394 @@ func TestStateRemove(t *testing.T) {
 		}
 	}
 }
+
+func TestStateCachedCommit(t *testing.T) {
+	stateTest := setupGroup(t)
+
+	// Alice commits and gets her own commit back from the server
+	commitA, _, nextA, err := stateTest.states[0].Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	handledA, err := stateTest.states[0].Handle(commitA)
+	require.Nil(t, err)
+	require.True(t, handledA == nextA)
+	require.Nil(t, stateTest.states[0].pendingCommit)
+
+	// A second delivery of the same commit is not accepted
+	_, err = stateTest.states[0].Handle(commitA)
+	require.Error(t, err)
+
+	for i := 1; i < groupSize; i++ {
+		next, err := stateTest.states[i].Handle(commitA)
+		require.Nil(t, err)
+		stateTest.states[i] = *next
+	}
+	stateTest.states[0] = *handledA
+
+	for _, s := range stateTest.states {
+		require.True(t, stateTest.states[0].Equals(s))
+	}
+
+	// Alice and Bob both commit, and Bob's commit wins the epoch
+	commitA, _, _, err = stateTest.states[0].Commit(randomBytes(32))
+	require.Nil(t, err)
+	commitB, _, nextB, err := stateTest.states[1].Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	handledB, err := stateTest.states[0].Handle(commitB)
+	require.Nil(t, err)
+	require.Nil(t, stateTest.states[0].pendingCommit)
+	require.True(t, handledB.Equals(*nextB))
+
+	// Alice's losing commit is rejected when it comes back
+	_, err = stateTest.states[0].Handle(commitA)
+	require.Error(t, err)
+}
+
+func TestStatePreSharedKey(t *testing.T) {
+	stateTest := setupGroup(t)
+	pskID := []byte("external psk")
+	psk := randomBytes(32)
+
+	commitPSK := func(pskID PreSharedKeyID, missing int) {
+		proposal, err := stateTest.states[0].PreSharedKey(pskID)
+		require.Nil(t, err)
+		_, err = stateTest.states[0].Handle(proposal)
+		require.Nil(t, err)
+
+		commit, _, next, err := stateTest.states[0].Commit(randomBytes(32))
+		require.Nil(t, err)
+		require.Equal(t, len(commit.Content.Commit.Commit.PreSharedKeys), 1)
+
+		for i := 1; i < len(stateTest.states); i++ {
+			_, err := stateTest.states[i].Handle(proposal)
+			require.Nil(t, err)
+
+			newState, err := stateTest.states[i].Handle(commit)
+			if i == missing {
+				require.Error(t, err)
+				continue
+			}
+
+			require.Nil(t, err)
+			stateTest.states[i] = *newState
+			require.True(t, next.Equals(stateTest.states[i]))
+		}
+
+		stateTest.states[0] = *next
+	}
+
+	// Everyone but the last member knows the external PSK
+	for i := 0; i < groupSize-1; i++ {
+		stateTest.states[i].SetExternalPSK(pskID, psk)
+	}
+
+	_, err := stateTest.states[groupSize-1].PreSharedKey(NewExternalPSKID(pskID))
+	require.Error(t, err)
+
+	commitPSK(NewExternalPSKID(pskID), groupSize-1)
+	stateTest.states = stateTest.states[:groupSize-1]
+
+	// Resume from the previous epoch of this group
+	prevEpoch := stateTest.states[0].Epoch - 1
+	commitPSK(NewResumptionPSKID(groupID, prevEpoch), -1)
+}
+
+func TestStatePreSharedKeyJoin(t *testing.T) {
+	stateTest := setup(t)
+	pskID := []byte("external psk")
+	psk := randomBytes(32)
+
+	creator, err := NewEmptyState(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0])
+	require.Nil(t, err)
+	creator.SetExternalPSK(pskID, psk)
+
+	add, err := creator.Add(stateTest.keyPackages[1])
+	require.Nil(t, err)
+	_, err = creator.Handle(add)
+	require.Nil(t, err)
+
+	proposal, err := creator.PreSharedKey(NewExternalPSKID(pskID))
+	require.Nil(t, err)
+	_, err = creator.Handle(proposal)
+	require.Nil(t, err)
+
+	_, welcome, next, err := creator.Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	// The new member must hold the PSK to join
+	initSecrets := stateTest.initSecrets[1]
+	sigPrivs := stateTest.identityPrivs[1:2]
+	kps := stateTest.keyPackages[1:2]
+	_, err = NewJoinedState(initSecrets, sigPrivs, kps, *welcome)
+	require.Error(t, err)
+
+	wrongPSKs := ExternalPSKStore{string(pskID): randomBytes(32)}
+	_, err = NewJoinedStateWithPSKs(initSecrets, sigPrivs, kps, *welcome, wrongPSKs, DefaultLifetimeConfig)
+	require.Error(t, err)
+
+	psks := ExternalPSKStore{string(pskID): psk}
+	joined, err := NewJoinedStateWithPSKs(initSecrets, sigPrivs, kps, *welcome, psks, DefaultLifetimeConfig)
+	require.Nil(t, err)
+	require.True(t, next.Equals(*joined))
+}
+
+func TestStateReInit(t *testing.T) {
+	stateTest := setupGroup(t)
+	newGroupID := []byte{0x05, 0x06, 0x07, 0x08}
+	newSuite := X25519_AES128GCM_SHA256_Ed25519
+
+	// Have someone other than the committer propose the ReInit
+	reInit, err := stateTest.states[1].ReInit(newGroupID, ProtocolVersionMLS10, newSuite, NewExtensionList())
+	require.Nil(t, err)
+
+	for i := range stateTest.states {
+		_, err = stateTest.states[i].Handle(reInit)
+		require.Nil(t, err)
+	}
+
+	commit, _, next, err := stateTest.states[0].Commit(randomBytes(32))
+	require.Nil(t, err)
+	require.Equal(t, len(commit.Content.Commit.Commit.ReInits), 1)
+	require.Nil(t, commit.Content.Commit.Commit.Path)
+
+	for i := 1; i < groupSize; i++ {
+		newState, err := stateTest.states[i].Handle(commit)
+		require.Nil(t, err)
+		require.True(t, next.Equals(*newState))
+		stateTest.states[i] = *newState
+	}
+	stateTest.states[0] = *next
+
+	// The old group is frozen
+	for _, state := range stateTest.states {
+		require.NotNil(t, state.PendingReInit)
+
+		_, err = state.Protect(testMessage)
+		require.Error(t, err)
+
+		_, err = state.Remove(1)
+		require.Error(t, err)
+
+		_, _, _, err = state.Commit(randomBytes(32))
+		require.Error(t, err)
+	}
+
+	// Generate key packages for the new ciphersuite
+	initSecrets := make([][]byte, groupSize)
+	sigPrivs := make([]SignaturePrivateKey, groupSize)
+	kps := make([]KeyPackage, groupSize)
+	for i := range kps {
+		initSecrets[i] = randomBytes(32)
+		sigPrivs[i], err = newSuite.Scheme().Derive(initSecrets[i])
+		require.Nil(t, err)
+
+		cred := NewBasicCredential(userID, newSuite.Scheme(), sigPrivs[i].PublicKey)
+		kp, err := NewKeyPackageWithSecret(newSuite, initSecrets[i], cred, sigPrivs[i])
+		require.Nil(t, err)
+		kps[i] = *kp
+	}
+
+	// The new group has to have the same membership as the old
+	_, _, err = stateTest.states[0].NewStateFromReInit(initSecrets[0], sigPrivs[0], kps[0], kps[2:])
+	require.Error(t, err)
+
+	first, welcome, err := stateTest.states[0].NewStateFromReInit(initSecrets[0], sigPrivs[0], kps[0], kps[1:])
+	require.Nil(t, err)
+	require.Equal(t, first.GroupID, newGroupID)
+	require.Equal(t, first.CipherSuite, newSuite)
+
+	oldEpoch := stateTest.states[0].Epoch
+	for i := 1; i < groupSize; i++ {
+		joined, err := stateTest.states[i].JoinReInit(initSecrets[i], sigPrivs[i:i+1], kps[i:i+1], *welcome)
+		require.Nil(t, err)
+		require.True(t, first.Equals(*joined))
+
+		_, ok := joined.PSK(NewResumptionPSKID(groupID, oldEpoch))
+		require.True(t, ok)
+	}
+
+	// Joining a group that matches the ReInit but is not tied to the old group
+	// by its resumption secret fails
+	unbound, err := NewEmptyState(newGroupID, initSecrets[0], sigPrivs[0], kps[0])
+	require.Nil(t, err)
+	for _, kp := range kps[1:] {
+		add, err := unbound.Add(kp)
+		require.Nil(t, err)
+		_, err = unbound.Handle(add)
+		require.Nil(t, err)
+	}
+	_, unboundWelcome, _, err := unbound.Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	_, err = stateTest.states[1].JoinReInit(initSecrets[1], sigPrivs[1:2], kps[1:2], *unboundWelcome)
+	require.Error(t, err)
+
+	// Joining a group that does not match the ReInit fails
+	other, err := NewEmptyState(groupID, initSecrets[0], sigPrivs[0], kps[0])
+	require.Nil(t, err)
+	add, err := other.Add(kps[1])
+	require.Nil(t, err)
+	_, err = other.Handle(add)
+	require.Nil(t, err)
+	_, otherWelcome, _, err := other.Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	_, err = stateTest.states[1].JoinReInit(initSecrets[1], sigPrivs[1:2], kps[1:2], *otherWelcome)
+	require.Error(t, err)
+}
+
+func TestStateReInitExperimentalSuite(t *testing.T) {
+	newGroupID := []byte{0x05, 0x06, 0x07, 0x08}
+	hybrid := X25519Kyber768_AES128GCM_SHA256_Ed25519
+
+	// Members do not accept an experimental suite by default
+	stateTest := setupGroup(t)
+	_, err := stateTest.states[0].ReInit(newGroupID, ProtocolVersionMLS10, hybrid, NewExtensionList())
+	require.Error(t, err)
+
+	// ... but do once they all list it in their KeyPackages
+	stateTest = setup(t)
+	suites := SupportedCipherSuitesExtension{[]CipherSuite{suite, hybrid}}
+	for i := range stateTest.keyPackages[:2] {
+		kp := &stateTest.keyPackages[i]
+		require.Nil(t, kp.SetExtensions([]ExtensionBody{suites}))
+		require.Nil(t, kp.Sign(stateTest.identityPrivs[i]))
+	}
+
+	alice, err := NewEmptyState(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0])
+	require.Nil(t, err)
+	_, err = alice.ReInit(newGroupID, ProtocolVersionMLS10, hybrid, NewExtensionList())
+	require.Nil(t, err)
+
+	add, err := alice.Add(stateTest.keyPackages[1])
+	require.Nil(t, err)
+	_, err = alice.Handle(add)
+	require.Nil(t, err)
+	_, _, alice, err = alice.Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	_, err = alice.ReInit(newGroupID, ProtocolVersionMLS10, hybrid, NewExtensionList())
+	require.Nil(t, err)
+
+	// A member that has not opted in blocks the ReInit
+	add, err = alice.Add(stateTest.keyPackages[2])
+	require.Nil(t, err)
+	_, err = alice.Handle(add)
+	require.Nil(t, err)
+	_, _, withCarol, err := alice.Commit(randomBytes(32))
+	require.Nil(t, err)
+	_, err = withCarol.ReInit(newGroupID, ProtocolVersionMLS10, hybrid, NewExtensionList())
+	require.Error(t, err)
+}
+
+func TestStateReInitNotAlone(t *testing.T) {
+	stateTest := setupGroup(t)
+	newGroupID := []byte{0x05, 0x06, 0x07, 0x08}
+
+	// A ReInit pending alongside another proposal cannot be committed, and the
+	// other proposal is not discarded
+	reInit, err := stateTest.states[1].ReInit(newGroupID, ProtocolVersionMLS10, suite, NewExtensionList())
+	require.Nil(t, err)
+	remove, err := stateTest.states[1].Remove(2)
+	require.Nil(t, err)
+
+	committer := stateTest.states[0]
+	for _, pt := range []*MLSPlaintext{reInit, remove} {
+		_, err = committer.Handle(pt)
+		require.Nil(t, err)
+	}
+
+	_, _, _, err = committer.Commit(randomBytes(32))
+	require.Equal(t, err, errReInitNotAlone)
+	require.Equal(t, len(committer.PendingProposals), 2)
+	require.Nil(t, committer.PendingReInit)
+}
+
+func TestStateExternalCommit(t *testing.T) {
+	stateTest := setupGroup(t)
+
+	// A member publishes a GroupInfo
+	gi, err := stateTest.states[1].ExternalGroupInfo()
+	require.Nil(t, err)
+
+	giData, err := syntax.Marshal(gi)
+	require.Nil(t, err)
+
+	var published GroupInfo
+	_, err = syntax.Unmarshal(giData, &published)
+	require.Nil(t, err)
+
+	// A non-member joins using the published GroupInfo
+	secret := randomBytes(32)
+	sigPriv, err := suite.Scheme().Derive(secret)
+	require.Nil(t, err)
+
+	cred := NewBasicCredential(userID, suite.Scheme(), sigPriv.PublicKey)
+	kp, err := NewKeyPackageWithSecret(suite, secret, cred, sigPriv)
+	require.Nil(t, err)
+
+	noExternal := published
+	noExternal.ExternalPub = nil
+	_, _, err = NewStateFromExternalCommit(secret, sigPriv, *kp, noExternal)
+	require.Error(t, err)
+
+	// Leaf lifetimes are checked with the joiner's clock
+	late := DefaultLifetimeConfig
+	late.Clock = fixedClock(time.Now().Add(10 * 365 * 24 * time.Hour))
+	_, _, err = NewStateFromExternalCommitWithLifetime(secret, sigPriv, *kp, published, late)
+	require.Error(t, err)
+
+	commit, joiner, err := NewStateFromExternalCommit(secret, sigPriv, *kp, published)
+	require.Nil(t, err)
+	require.Equal(t, commit.Sender.Type, SenderTypeNewMember)
+	require.Equal(t, joiner.Index, LeafIndex(groupSize))
+
+	// The published GroupInfo is left as it was
+	for _, node := range published.Tree.Nodes {
+		require.Nil(t, node.Hash)
+	}
+
+	// The existing members process the commit
+	for i, state := range stateTest.states {
+		next, err := state.Handle(commit)
+		require.Nil(t, err)
+		require.True(t, next.Equals(*joiner))
+		require.True(t, next.NewCredentials[joiner.Index])
+		stateTest.states[i] = *next
+	}
+
+	// The new member can exchange messages with the group
+	ct, err := joiner.Protect(testMessage)
+	require.Nil(t, err)
+	pt, err := stateTest.states[0].Unprotect(ct)
+	require.Nil(t, err)
+	require.Equal(t, pt, testMessage)
+}
+
+func TestStatePreconfiguredSender(t *testing.T) {
+	scheme := suite.Scheme()
+	moderatorPriv, err := scheme.Generate()
+	require.Nil(t, err)
+
+	groupExtensions := NewExtensionList()
+	err = groupExtensions.Add(ExternalSendersExtension{
+		Senders: []ExternalSender{{scheme, moderatorPriv.PublicKey}},
+	})
+	require.Nil(t, err)
+
+	stateTest := setupGroupWithExtensions(t, groupExtensions)
+	ctx := stateTest.states[0].groupContext()
+	removed := LeafIndex(2)
+
+	// Only known senders may propose, and only Add or Remove
+	remove := Proposal{Remove: &RemoveProposal{Removed: removed}}
+	unknown, err := SignPreconfiguredProposal(ctx, 1, remove, moderatorPriv, scheme)
+	require.Nil(t, err)
+	_, err = stateTest.states[0].Handle(unknown)
+	require.Error(t, err)
+
+	update := Proposal{Update: &UpdateProposal{KeyPackage: stateTest.keyPackages[0]}}
+	badType, err := SignPreconfiguredProposal(ctx, 0, update, moderatorPriv, scheme)
+	require.Nil(t, err)
+	_, err = stateTest.states[0].Handle(badType)
+	require.Error(t, err)
+
+	forged, err := SignPreconfiguredProposal(ctx, 0, remove, stateTest.identityPrivs[1], scheme)
+	require.Nil(t, err)
+	_, err = stateTest.states[0].Handle(forged)
+	require.Error(t, err)
+
+	// The moderator removes a member
+	proposal, err := SignPreconfiguredProposalWithRand(newTestRandom(t, 1), ctx, 0, remove, moderatorPriv, scheme)
+	require.Nil(t, err)
+
+	for i := range stateTest.states {
+		_, err = stateTest.states[i].Handle(proposal)
+		require.Nil(t, err)
+	}
+
+	commit, _, next, err := stateTest.states[0].Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	for i := 1; i < groupSize; i++ {
+		if LeafIndex(i) == removed {
+			continue
+		}
+
+		newState, err := stateTest.states[i].Handle(commit)
+		require.Nil(t, err)
+		require.True(t, next.Equals(*newState))
+	}
+
+	_, ok := next.Tree.KeyPackage(removed)
+	require.False(t, ok)
+}
+
+func TestStatePreconfiguredSenderScheme(t *testing.T) {
+	// A moderator whose scheme differs from the group's ciphersuite
+	moderatorPriv, err := Ed25519.Generate()
+	require.Nil(t, err)
+
+	senders := ExternalSendersExtension{
+		Senders: []ExternalSender{
+			{Ed25519, moderatorPriv.PublicKey},
+			{suite.Scheme(), moderatorPriv.PublicKey},
+		},
+	}
+
+	// The group has to allow the moderator's scheme
+	stateTest := setup(t)
+	notAllowed := NewExtensionList()
+	err = notAllowed.Add(senders)
+	require.Nil(t, err)
+	_, err = NewEmptyStateWithExtensions(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0], notAllowed)
+	require.Error(t, err)
+
+	groupExtensions := NewExtensionList()
+	err = groupExtensions.Add(senders)
+	require.Nil(t, err)
+	err = groupExtensions.Add(SignatureSchemesExtension{[]SignatureScheme{suite.Scheme(), Ed25519}})
+	require.Nil(t, err)
+
+	stateTest = setupGroupWithExtensions(t, groupExtensions)
+	ctx := stateTest.states[0].groupContext()
+	remove := Proposal{Remove: &RemoveProposal{Removed: LeafIndex(2)}}
+
+	// Proposals are verified with the scheme recorded for the sender
+	mislabeled, err := SignPreconfiguredProposal(ctx, 1, remove, moderatorPriv, Ed25519)
+	require.Nil(t, err)
+	_, err = stateTest.states[0].Handle(mislabeled)
+	require.Error(t, err)
+
+	proposal, err := SignPreconfiguredProposal(ctx, 0, remove, moderatorPriv, Ed25519)
+	require.Nil(t, err)
+	for i := range stateTest.states {
+		_, err = stateTest.states[i].Handle(proposal)
+		require.Nil(t, err)
+	}
+
+	// The group cannot stop allowing the moderator's scheme
+	restricted := NewExtensionList()
+	err = restricted.Add(senders)
+	require.Nil(t, err)
+	err = restricted.Add(SignatureSchemesExtension{[]SignatureScheme{suite.Scheme()}})
+	require.Nil(t, err)
+	_, err = stateTest.states[1].GroupContextExtensions(restricted)
+	require.Error(t, err)
+}
+func TestStateGroupContextExtensions(t *testing.T) {
+	stateTest := setupGroup(t)
+
+	// The members do not support the test extension
+	unsupported := NewExtensionList()
+	err := unsupported.Add(GroupTestExtension{})
+	require.Nil(t, err)
+
+	_, err = stateTest.states[0].GroupContextExtensions(unsupported)
+	require.Error(t, err)
+
+	bad, err := stateTest.states[0].sign(Proposal{
+		GroupContextExtensions: &GroupContextExtensionsProposal{Extensions: unsupported},
+	})
+	require.Nil(t, err)
+
+	badState := stateTest.states[0].Clone()
+	_, err = badState.Handle(bad)
+	require.Nil(t, err)
+	_, _, _, err = badState.Commit(randomBytes(32))
+	require.Error(t, err)
+
+	// The members all support the extensions implemented by the library
+	ext := NewExtensionList()
+	err = ext.Add(ExternalSendersExtension{Senders: []ExternalSender{}})
+	require.Nil(t, err)
+
+	proposal, err := stateTest.states[1].GroupContextExtensions(ext)
+	require.Nil(t, err)
+
+	for i := range stateTest.states {
+		_, err = stateTest.states[i].Handle(proposal)
+		require.Nil(t, err)
+	}
+
+	commit, _, next, err := stateTest.states[0].Commit(randomBytes(32))
+	require.Nil(t, err)
+	require.Equal(t, len(commit.Content.Commit.Commit.GroupContextExtensions), 1)
+	require.NotNil(t, commit.Content.Commit.Commit.Path)
+	require.Equal(t, next.Extensions, ext)
+	require.Equal(t, next.groupContext().Extensions, ext)
+
+	for i := 1; i < groupSize; i++ {
+		newState, err := stateTest.states[i].Handle(commit)
+		require.Nil(t, err)
+		require.True(t, next.Equals(*newState))
+		require.True(t, newState.Extensions.Has(ExtensionTypeExternalSenders))
+	}
+
+	// The new extensions are reflected in the GroupInfo
+	gi, err := next.ExternalGroupInfo()
+	require.Nil(t, err)
+	require.Equal(t, gi.Extensions, ext)
+	require.Nil(t, gi.verify())
+
+	gi.Extensions = NewExtensionList()
+	require.Error(t, gi.verify())
+}
+
+func TestStateEncryptedHandshake(t *testing.T) {
+	stateTest := setupGroup(t)
+
+	// Require that handshake messages be encrypted
+	ext := NewExtensionList()
+	err := ext.Add(WireFormatPolicyExtension{HandshakePolicy: WireFormatPolicyEncryptHandshake})
+	require.Nil(t, err)
+
+	gce, err := stateTest.states[0].GroupContextExtensions(ext)
+	require.Nil(t, err)
+	for i := range stateTest.states {
+		_, err = stateTest.states[i].Handle(gce)
+		require.Nil(t, err)
+	}
+
+	commit, _, next, err := stateTest.states[0].Commit(randomBytes(32))
+	require.Nil(t, err)
+	for i := 1; i < groupSize; i++ {
+		newState, err := stateTest.states[i].Handle(commit)
+		require.Nil(t, err)
+		stateTest.states[i] = *newState
+	}
+	stateTest.states[0] = *next
+
+	// Plaintext proposals from members are now rejected
+	removed := LeafIndex(groupSize - 1)
+	proposal, err := stateTest.states[1].Remove(removed)
+	require.Nil(t, err)
+
+	_, err = stateTest.states[0].Handle(proposal)
+	require.Error(t, err)
+
+	// Only our own handshake messages can be protected
+	_, err = stateTest.states[0].ProtectHandshake(proposal)
+	require.Error(t, err)
+
+	// Encrypted proposals are accepted, including by the sender
+	ct, err := stateTest.states[1].ProtectHandshake(proposal)
+	require.Nil(t, err)
+	require.Equal(t, ContentType(ct.ContentType), ContentTypeProposal)
+
+	for i := range stateTest.states {
+		_, err = stateTest.states[i].HandleCiphertext(ct)
+		require.Nil(t, err)
+	}
+
+	// Encrypted commits are accepted, including by the sender
+	commit, _, next, err = stateTest.states[0].Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	ct, err = stateTest.states[0].ProtectHandshake(commit)
+	require.Nil(t, err)
+
+	for i := 0; i < groupSize-1; i++ {
+		newState, err := stateTest.states[i].HandleCiphertext(ct)
+		require.Nil(t, err)
+		require.True(t, next.Equals(*newState))
+	}
+
+	// Application messages are not handshake messages
+	appCt, err := next.Protect(testMessage)
+	require.Nil(t, err)
+	_, err = next.HandleCiphertext(appCt)
+	require.Error(t, err)
+}
+
+func TestStatePastEpochs(t *testing.T) {
+	stateTest := setupGroup(t)
+	for i := range stateTest.states {
+		stateTest.states[i].SetPastEpochRetention(2, time.Hour)
+	}
+
+	commitAll := func() {
+		commit, _, next, err := stateTest.states[0].Commit(randomBytes(32))
+		require.Nil(t, err)
+
+		for i := 1; i < groupSize; i++ {
+			newState, err := stateTest.states[i].Handle(commit)
+			require.Nil(t, err)
+			stateTest.states[i] = *newState
+		}
+		stateTest.states[0] = *next
+	}
+
+	// A message sent before a commit can be decrypted after it, but only once
+	ct0, err := stateTest.states[1].Protect(testMessage)
+	require.Nil(t, err)
+	ct1, err := stateTest.states[1].Protect(testMessage)
+	require.Nil(t, err)
+
+	commitAll()
+
+	pt, err := stateTest.states[2].Unprotect(ct0)
+	require.Nil(t, err)
+	require.Equal(t, pt, testMessage)
+
+	_, err = stateTest.states[2].Unprotect(ct0)
+	require.Error(t, err)
+
+	// Keys expire after the configured lifetime
+	past := stateTest.states[3].pastEpochs[0]
+	past.Expiry = time.Now().Add(-time.Second)
+	_, err = stateTest.states[3].Unprotect(ct1)
+	require.Error(t, err)
+	require.Equal(t, past.SenderDataKey, make([]byte, len(past.SenderDataKey)))
+
+	// Keys are dropped once more than the configured number of epochs pass
+	pt, err = stateTest.states[4].Unprotect(ct1)
+	require.Nil(t, err)
+	require.Equal(t, pt, testMessage)
+
+	ct2, err := stateTest.states[1].Protect(testMessage)
+	require.Nil(t, err)
+
+	commitAll()
+	commitAll()
+	commitAll()
+
+	_, err = stateTest.states[4].Unprotect(ct2)
+	require.Error(t, err)
+	require.Equal(t, len(stateTest.states[4].pastEpochs), 2)
+
+	// Erasing retained keys affects neither the state they were retained from
+	// nor clones of the state retaining them
+	ct3, err := stateTest.states[1].Protect(testMessage)
+	require.Nil(t, err)
+
+	prev := stateTest.states[2]
+	commitAll()
+	clone := stateTest.states[2].Clone()
+	stateTest.states[2].SetPastEpochRetention(0, 0)
+
+	pt, err = prev.Unprotect(ct3)
+	require.Nil(t, err)
+	require.Equal(t, pt, testMessage)
+
+	pt, err = clone.Unprotect(ct3)
+	require.Nil(t, err)
+	require.Equal(t, pt, testMessage)
+}
+
+func TestStateRatchetLimits(t *testing.T) {
+	stateTest := setupGroup(t)
+	limits := RatchetLimits{
+		MaxForwardSkip: 2,
+		MaxCachedKeys:  4,
+		ReplayWindow:   4,
+	}
+	stateTest.states[1].SetRatchetLimits(limits)
+
+	cts := make([]*MLSCiphertext, 4)
+	for i := range cts {
+		ct, err := stateTest.states[0].Protect(testMessage)
+		require.Nil(t, err)
+		cts[i] = ct
+	}
+
+	// A message too far ahead is rejected with a typed error
+	_, err := stateTest.states[1].Unprotect(cts[3])
+	var tooFar GenerationTooFarError
+	require.True(t, errors.As(err, &tooFar))
+	require.Equal(t, tooFar.MaxForwardSkip, limits.MaxForwardSkip)
+
+	// Messages within the limit are accepted in any order, but only once
+	for _, i := range []int{2, 0, 3, 1} {
+		pt, err := stateTest.states[1].Unprotect(cts[i])
+		require.Nil(t, err)
+		require.Equal(t, pt, testMessage)
+	}
+
+	_, err = stateTest.states[1].Unprotect(cts[2])
+	var expired GenerationExpiredError
+	require.True(t, errors.As(err, &expired))
+
+	// The limits apply to later epochs
+	commit, _, next, err := stateTest.states[0].Commit(randomBytes(32))
+	require.Nil(t, err)
+	stateTest.states[0] = *next
+
+	state1, err := stateTest.states[1].Handle(commit)
+	require.Nil(t, err)
+	require.Equal(t, state1.Keys.Limits, limits)
+
+	// Limits left unset take their defaults, and messages still round-trip
+	for i := range stateTest.states {
+		stateTest.states[i].SetRatchetLimits(RatchetLimits{MaxForwardSkip: 16})
+	}
+
+	partial := DefaultRatchetLimits
+	partial.MaxForwardSkip = 16
+	require.Equal(t, stateTest.states[2].Keys.Limits, partial)
+
+	ct, err := stateTest.states[2].Protect(testMessage)
+	require.Nil(t, err)
+	pt, err := stateTest.states[3].Unprotect(ct)
+	require.Nil(t, err)
+	require.Equal(t, pt, testMessage)
+}
+
+func TestStateFullMarshal(t *testing.T) {
+	stateTest := setupGroup(t)
+	pskID := []byte("external psk")
+	for i := range stateTest.states {
+		stateTest.states[i].SetPastEpochRetention(2, time.Hour)
+		stateTest.states[i].SetExternalPSK(pskID, []byte("secret"))
+	}
+
+	handleAll := func(pt *MLSPlaintext) []State {
+		next := make([]State, groupSize)
+		for i := range stateTest.states {
+			newState, err := stateTest.states[i].Handle(pt)
+			require.Nil(t, err)
+			if newState != nil {
+				next[i] = *newState
+			} else {
+				next[i] = stateTest.states[i]
+			}
+		}
+		return next
+	}
+
+	// Move to a new epoch with a message outstanding from the old one
+	ct, err := stateTest.states[1].Protect(testMessage)
+	require.Nil(t, err)
+
+	commit, _, _, err := stateTest.states[0].Commit(randomBytes(32))
+	require.Nil(t, err)
+	stateTest.states = handleAll(commit)
+
+	// Leave an update pending, and a commit awaiting confirmation
+	newSecret := randomBytes(32)
+	newKP, err := NewKeyPackageWithSecret(suite, newSecret, &stateTest.keyPackages[2].Credential, stateTest.identityPrivs[2])
+	require.Nil(t, err)
+	update, err := stateTest.states[2].Update(newSecret, nil, *newKP)
+	require.Nil(t, err)
+	stateTest.states = handleAll(update)
+
+	commit, _, _, err = stateTest.states[1].Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	// Round-trip every member's state
+	for i, state := range stateTest.states {
+		data, err := state.Marshal()
+		require.Nil(t, err)
+
+		restored, err := UnmarshalState(data)
+		require.Nil(t, err)
+		require.True(t, restored.Equals(state))
+
+		data2, err := restored.Marshal()
+		require.Nil(t, err)
+		require.Equal(t, data, data2)
+
+		stateTest.states[i] = *restored
+	}
+
+	// The restored states can carry on with the group
+	require.NotNil(t, stateTest.states[1].pendingCommit)
+	stateTest.states = handleAll(commit)
+	for _, state := range stateTest.states {
+		require.True(t, state.Equals(stateTest.states[0]))
+	}
+
+	pt, err := stateTest.states[3].Unprotect(ct)
+	require.Nil(t, err)
+	require.Equal(t, pt, testMessage)
+
+	ct, err = stateTest.states[2].Protect(testMessage)
+	require.Nil(t, err)
+	pt, err = stateTest.states[4].Unprotect(ct)
+	require.Nil(t, err)
+	require.Equal(t, pt, testMessage)
+
+	// Other versions of the format are rejected
+	data, err := stateTest.states[0].Marshal()
+	require.Nil(t, err)
+	data[0] += 1
+	_, err = UnmarshalState(data)
+	require.Error(t, err)
+}
+
+func TestStateLifetime(t *testing.T) {
+	stateTest := setup(t)
+	start := time.Unix(1600000000, 0)
+	cfg := LifetimeConfig{
+		Clock:    fixedClock(start),
+		Lifetime: time.Hour,
+	}
+
+	kps := make([]KeyPackage, 3)
+	for i := range kps {
+		cred := &stateTest.keyPackages[i].Credential
+		kp, err := NewKeyPackageWithSecretAndLifetime(suite, stateTest.initSecrets[i], cred, stateTest.identityPrivs[i], cfg)
+		require.Nil(t, err)
+		kps[i] = *kp
+	}
+
+	alice, err := NewEmptyState(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], kps[0])
+	require.Nil(t, err)
+	alice.SetLifetimeConfig(cfg)
+
+	add, err := alice.Add(kps[1])
+	require.Nil(t, err)
+	_, err = alice.Handle(add)
+	require.Nil(t, err)
+
+	_, welcome, alice, err := alice.Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	// A joiner checks the lifetime of every leaf in the tree
+	late := cfg
+	late.Clock = fixedClock(start.Add(2 * time.Hour))
+	_, err = NewJoinedStateWithLifetime(stateTest.initSecrets[1], stateTest.identityPrivs[1:2], kps[1:2], *welcome, late)
+	require.Error(t, err)
+
+	bob, err := NewJoinedStateWithLifetime(stateTest.initSecrets[1], stateTest.identityPrivs[1:2], kps[1:2], *welcome, cfg)
+	require.Nil(t, err)
+	require.True(t, alice.Equals(*bob))
+
+	// Members reject expired KeyPackages
+	alice.SetLifetimeConfig(late)
+	add, err = alice.Add(kps[2])
+	require.Nil(t, err)
+	_, err = alice.Handle(add)
+	require.Nil(t, err)
+	_, _, _, err = alice.Commit(randomBytes(32))
+	require.Error(t, err)
+}
+
+func TestStateParentHash(t *testing.T) {
+	stateTest := setupGroup(t)
+
+	commit, _, _, err := stateTest.states[0].Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	// Swap the public keys on the committer's path and re-sign, so that only
+	// the parent hash is wrong
+	data, err := syntax.Marshal(commit)
+	require.Nil(t, err)
+	var forged MLSPlaintext
+	_, err = syntax.Unmarshal(data, &forged)
+	require.Nil(t, err)
+
+	path := forged.Content.Commit.Commit.Path
+	path.Steps[0].PublicKey, path.Steps[1].PublicKey = path.Steps[1].PublicKey, path.Steps[0].PublicKey
+	err = forged.sign(stateTest.states[0].groupContext(), stateTest.identityPrivs[0], stateTest.states[0].Scheme, rand.Reader)
+	require.Nil(t, err)
+
+	_, err = stateTest.states[1].Handle(&forged)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "parent hash")
+
+	// The genuine commit is still accepted
+	next, err := stateTest.states[1].Handle(commit)
+	require.Nil(t, err)
+	require.Nil(t, next.Tree.ParentHashValid())
+}
+
+func TestStateExternalTree(t *testing.T) {
+	stateTest := setup(t)
+	alice0, err := NewEmptyState(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0])
+	require.Nil(t, err)
+	alice0.SetExternalTreeDelivery(true)
+
+	add, err := alice0.Add(stateTest.keyPackages[1])
+	require.Nil(t, err)
+	_, err = alice0.Handle(add)
+	require.Nil(t, err)
+
+	_, welcome, alice1, err := alice0.Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	// The Welcome alone is not enough to join
+	_, err = NewJoinedState(stateTest.initSecrets[1], stateTest.identityPrivs[1:2], stateTest.keyPackages[1:2], *welcome)
+	require.Error(t, err)
+
+	// The tree is delivered separately
+	ext := NewExtensionList()
+	require.Nil(t, ext.Add(RatchetTreeExtension{alice1.Tree}))
+	extData, err := syntax.Marshal(ext)
+	require.Nil(t, err)
+
+	var received ExtensionList
+	_, err = syntax.Unmarshal(extData, &received)
+	require.Nil(t, err)
+
+	var rte RatchetTreeExtension
+	found, err := received.Find(&rte)
+	require.True(t, found)
+	require.Nil(t, err)
+
+	// A tree that doesn't match the signed tree hash is rejected
+	_, err = NewJoinedStateWithTree(stateTest.initSecrets[1], stateTest.identityPrivs[1:2], stateTest.keyPackages[1:2], *welcome, alice0.Tree, DefaultLifetimeConfig)
+	require.Error(t, err)
+
+	bob1, err := NewJoinedStateWithTree(stateTest.initSecrets[1], stateTest.identityPrivs[1:2], stateTest.keyPackages[1:2], *welcome, rte.Tree, DefaultLifetimeConfig)
+	require.Nil(t, err)
+	require.True(t, alice1.Equals(*bob1))
+
+	ct, err := alice1.Protect(testMessage)
+	require.Nil(t, err)
+	pt, err := bob1.Unprotect(ct)
+	require.Nil(t, err)
+	require.Equal(t, pt, testMessage)
+}
+
+func TestStateRatchetTreeExtension(t *testing.T) {
+	stateTest := setup(t)
+	alice0, err := NewEmptyState(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0])
+	require.Nil(t, err)
+	alice0.SetRatchetTreeExtension(true)
+
+	// The setting survives serialization
+	data, err := alice0.Marshal()
+	require.Nil(t, err)
+	alice0, err = UnmarshalState(data)
+	require.Nil(t, err)
+
+	add, err := alice0.Add(stateTest.keyPackages[1])
+	require.Nil(t, err)
+	_, err = alice0.Handle(add)
+	require.Nil(t, err)
+
+	_, welcome, alice1, err := alice0.Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	// The joiner takes the tree from the extension, which is not one of the
+	// group's extensions
+	bob1, err := NewJoinedState(stateTest.initSecrets[1], stateTest.identityPrivs[1:2], stateTest.keyPackages[1:2], *welcome)
+	require.Nil(t, err)
+	require.True(t, alice1.Equals(*bob1))
+	require.False(t, bob1.Extensions.Has(ExtensionTypeRatchetTree))
+
+	// External tree delivery replaces the extension
+	alice0.SetExternalTreeDelivery(true)
+	_, welcome, _, err = alice0.Commit(randomBytes(32))
+	require.Nil(t, err)
+	_, err = NewJoinedState(stateTest.initSecrets[1], stateTest.identityPrivs[1:2], stateTest.keyPackages[1:2], *welcome)
+	require.Error(t, err)
+}
+
+func TestStateWelcomeHeader(t *testing.T) {
+	stateTest := setup(t)
+	alice0, err := NewEmptyState(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0])
+	require.Nil(t, err)
+
+	for _, kp := range stateTest.keyPackages[1:3] {
+		add, err := alice0.Add(kp)
+		require.Nil(t, err)
+		_, err = alice0.Handle(add)
+		require.Nil(t, err)
+	}
+
+	_, welcome, _, err := alice0.Commit(randomBytes(32))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(welcome.Secrets))
+
+	join := func(w Welcome) error {
+		_, err := NewJoinedState(stateTest.initSecrets[1], stateTest.identityPrivs[1:2], stateTest.keyPackages[1:2], w)
+		return err
+	}
+
+	// Dropping another joiner's secrets invalidates the GroupInfo
+	dropped := *welcome
+	dropped.Secrets = welcome.Secrets[:1]
+	egs, err := dropped.findSecrets(stateTest.keyPackages[1])
+	require.Nil(t, err)
+	require.NotNil(t, egs)
+	require.Error(t, join(dropped))
+
+	// So does changing the version
+	badVersion := *welcome
+	badVersion.Version = ProtocolVersion(0xff)
+	require.Error(t, join(badVersion))
+
+	require.Nil(t, join(*welcome))
+}
+
+func TestStateStagedWelcome(t *testing.T) {
+	stateTest := setup(t)
+	alice0, err := NewEmptyState(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0])
+	require.Nil(t, err)
+
+	add, err := alice0.Add(stateTest.keyPackages[1])
+	require.Nil(t, err)
+	_, err = alice0.Handle(add)
+	require.Nil(t, err)
+
+	commit, wb, _, err := alice0.CommitStaged(randomBytes(32))
+	require.Nil(t, err)
+	alice1, err := alice0.Handle(commit)
+	require.Nil(t, err)
+
+	// Only members in the tree can be welcomed
+	require.Equal(t, stateTest.keyPackages[1:2], wb.Joiners())
+	require.Error(t, wb.EncryptTo(stateTest.keyPackages[2:3]))
+
+	require.Nil(t, wb.EncryptTo(wb.Joiners()))
+	welcome, err := wb.Finalize()
+	require.Nil(t, err)
+
+	// Once finalized, the builder is done
+	require.Error(t, wb.EncryptTo(wb.Joiners()))
+	_, err = wb.Finalize()
+	require.Error(t, err)
+
+	bob1, err := NewJoinedState(stateTest.initSecrets[1], stateTest.identityPrivs[1:2], stateTest.keyPackages[1:2], *welcome)
+	require.Nil(t, err)
+	require.True(t, alice1.Equals(*bob1))
+}
+
+func TestStateEncryptionWorkers(t *testing.T) {
+	stateTest := setup(t)
+	alice0, err := NewEmptyState(groupID, stateTest.initSecrets[0], stateTest.identityPrivs[0], stateTest.keyPackages[0])
+	require.Nil(t, err)
+	alice0.SetEncryptionWorkers(4)
+
+	for _, kp := range stateTest.keyPackages[1:] {
+		add, err := alice0.Add(kp)
+		require.Nil(t, err)
+		_, err = alice0.Handle(add)
+		require.Nil(t, err)
+	}
+
+	_, welcome, alice1, err := alice0.Commit(randomBytes(32))
+	require.Nil(t, err)
+	require.Equal(t, 4, alice1.encryptionWorkers)
+
+	// Secrets are listed in the order the members were added
+	for i, kp := range stateTest.keyPackages[1:] {
+		egs, err := welcome.findSecrets(kp)
+		require.Nil(t, err)
+		require.Equal(t, &welcome.Secrets[i], egs)
+	}
+
+	states := []*State{alice1}
+	for i := 1; i < groupSize; i++ {
+		s, err := NewJoinedState(stateTest.initSecrets[i], stateTest.identityPrivs[i:i+1], stateTest.keyPackages[i:i+1], *welcome)
+		require.Nil(t, err)
+		require.True(t, alice1.Equals(*s))
+		states = append(states, s)
+	}
+
+	// A commit with a path is decrypted by everyone
+	commit, _, alice2, err := alice1.Commit(randomBytes(32))
+	require.Nil(t, err)
+	require.NotNil(t, commit.Content.Commit.Commit.Path)
+	for _, s := range states[1:] {
+		next, err := s.Handle(commit)
+		require.Nil(t, err)
+		require.True(t, alice2.Equals(*next))
+	}
+}
+
+// Rejects credentials with specific public keys
+type rejectKeysAS map[string]bool
+
+func (as rejectKeysAS) Authenticate(cred Credential) error {
+	if as[string(cred.PublicKey().Data)] {
+		return fmt.Errorf("rejected")
+	}
+	return nil
+}
+
+func TestStateAuthentication(t *testing.T) {
+	stateTest := setupGroup(t)
+	alice := stateTest.states[0]
+	bob := stateTest.states[1]
+	carol := stateTest.states[2]
+
+	requireRejected := func(err error, index LeafIndex) {
+		var rejected CredentialRejectedError
+		require.True(t, errors.As(err, &rejected))
+		require.Equal(t, index, rejected.Index)
+	}
+
+	// Bob updates to a credential that Alice's AS rejects
+	oldCred := stateTest.keyPackages[1].Credential
+	newPriv, err := oldCred.Scheme().Generate()
+	require.Nil(t, err)
+	newCred := NewBasicCredential(oldCred.Identity(), oldCred.Scheme(), newPriv.PublicKey)
+	newSecret := randomBytes(32)
+	newKP, err := NewKeyPackageWithSecret(suite, newSecret, newCred, newPriv)
+	require.Nil(t, err)
+
+	alice.SetAuthenticationService(rejectKeysAS{string(newPriv.PublicKey.Data): true})
+
+	update, err := bob.Update(newSecret, &newPriv, *newKP)
+	require.Nil(t, err)
+	_, err = bob.Handle(update)
+	require.Nil(t, err)
+	commit, _, _, err := bob.Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	aliceUpdate := alice.Clone()
+	_, err = aliceUpdate.Handle(update)
+	require.Nil(t, err)
+	_, err = aliceUpdate.Handle(commit)
+	requireRejected(err, 1)
+
+	_, _, _, err = aliceUpdate.Commit(randomBytes(32))
+	requireRejected(err, 1)
+
+	// Carol adds a new member whose credential Alice's AS rejects
+	newSecret = randomBytes(32)
+	newPriv, err = suite.Scheme().Derive(newSecret)
+	require.Nil(t, err)
+	newCred = NewBasicCredential(userID, suite.Scheme(), newPriv.PublicKey)
+	newKP, err = NewKeyPackageWithSecret(suite, newSecret, newCred, newPriv)
+	require.Nil(t, err)
+
+	alice.SetAuthenticationService(rejectKeysAS{string(newPriv.PublicKey.Data): true})
+
+	add, err := carol.Add(*newKP)
+	require.Nil(t, err)
+	_, err = carol.Handle(add)
+	require.Nil(t, err)
+	commit, welcome, _, err := carol.Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	_, err = alice.Handle(add)
+	require.Nil(t, err)
+	_, err = alice.Handle(commit)
+	requireRejected(err, LeafIndex(groupSize))
+
+	// The new member checks everyone's credential on joining
+	aliceKey := string(stateTest.keyPackages[0].Credential.PublicKey().Data)
+	_, err = NewJoinedStateWithAuthentication(newSecret, []SignaturePrivateKey{newPriv}, []KeyPackage{*newKP}, *welcome, nil, DefaultLifetimeConfig, rejectKeysAS{aliceKey: true})
+	requireRejected(err, 0)
+
+	joined, err := NewJoinedStateWithAuthentication(newSecret, []SignaturePrivateKey{newPriv}, []KeyPackage{*newKP}, *welcome, nil, DefaultLifetimeConfig, rejectKeysAS{})
+	require.Nil(t, err)
+	require.Equal(t, rejectKeysAS{}, joined.auth)
+}
+
+func TestStateSigner(t *testing.T) {
+	stateTest := setupGroup(t)
+	creator := stateTest.states[0]
+
+	// A new member whose identity key lives behind a crypto.Signer
+	signer := newTestSigner(t, suite.Scheme())
+	sigPriv, err := suite.Scheme().FromSigner(signer)
+	require.Nil(t, err)
+
+	secret := randomBytes(32)
+	cred := NewBasicCredential(userID, suite.Scheme(), sigPriv.PublicKey)
+	kp, err := NewKeyPackageWithSecret(suite, secret, cred, sigPriv)
+	require.Nil(t, err)
+	require.True(t, kp.Verify())
+	require.Equal(t, signer.calls, 1)
+
+	add, err := creator.Add(*kp)
+	require.Nil(t, err)
+	_, err = creator.Handle(add)
+	require.Nil(t, err)
+	_, welcome, creator1, err := creator.Commit(randomBytes(32))
+	require.Nil(t, err)
+
+	joiner1, err := NewJoinedState(secret, []SignaturePrivateKey{sigPriv}, []KeyPackage{*kp}, *welcome)
+	require.Nil(t, err)
+	require.True(t, creator1.Equals(*joiner1))
+
+	// Committing signs the leaf KeyPackage, the MLSPlaintext, and the GroupInfo
+	commit, _, joiner2, err := joiner1.Commit(randomBytes(32))
+	require.Nil(t, err)
+	require.Equal(t, signer.calls, 4)
+
+	creator2, err := creator1.Handle(commit)
+	require.Nil(t, err)
+	require.True(t, creator2.Equals(*joiner2))
+
+	ct, err := joiner2.Protect(testMessage)
+	require.Nil(t, err)
+	pt, err := creator2.Unprotect(ct)
+	require.Nil(t, err)
+	require.Equal(t, pt, testMessage)
+
+	// The signer is not serialized, and has to be attached again
+	data, err := joiner2.Marshal()
+	require.Nil(t, err)
+	restored, err := UnmarshalState(data)
+	require.Nil(t, err)
+	require.Empty(t, restored.IdentityPriv.Data)
+
+	_, _, _, err = restored.Commit(randomBytes(32))
+	require.Error(t, err)
+
+	require.Error(t, restored.SetIdentitySigner(newTestSigner(t, suite.Scheme())))
+	require.Nil(t, restored.SetIdentitySigner(signer))
+
+	commit, _, joiner3, err := restored.Commit(randomBytes(32))
+	require.Nil(t, err)
+	creator3, err := creator2.Handle(commit)
+	require.Nil(t, err)
+	require.True(t, creator3.Equals(*joiner3))
+}
+
+func TestStateSignatureSchemes(t *testing.T) {
+	// A new member whose credential uses a different scheme from the suite's
+	secret := randomBytes(32)
+	sigPriv, err := Ed25519.Derive(secret)
+	require.Nil(t, err)
+
+	cred := NewBasicCredential(userID, Ed25519, sigPriv.PublicKey)
+	kp, err := NewKeyPackageWithSecret(suite, secret, cred, sigPriv)
+	require.Nil(t, err)
+
+	// On its own, a KeyPackage must use its suite's scheme
+	require.False(t, kp.Verify())
+
+	// By default, only the suite's scheme is allowed
+	stateTest := setupGroup(t)
+	_, err = stateTest.states[0].Add(*kp)
+	require.Error(t, err)
+
+	add, err := stateTest.states[1].sign(Proposal{Add: &AddProposal{KeyPackage: *kp}})
+	require.Nil(t, err)
+	_, err = stateTest.states[0].Handle(add)
+	require.Nil(t, err)
+	_, _, _, err = stateTest.states[0].Commit(randomBytes(32))
+	var notAllowed SignatureSchemeNotAllowedError
+	require.True(t, errors.As(err, &notAllowed))
+	require.Equal(t, notAllowed.Scheme, Ed25519)
+
+	// The group can allow other schemes with an extension
+	ext := NewExtensionList()
+	err = ext.Add(SignatureSchemesExtension{[]SignatureScheme{suite.Scheme(), Ed25519}})
+	require.Nil(t, err)
+
+	stateTest = setupGroupWithExtensions(t, ext)
+	creator := stateTest.states[0]
+	other := stateTest.states[1]
+
+	add, err = creator.Add(*kp)
+	require.Nil(t, err)
+	_, err = creator.Handle(add)
+	require.Nil(t, err)
+	_, err = other.Handle(add)
+	require.Nil(t, err)
+
+	commit, welcome, creator1, err := creator.Commit(randomBytes(32))
+	require.Nil(t, err)
+	other1, err := other.Handle(commit)
+	require.Nil(t, err)
+
+	joiner1, err := NewJoinedState(secret, []SignaturePrivateKey{sigPriv}, []KeyPackage{*kp}, *welcome)
+	require.Nil(t, err)
+	require.True(t, creator1.Equals(*joiner1))
+
+	// Messages from the new member are verified with its own scheme
+	commit, _, joiner2, err := joiner1.Commit(randomBytes(32))
+	require.Nil(t, err)
+	creator2, err := creator1.Handle(commit)
+	require.Nil(t, err)
+	require.True(t, creator2.Equals(*joiner2))
+	other2, err := other1.Handle(commit)
+	require.Nil(t, err)
+	require.True(t, other2.Equals(*joiner2))
+
+	ct, err := joiner2.Protect(testMessage)
+	require.Nil(t, err)
+	pt, err := creator2.Unprotect(ct)
+	require.Nil(t, err)
+	require.Equal(t, pt, testMessage)
+
+	ct, err = creator2.Protect(testMessage)
+	require.Nil(t, err)
+	pt, err = joiner2.Unprotect(ct)
+	require.Nil(t, err)
+	require.Equal(t, pt, testMessage)
+
+	// The group cannot stop allowing a scheme that a member uses
+	restricted := NewExtensionList()
+	err = restricted.Add(SignatureSchemesExtension{[]SignatureScheme{suite.Scheme()}})
+	require.Nil(t, err)
+
+	_, err = creator2.GroupContextExtensions(restricted)
+	require.Error(t, err)
+}
+
+func newTestRandom(t *testing.T, seed byte) io.Reader {
+	streams, err := splitRandom(bytes.NewReader(bytes.Repeat([]byte{seed}, 32)), 1)
+	require.Nil(t, err)
+	return streams[0]
+}
+
+func TestStateRandomSource(t *testing.T) {
+	// Ed25519 signatures and X25519 key generation consume randomness
+	// deterministically, so this suite gives reproducible transcripts
+	cs := X25519_AES128GCM_SHA256_Ed25519
+	cfg := DefaultLifetimeConfig
+	cfg.Clock = fixedClock(time.Now())
+
+	transcript := func(seed byte) [][]byte {
+		secrets := make([][]byte, 3)
+		sigPrivs := make([]SignaturePrivateKey, 3)
+		kps := make([]KeyPackage, 3)
+		for i := range secrets {
+			secrets[i] = bytes.Repeat([]byte{byte(i)}, 32)
+			sigPriv, err := cs.Scheme().Derive(secrets[i])
+			require.Nil(t, err)
+
+			cred := NewBasicCredential(userID, cs.Scheme(), sigPriv.PublicKey)
+			kp, err := NewKeyPackageWithSecretAndLifetime(cs, secrets[i], cred, sigPriv, cfg)
+			require.Nil(t, err)
+
+			sigPrivs[i], kps[i] = sigPriv, *kp
+		}
+
+		creator, err := NewEmptyState(groupID, secrets[0], sigPrivs[0], kps[0])
+		require.Nil(t, err)
+		creator.SetRandomSource(newTestRandom(t, seed))
+		creator.SetEncryptionWorkers(4)
+
+		for _, kp := range kps[1:] {
+			add, err := creator.Add(kp)
+			require.Nil(t, err)
+			_, err = creator.Handle(add)
+			require.Nil(t, err)
+		}
+
+		commit, welcome, creator1, err := creator.Commit(bytes.Repeat([]byte{0xA0}, 32))
+		require.Nil(t, err)
+
+		joiner, err := NewJoinedStateWithLifetime(secrets[1], sigPrivs[1:2], kps[1:2], *welcome, cfg)
+		require.Nil(t, err)
+		joiner.SetRandomSource(newTestRandom(t, seed+1))
+
+		ct0, err := creator1.Protect(testMessage)
+		require.Nil(t, err)
+		ct1, err := joiner.Protect(testMessage)
+		require.Nil(t, err)
+
+		// This commit encrypts path secrets to the other members
+		pathCommit, _, _, err := joiner.Commit(bytes.Repeat([]byte{0xA1}, 32))
+		require.Nil(t, err)
+
+		out := [][]byte{}
+		for _, msg := range []interface{}{commit, welcome, ct0, ct1, pathCommit} {
+			data, err := syntax.Marshal(msg)
+			require.Nil(t, err)
+			out = append(out, data)
+		}
+		return out
+	}
+
+	// The same source gives the same messages; a different one doesn't.  The
+	// commit only adds members, so its path has nothing to encrypt.
+	first := transcript(1)
+	require.Equal(t, first, transcript(1))
+
+	other := transcript(2)
+	for i := 1; i < len(first); i++ {
+		require.NotEqual(t, first[i], other[i])
+	}
+}
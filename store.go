@@ -0,0 +1,492 @@
+package mls
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cisco/go-tls-syntax"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var ErrStateNotFound = fmt.Errorf("mls.store: State not found")
+var errNoSealer = fmt.Errorf("mls.store: A sealer is required")
+
+// A StateStore keeps snapshots of group state, one per group per epoch, so
+// that a member can resume after a restart, or return to an earlier epoch if
+// a later one turns out to be bad.
+type StateStore interface {
+	// Store a snapshot of the state under its group ID and epoch, replacing
+	// any existing snapshot for that epoch
+	Save(s State) error
+
+	// Load the snapshot for the specified epoch of a group
+	Load(groupID []byte, epoch Epoch) (*State, error)
+
+	// Load the snapshot for the most recent epoch of a group
+	LoadLatest(groupID []byte) (*State, error)
+
+	// The epochs for which snapshots of a group are stored, in ascending order
+	Epochs(groupID []byte) ([]Epoch, error)
+
+	// Discard all snapshots of a group after the specified epoch, and return
+	// the snapshot for that epoch
+	Rollback(groupID []byte, epoch Epoch) (*State, error)
+
+	// Discard all snapshots of a group
+	Delete(groupID []byte) error
+}
+
+///
+/// Sealing
+///
+
+const (
+	stateSealerKeySize  = chacha20poly1305.KeySize
+	stateSealerSaltSize = 16
+
+	// Argon2id parameters for passphrase-derived keys
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+// A StateSealer encrypts serialized state before it is stored, using either a
+// caller-supplied key or a key derived from a passphrase
+type StateSealer struct {
+	key        []byte
+	passphrase []byte
+	salt       []byte
+}
+
+type sealedState struct {
+	Salt       []byte `tls:"head=1"`
+	Nonce      []byte `tls:"head=1"`
+	Ciphertext []byte `tls:"head=4"`
+}
+
+func NewStateSealer(key []byte) (*StateSealer, error) {
+	if len(key) != stateSealerKeySize {
+		return nil, fmt.Errorf("mls.store: Sealing key must be %d bytes", stateSealerKeySize)
+	}
+
+	return &StateSealer{key: dup(key), salt: []byte{}}, nil
+}
+
+// Derive the sealing key from a passphrase with Argon2id.  Each sealer uses a
+// fresh salt, which is stored alongside the states it seals.
+func NewPassphraseStateSealer(passphrase []byte) (*StateSealer, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("mls.store: Empty passphrase")
+	}
+
+	salt := make([]byte, stateSealerSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	ss := &StateSealer{passphrase: dup(passphrase), salt: salt}
+	ss.key = ss.deriveKey(salt)
+	return ss, nil
+}
+
+func (ss StateSealer) deriveKey(salt []byte) []byte {
+	return argon2.IDKey(ss.passphrase, salt, argon2Time, argon2Memory, argon2Threads, stateSealerKeySize)
+}
+
+// Snapshots are bound to their group and epoch, so that one cannot be
+// substituted for another
+func sealedStateAAD(groupID []byte, epoch Epoch) []byte {
+	s := syntax.NewWriteStream()
+	err := s.Write(struct {
+		GroupID []byte `tls:"head=1"`
+		Epoch   Epoch
+	}{
+		GroupID: groupID,
+		Epoch:   epoch,
+	})
+
+	if err != nil {
+		return nil
+	}
+	return s.Data()
+}
+
+func (ss StateSealer) seal(groupID []byte, epoch Epoch, data []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(ss.key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	aad := sealedStateAAD(groupID, epoch)
+	return syntax.Marshal(sealedState{
+		Salt:       ss.salt,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, data, aad),
+	})
+}
+
+func (ss StateSealer) open(groupID []byte, epoch Epoch, sealed []byte) ([]byte, error) {
+	var st sealedState
+	read, err := syntax.Unmarshal(sealed, &st)
+	if err != nil {
+		return nil, fmt.Errorf("mls.store: Malformed sealed state %v", err)
+	}
+
+	if read != len(sealed) {
+		return nil, fmt.Errorf("mls.store: Sealed state has trailing data")
+	}
+
+	key := ss.key
+	if !bytes.Equal(st.Salt, ss.salt) {
+		if len(ss.passphrase) == 0 {
+			return nil, fmt.Errorf("mls.store: State was sealed with a passphrase")
+		}
+
+		key = ss.deriveKey(st.Salt)
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(st.Nonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("mls.store: Malformed sealed state nonce")
+	}
+
+	aad := sealedStateAAD(groupID, epoch)
+	data, err := aead.Open(nil, st.Nonce, st.Ciphertext, aad)
+	if err != nil {
+		return nil, fmt.Errorf("mls.store: Failed to unseal state %v", err)
+	}
+
+	return data, nil
+}
+
+///
+/// Stores
+///
+
+// The storage underlying a StateStore, which deals only in sealed snapshots
+type stateBackend interface {
+	put(groupID []byte, epoch Epoch, data []byte) error
+	get(groupID []byte, epoch Epoch) ([]byte, error)
+	epochs(groupID []byte) ([]Epoch, error)
+	remove(groupID []byte, epoch Epoch) error
+}
+
+type sealedStateStore struct {
+	backend stateBackend
+	sealer  *StateSealer
+}
+
+func (sss sealedStateStore) Save(s State) error {
+	data, err := s.Marshal()
+	if err != nil {
+		return err
+	}
+
+	sealed, err := sss.sealer.seal(s.GroupID, s.Epoch, data)
+	zeroize(data)
+	if err != nil {
+		return err
+	}
+
+	return sss.backend.put(s.GroupID, s.Epoch, sealed)
+}
+
+func (sss sealedStateStore) Load(groupID []byte, epoch Epoch) (*State, error) {
+	sealed, err := sss.backend.get(groupID, epoch)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := sss.sealer.open(groupID, epoch, sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := UnmarshalState(data)
+	zeroize(data)
+	return s, err
+}
+
+func (sss sealedStateStore) LoadLatest(groupID []byte) (*State, error) {
+	epochs, err := sss.backend.epochs(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(epochs) == 0 {
+		return nil, ErrStateNotFound
+	}
+
+	return sss.Load(groupID, epochs[len(epochs)-1])
+}
+
+func (sss sealedStateStore) Epochs(groupID []byte) ([]Epoch, error) {
+	return sss.backend.epochs(groupID)
+}
+
+func (sss sealedStateStore) Rollback(groupID []byte, epoch Epoch) (*State, error) {
+	// Make sure the target snapshot is usable before discarding anything
+	s, err := sss.Load(groupID, epoch)
+	if err != nil {
+		return nil, err
+	}
+
+	epochs, err := sss.backend.epochs(groupID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range epochs {
+		if e <= epoch {
+			continue
+		}
+
+		if err := sss.backend.remove(groupID, e); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (sss sealedStateStore) Delete(groupID []byte) error {
+	epochs, err := sss.backend.epochs(groupID)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range epochs {
+		if err := sss.backend.remove(groupID, e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func sortEpochs(epochs []Epoch) {
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+}
+
+//////////
+
+type memoryStateBackend struct {
+	mutex     sync.Mutex
+	snapshots map[string]map[Epoch][]byte
+}
+
+// Keep sealed snapshots in memory, e.g., for testing or for short-lived
+// processes
+func NewMemoryStateStore(sealer *StateSealer) (StateStore, error) {
+	if sealer == nil {
+		return nil, errNoSealer
+	}
+
+	backend := &memoryStateBackend{snapshots: map[string]map[Epoch][]byte{}}
+	return sealedStateStore{backend, sealer}, nil
+}
+
+func (msb *memoryStateBackend) put(groupID []byte, epoch Epoch, data []byte) error {
+	msb.mutex.Lock()
+	defer msb.mutex.Unlock()
+
+	group, ok := msb.snapshots[string(groupID)]
+	if !ok {
+		group = map[Epoch][]byte{}
+		msb.snapshots[string(groupID)] = group
+	}
+
+	group[epoch] = dup(data)
+	return nil
+}
+
+func (msb *memoryStateBackend) get(groupID []byte, epoch Epoch) ([]byte, error) {
+	msb.mutex.Lock()
+	defer msb.mutex.Unlock()
+
+	data, ok := msb.snapshots[string(groupID)][epoch]
+	if !ok {
+		return nil, ErrStateNotFound
+	}
+
+	return dup(data), nil
+}
+
+func (msb *memoryStateBackend) epochs(groupID []byte) ([]Epoch, error) {
+	msb.mutex.Lock()
+	defer msb.mutex.Unlock()
+
+	epochs := []Epoch{}
+	for epoch := range msb.snapshots[string(groupID)] {
+		epochs = append(epochs, epoch)
+	}
+
+	sortEpochs(epochs)
+	return epochs, nil
+}
+
+func (msb *memoryStateBackend) remove(groupID []byte, epoch Epoch) error {
+	msb.mutex.Lock()
+	defer msb.mutex.Unlock()
+
+	group := msb.snapshots[string(groupID)]
+	delete(group, epoch)
+	if len(group) == 0 {
+		delete(msb.snapshots, string(groupID))
+	}
+	return nil
+}
+
+//////////
+
+const stateFileSuffix = ".state"
+
+// Snapshots are stored as <dir>/<hex group ID>/<epoch>.state.  The mutex keeps
+// a put from creating a file in a group directory that a remove is deleting.
+type fileStateBackend struct {
+	mutex sync.Mutex
+	dir   string
+}
+
+// Keep sealed snapshots in files under the specified directory, which is
+// created if it does not exist
+func NewFileStateStore(dir string, sealer *StateSealer) (StateStore, error) {
+	if sealer == nil {
+		return nil, errNoSealer
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("mls.store: Failed to create store directory %v", err)
+	}
+
+	backend := &fileStateBackend{dir: dir}
+	return sealedStateStore{backend, sealer}, nil
+}
+
+func (fsb *fileStateBackend) groupDir(groupID []byte) string {
+	return filepath.Join(fsb.dir, hex.EncodeToString(groupID))
+}
+
+func (fsb *fileStateBackend) path(groupID []byte, epoch Epoch) string {
+	name := strconv.FormatUint(uint64(epoch), 10) + stateFileSuffix
+	return filepath.Join(fsb.groupDir(groupID), name)
+}
+
+func (fsb *fileStateBackend) put(groupID []byte, epoch Epoch, data []byte) error {
+	fsb.mutex.Lock()
+	defer fsb.mutex.Unlock()
+
+	dir := fsb.groupDir(groupID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("mls.store: Failed to create group directory %v", err)
+	}
+
+	// Write to a temporary file and rename it into place, so that a crash
+	// never leaves a partially written snapshot
+	tmp, err := os.CreateTemp(dir, "tmp-")
+	if err != nil {
+		return fmt.Errorf("mls.store: Failed to create state file %v", err)
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), fsb.path(groupID, epoch))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("mls.store: Failed to write state file %v", err)
+	}
+
+	return nil
+}
+
+func (fsb *fileStateBackend) get(groupID []byte, epoch Epoch) ([]byte, error) {
+	data, err := os.ReadFile(fsb.path(groupID, epoch))
+	if os.IsNotExist(err) {
+		return nil, ErrStateNotFound
+	} else if err != nil {
+		return nil, fmt.Errorf("mls.store: Failed to read state file %v", err)
+	}
+
+	return data, nil
+}
+
+func (fsb *fileStateBackend) epochs(groupID []byte) ([]Epoch, error) {
+	files, err := os.ReadDir(fsb.groupDir(groupID))
+	if os.IsNotExist(err) {
+		return []Epoch{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("mls.store: Failed to list state files %v", err)
+	}
+
+	epochs := []Epoch{}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasSuffix(name, stateFileSuffix) {
+			continue
+		}
+
+		epoch, err := strconv.ParseUint(strings.TrimSuffix(name, stateFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		epochs = append(epochs, Epoch(epoch))
+	}
+
+	sortEpochs(epochs)
+	return epochs, nil
+}
+
+func (fsb *fileStateBackend) remove(groupID []byte, epoch Epoch) error {
+	fsb.mutex.Lock()
+	defer fsb.mutex.Unlock()
+
+	err := os.Remove(fsb.path(groupID, epoch))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("mls.store: Failed to remove state file %v", err)
+	}
+
+	// Clean up the group directory once it is empty
+	dir := fsb.groupDir(groupID)
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("mls.store: Failed to list state files %v", err)
+	}
+
+	if len(files) > 0 {
+		return nil
+	}
+
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("mls.store: Failed to remove group directory %v", err)
+	}
+
+	return nil
+}
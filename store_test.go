@@ -0,0 +1,175 @@
+package mls
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func storeTestStates(t *testing.T) []State {
+	stateTest := setupGroup(t)
+	states := []State{stateTest.states[0]}
+	for i := 0; i < 2; i++ {
+		_, _, next, err := states[i].Commit(randomBytes(32))
+		require.Nil(t, err)
+		states = append(states, *next)
+	}
+	return states
+}
+
+func testStateStore(t *testing.T, store StateStore, states []State) {
+	groupID := states[0].GroupID
+
+	epochs, err := store.Epochs(groupID)
+	require.Nil(t, err)
+	require.Empty(t, epochs)
+
+	_, err = store.LoadLatest(groupID)
+	require.Equal(t, ErrStateNotFound, err)
+
+	for _, state := range states {
+		require.Nil(t, store.Save(state))
+	}
+
+	epochs, err = store.Epochs(groupID)
+	require.Nil(t, err)
+	require.Equal(t, []Epoch{states[0].Epoch, states[1].Epoch, states[2].Epoch}, epochs)
+
+	latest, err := store.LoadLatest(groupID)
+	require.Nil(t, err)
+	require.True(t, latest.Equals(states[2]))
+
+	loaded, err := store.Load(groupID, states[1].Epoch)
+	require.Nil(t, err)
+	require.True(t, loaded.Equals(states[1]))
+
+	_, err = store.Load(groupID, states[2].Epoch+1)
+	require.Equal(t, ErrStateNotFound, err)
+
+	// Rolling back discards later epochs
+	rolledBack, err := store.Rollback(groupID, states[0].Epoch)
+	require.Nil(t, err)
+	require.True(t, rolledBack.Equals(states[0]))
+
+	epochs, err = store.Epochs(groupID)
+	require.Nil(t, err)
+	require.Equal(t, []Epoch{states[0].Epoch}, epochs)
+
+	_, err = store.Rollback(groupID, states[1].Epoch)
+	require.Equal(t, ErrStateNotFound, err)
+
+	require.Nil(t, store.Delete(groupID))
+	epochs, err = store.Epochs(groupID)
+	require.Nil(t, err)
+	require.Empty(t, epochs)
+}
+
+func TestMemoryStateStore(t *testing.T) {
+	sealer, err := NewStateSealer(randomBytes(32))
+	require.Nil(t, err)
+
+	store, err := NewMemoryStateStore(sealer)
+	require.Nil(t, err)
+	testStateStore(t, store, storeTestStates(t))
+
+	_, err = NewMemoryStateStore(nil)
+	require.Error(t, err)
+}
+
+func TestFileStateStore(t *testing.T) {
+	dir, err := os.MkdirTemp("", "mls-store")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	states := storeTestStates(t)
+	sealer, err := NewPassphraseStateSealer([]byte("correct horse battery staple"))
+	require.Nil(t, err)
+
+	store, err := NewFileStateStore(dir, sealer)
+	require.Nil(t, err)
+	testStateStore(t, store, states)
+
+	// Private keys are not stored in the clear
+	require.Nil(t, store.Save(states[0]))
+	require.Nil(t, store.Save(states[1]))
+	fsb := &fileStateBackend{dir: dir}
+	data, err := os.ReadFile(fsb.path(states[0].GroupID, states[0].Epoch))
+	require.Nil(t, err)
+	require.False(t, bytes.Contains(data, states[0].IdentityPriv.Data))
+	require.False(t, bytes.Contains(data, states[0].Keys.EpochSecret))
+
+	// The same passphrase opens the store in a new sealer
+	sealer2, err := NewPassphraseStateSealer([]byte("correct horse battery staple"))
+	require.Nil(t, err)
+	store2, err := NewFileStateStore(dir, sealer2)
+	require.Nil(t, err)
+	loaded, err := store2.Load(states[0].GroupID, states[0].Epoch)
+	require.Nil(t, err)
+	require.True(t, loaded.Equals(states[0]))
+
+	// A different passphrase does not
+	sealer3, err := NewPassphraseStateSealer([]byte("incorrect horse battery staple"))
+	require.Nil(t, err)
+	store3, err := NewFileStateStore(dir, sealer3)
+	require.Nil(t, err)
+	_, err = store3.Load(states[0].GroupID, states[0].Epoch)
+	require.Error(t, err)
+
+	// A snapshot can't be passed off as one for another epoch
+	err = os.Rename(fsb.path(states[0].GroupID, states[0].Epoch), fsb.path(states[0].GroupID, states[1].Epoch))
+	require.Nil(t, err)
+	_, err = store.Load(states[0].GroupID, states[1].Epoch)
+	require.Error(t, err)
+
+	// Stray files in the group directory are ignored
+	stray := filepath.Join(fsb.groupDir(states[0].GroupID), "notes.txt")
+	require.Nil(t, os.WriteFile(stray, []byte("hello"), 0600))
+	epochs, err := store.Epochs(states[0].GroupID)
+	require.Nil(t, err)
+	require.Equal(t, []Epoch{states[1].Epoch}, epochs)
+
+	// The group directory is only removed once it is empty
+	require.Nil(t, store.Delete(states[0].GroupID))
+	_, err = os.Stat(stray)
+	require.Nil(t, err)
+
+	require.Nil(t, os.Remove(stray))
+	require.Nil(t, store.Save(states[0]))
+	require.Nil(t, store.Delete(states[0].GroupID))
+	_, err = os.Stat(fsb.groupDir(states[0].GroupID))
+	require.True(t, os.IsNotExist(err))
+
+	// A sealer is required
+	_, err = NewFileStateStore(dir, nil)
+	require.Error(t, err)
+}
+
+func TestStateSealer(t *testing.T) {
+	_, err := NewStateSealer(randomBytes(16))
+	require.Error(t, err)
+
+	_, err = NewPassphraseStateSealer(nil)
+	require.Error(t, err)
+
+	sealer, err := NewStateSealer(randomBytes(32))
+	require.Nil(t, err)
+
+	data := []byte("state")
+	sealed, err := sealer.seal(groupID, 1, data)
+	require.Nil(t, err)
+
+	opened, err := sealer.open(groupID, 1, sealed)
+	require.Nil(t, err)
+	require.Equal(t, data, opened)
+
+	_, err = sealer.open([]byte("other group"), 1, sealed)
+	require.Error(t, err)
+
+	other, err := NewStateSealer(randomBytes(32))
+	require.Nil(t, err)
+	_, err = other.open(groupID, 1, sealed)
+	require.Error(t, err)
+}
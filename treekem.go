@@ -2,7 +2,9 @@ package mls
 
 import (
 	"bytes"
+	"crypto/rand"
 	"fmt"
+	"io"
 	"reflect"
 
 	syntax "github.com/cisco/go-tls-syntax"
@@ -53,6 +55,21 @@ func (n *ParentNode) AddUnmerged(l LeafIndex) {
 	n.UnmergedLeaves = append(n.UnmergedLeaves, l)
 }
 
+// The hash of this node that its child on a DirectPath records as its parent
+// hash.  Unmerged leaves are excluded, since they change as members are added.
+func (n ParentNode) hash(suite CipherSuite) ([]byte, error) {
+	data, err := syntax.Marshal(ParentNode{
+		PublicKey:      n.PublicKey,
+		UnmergedLeaves: []LeafIndex{},
+		ParentHash:     n.ParentHash,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return suite.Digest(data), nil
+}
+
 ///
 /// Node
 ///
@@ -178,19 +195,25 @@ func newLeafNode(keyPkg KeyPackage) OptionalNode {
 	return OptionalNode{Node: &Node{Leaf: &keyPkg}}
 }
 
-func newParentNode(pub HPKEPublicKey) OptionalNode {
+func newParentNode(pub HPKEPublicKey, parentHash []byte) OptionalNode {
 	parentNode := &ParentNode{
 		PublicKey:      pub,
 		UnmergedLeaves: []LeafIndex{},
-		ParentHash:     []byte{},
+		ParentHash:     parentHash,
 	}
 	return OptionalNode{Node: &Node{Parent: parentNode}}
 }
 
 func (n OptionalNode) Clone() OptionalNode {
+	// Preserve an unset hash, so that it isn't mistaken for a cached one
+	var hash []byte
+	if n.Hash != nil {
+		hash = dup(n.Hash)
+	}
+
 	return OptionalNode{
 		Node: n.Node.Clone(),
-		Hash: dup(n.Hash),
+		Hash: hash,
 	}
 }
 
@@ -280,19 +303,19 @@ func (path DirectPath) ParentHashes(suite CipherSuite) ([][]byte, error) {
 	ph := make([][]byte, len(path.Steps))
 
 	var err error
-	var lastHash []byte
+	lastHash := []byte{}
 	for i := len(path.Steps) - 1; i >= 0; i-- {
 		parentNode := ParentNode{
 			PublicKey:  path.Steps[i].PublicKey,
 			ParentHash: lastHash,
 		}
 
-		lastHash, err = syntax.Marshal(parentNode)
+		lastHash, err = parentNode.hash(suite)
 		if err != nil {
 			return nil, err
 		}
 
-		ph[i] = suite.Digest(lastHash)
+		ph[i] = lastHash
 	}
 
 	return ph, nil
@@ -331,6 +354,15 @@ type KeyPackageOpts struct {
 }
 
 func (path *DirectPath) Sign(suite CipherSuite, initPub HPKEPublicKey, sigPriv SignaturePrivateKey, opts *KeyPackageOpts) error {
+	return path.sign(suite, initPub, sigPriv, opts, rand.Reader)
+}
+
+// Like Sign, but draws any randomness from the specified source
+func (path *DirectPath) SignWithRand(r io.Reader, suite CipherSuite, initPub HPKEPublicKey, sigPriv SignaturePrivateKey, opts *KeyPackageOpts) error {
+	return path.sign(suite, initPub, sigPriv, opts, r)
+}
+
+func (path *DirectPath) sign(suite CipherSuite, initPub HPKEPublicKey, sigPriv SignaturePrivateKey, opts *KeyPackageOpts, r io.Reader) error {
 	// Compute parent hashes down the tree from the root
 	leafParentHash := []byte{}
 	if len(path.Steps) > 0 {
@@ -353,7 +385,7 @@ func (path *DirectPath) Sign(suite CipherSuite, initPub HPKEPublicKey, sigPriv S
 
 	path.LeafKeyPackage.InitKey = initPub
 
-	return path.LeafKeyPackage.Sign(sigPriv)
+	return path.LeafKeyPackage.sign(sigPriv, r)
 }
 
 ////////////////////////////////////////////////////////////
@@ -608,14 +640,20 @@ func NewTreeKEMPublicKey(suite CipherSuite) *TreeKEMPublicKey {
 	return &TreeKEMPublicKey{Suite: suite}
 }
 
-func (pub *TreeKEMPublicKey) AddLeaf(keyPkg KeyPackage) LeafIndex {
-	// Find the leftmost free leaf
+// The leaf that AddLeaf will fill, i.e., the leftmost free leaf
+func (pub TreeKEMPublicKey) nextLeaf() LeafIndex {
 	index := LeafIndex(0)
 	size := LeafIndex(pub.Size())
 	for index < size && !pub.Nodes[toNodeIndex(index)].Blank() {
 		index++
 	}
 
+	return index
+}
+
+func (pub *TreeKEMPublicKey) AddLeaf(keyPkg KeyPackage) LeafIndex {
+	index := pub.nextLeaf()
+
 	// Extend the tree if necessary
 	n := toNodeIndex(index)
 	for len(pub.Nodes) < int(n)+1 {
@@ -655,9 +693,29 @@ func (pub *TreeKEMPublicKey) BlankPath(index LeafIndex) {
 	for _, n := range dirpath(ni, pub.Size()) {
 		pub.Nodes[n].SetToBlank()
 	}
+
+	pub.clearHashPath(index)
 }
 
 func (pub TreeKEMPublicKey) Encap(from LeafIndex, context, leafSecret []byte, leafSigPriv SignaturePrivateKey, opts *KeyPackageOpts) (*TreeKEMPrivateKey, *DirectPath, error) {
+	return pub.EncapWithWorkers(from, context, leafSecret, leafSigPriv, opts, 1)
+}
+
+// Like Encap, but spreads the encryption of path secrets over at most the
+// specified number of goroutines.  The resulting DirectPath has the same
+// structure regardless of the number of workers.
+func (pub TreeKEMPublicKey) EncapWithWorkers(from LeafIndex, context, leafSecret []byte, leafSigPriv SignaturePrivateKey, opts *KeyPackageOpts, workers int) (*TreeKEMPrivateKey, *DirectPath, error) {
+	return pub.encap(from, context, leafSecret, leafSigPriv, opts, workers, rand.Reader)
+}
+
+// Like EncapWithWorkers, but draws randomness from the specified source.  The
+// source is split among the workers, so the same source gives the same
+// DirectPath for any number of workers.
+func (pub TreeKEMPublicKey) EncapWithRand(r io.Reader, from LeafIndex, context, leafSecret []byte, leafSigPriv SignaturePrivateKey, opts *KeyPackageOpts, workers int) (*TreeKEMPrivateKey, *DirectPath, error) {
+	return pub.encap(from, context, leafSecret, leafSigPriv, opts, workers, r)
+}
+
+func (pub TreeKEMPublicKey) encap(from LeafIndex, context, leafSecret []byte, leafSigPriv SignaturePrivateKey, opts *KeyPackageOpts, workers int, r io.Reader) (*TreeKEMPrivateKey, *DirectPath, error) {
 	// Generate path secrets
 	priv := NewTreeKEMPrivateKey(pub.Suite, pub.Size(), from, leafSecret)
 
@@ -667,6 +725,13 @@ func (pub TreeKEMPublicKey) Encap(from LeafIndex, context, leafSecret []byte, le
 		LeafKeyPackage: *pub.Nodes[toNodeIndex(from)].Node.Leaf,
 		Steps:          make([]DirectPathNode, len(dp)),
 	}
+	type encryption struct {
+		step, index int
+		nodePub     HPKEPublicKey
+		pathSecret  []byte
+	}
+
+	encryptions := []encryption{}
 	last := toNodeIndex(from)
 	for i, n := range dp {
 		nodePriv, err := priv.privateKey(n)
@@ -686,22 +751,42 @@ func (pub TreeKEMPublicKey) Encap(from LeafIndex, context, leafSecret []byte, le
 		path.Steps[i].EncryptedPathSecrets = make([]HPKECiphertext, len(res))
 		for j, nr := range res {
 			nodePub := pub.Nodes[nr].Node.PublicKey()
-			path.Steps[i].EncryptedPathSecrets[j], err = pub.Suite.hpke().Encrypt(nodePub, context, pathSecret)
-			if err != nil {
-				return nil, nil, err
-			}
+			encryptions = append(encryptions, encryption{i, j, nodePub, pathSecret})
 		}
 
 		last = n
 	}
 
+	// Each encryption fills its own slot and uses its own stream of
+	// randomness, so the output does not depend on scheduling
+	streams, err := splitRandom(r, len(encryptions))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = parallelFor(len(encryptions), workers, func(k int) error {
+		e := encryptions[k]
+		instance := pub.Suite.hpke()
+		instance.Rand = streams[k]
+		ct, err := instance.Encrypt(e.nodePub, context, e.pathSecret)
+		if err != nil {
+			return err
+		}
+
+		path.Steps[e.step].EncryptedPathSecrets[e.index] = ct
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
 	// Sign the DirectPath
 	leafPriv, err := priv.privateKey(toNodeIndex(from))
 	if err != nil {
 		return nil, nil, err
 	}
 
-	err = path.Sign(pub.Suite, leafPriv.PublicKey, leafSigPriv, opts)
+	err = path.sign(pub.Suite, leafPriv.PublicKey, leafSigPriv, opts, r)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -712,31 +797,217 @@ func (pub TreeKEMPublicKey) Encap(from LeafIndex, context, leafSecret []byte, le
 		return nil, nil, err
 	}
 
-	// XXX(RLB): Should be possible to make a more targeted change, e.g., clearHashPath(from)
-	pub.clearHashAll()
-	pub.SetHashAll()
 	return priv, path, nil
 }
 
 func (pub *TreeKEMPublicKey) Merge(from LeafIndex, path DirectPath) error {
 	ni := toNodeIndex(from)
-	pub.Nodes[ni] = newLeafNode(path.LeafKeyPackage)
-
 	dp := dirpath(ni, pub.Size())
 	if len(dp) != len(path.Steps) {
 		return fmt.Errorf("Malformed DirectPath %d %d", len(dp), len(path.Steps))
 	}
 
+	if err := path.ParentHashValid(pub.Suite); err != nil {
+		return err
+	}
+
+	pub.Nodes[ni] = newLeafNode(path.LeafKeyPackage)
+
+	// Each node keeps the hash of its parent, so that the whole tree can be
+	// checked later
+	ph, err := path.ParentHashes(pub.Suite)
+	if err != nil {
+		return err
+	}
+
 	for i, n := range dp {
-		pub.Nodes[n] = newParentNode(path.Steps[i].PublicKey)
+		parentHash := []byte{}
+		if i+1 < len(ph) {
+			parentHash = ph[i+1]
+		}
+
+		pub.Nodes[n] = newParentNode(path.Steps[i].PublicKey, parentHash)
+	}
+
+	// Only the hashes along the direct path have changed
+	pub.clearHashPath(from)
+	return pub.SetHashAll()
+}
+
+// Check that the tree is well-formed and that its contents are authentic:
+// every leaf holds a validly signed KeyPackage for the tree's ciphersuite,
+// unmerged leaves are consistent, every parent node was set by a DirectPath
+// whose parent hashes chain down to a leaf, and any cached tree hashes match
+// the contents of the tree.  Every credential must use the ciphersuite's
+// signature scheme.
+func (pub TreeKEMPublicKey) Validate() error {
+	return pub.validate([]SignatureScheme{pub.Suite.Scheme()})
+}
+
+// Like Validate, but credentials may use any of the specified signature
+// schemes
+func (pub TreeKEMPublicKey) validate(schemes []SignatureScheme) error {
+	if len(pub.Nodes)%2 != 1 {
+		return fmt.Errorf("mls.tree: Malformed tree with %d nodes", len(pub.Nodes))
+	}
+
+	size := pub.Size()
+	initKeys := map[string]LeafIndex{}
+	for i := LeafIndex(0); LeafCount(i) < size; i++ {
+		n := pub.Nodes[toNodeIndex(i)]
+		if n.Blank() {
+			continue
+		}
+
+		if n.Node.Type() != NodeTypeLeaf {
+			return fmt.Errorf("mls.tree: Parent node at leaf %d", i)
+		}
+
+		kp := n.Node.Leaf
+		if kp.CipherSuite != pub.Suite {
+			return fmt.Errorf("mls.tree: Wrong ciphersuite at leaf %d", i)
+		}
+
+		if !kp.verifySignature(schemes) {
+			return fmt.Errorf("mls.tree: Invalid KeyPackage at leaf %d", i)
+		}
+
+		if j, ok := initKeys[string(kp.InitKey.Data)]; ok {
+			return fmt.Errorf("mls.tree: Leaves %d and %d have the same init key", j, i)
+		}
+		initKeys[string(kp.InitKey.Data)] = i
+	}
+
+	for i := 1; i < len(pub.Nodes); i += 2 {
+		index := NodeIndex(i)
+		if pub.Nodes[index].Blank() {
+			continue
+		}
+
+		if pub.Nodes[index].Node.Type() != NodeTypeParent {
+			return fmt.Errorf("mls.tree: Leaf node at parent %d", index)
+		}
+
+		if err := pub.validateUnmerged(index); err != nil {
+			return err
+		}
+	}
+
+	if err := pub.ParentHashValid(); err != nil {
+		return err
+	}
+
+	// Recompute the tree hash from scratch and compare with any cached values
+	fresh := pub.Clone()
+	fresh.clearHashAll()
+	if err := fresh.SetHashAll(); err != nil {
+		return err
+	}
+
+	for i, n := range pub.Nodes {
+		if n.Hash != nil && !bytes.Equal(n.Hash, fresh.Nodes[i].Hash) {
+			return fmt.Errorf("mls.tree: Incorrect tree hash at node %d", i)
+		}
 	}
 
-	// XXX(RLB): Should be possible to make a more targeted change, e.g., clearHashPath(from)
-	pub.clearHashAll()
-	pub.SetHashAll()
 	return nil
 }
 
+// A leaf is unmerged at a parent node if it was added below that node since
+// the node was last set, in which case it must also be unmerged at every
+// non-blank node between the leaf and the parent
+func (pub TreeKEMPublicKey) validateUnmerged(index NodeIndex) error {
+	size := pub.Size()
+	unmerged := pub.Nodes[index].Node.Parent.UnmergedLeaves
+	for i, leaf := range unmerged {
+		if containsLeaf(unmerged[:i], leaf) {
+			return fmt.Errorf("mls.tree: Duplicate unmerged leaf %d at node %d", leaf, index)
+		}
+
+		if LeafCount(leaf) >= size || pub.Nodes[toNodeIndex(leaf)].Blank() {
+			return fmt.Errorf("mls.tree: Unmerged leaf %d at node %d is not occupied", leaf, index)
+		}
+
+		if !inPath(toNodeIndex(leaf), index) {
+			return fmt.Errorf("mls.tree: Unmerged leaf %d is not below node %d", leaf, index)
+		}
+
+		for _, n := range dirpath(toNodeIndex(leaf), size) {
+			if n == index {
+				break
+			}
+
+			if !pub.Nodes[n].Blank() && !containsLeaf(pub.Nodes[n].Node.Parent.UnmergedLeaves, leaf) {
+				return fmt.Errorf("mls.tree: Unmerged leaf %d at node %d is merged at node %d", leaf, index, n)
+			}
+		}
+	}
+
+	return nil
+}
+
+func containsLeaf(leaves []LeafIndex, leaf LeafIndex) bool {
+	for _, l := range leaves {
+		if l == leaf {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that every parent node in the tree was set by a DirectPath with valid
+// parent hashes
+func (pub TreeKEMPublicKey) ParentHashValid() error {
+	for i := 1; i < len(pub.Nodes); i += 2 {
+		index := NodeIndex(i)
+		if pub.Nodes[index].Blank() || pub.Nodes[index].Node.Type() != NodeTypeParent {
+			continue
+		}
+
+		if err := pub.validateParentHash(index); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// A parent node is only set by a DirectPath, so some node below it must record
+// its hash as a parent hash, either in a parent node or in a leaf's
+// ParentHashExtension
+func (pub TreeKEMPublicKey) validateParentHash(index NodeIndex) error {
+	ph, err := pub.Nodes[index].Node.Parent.hash(pub.Suite)
+	if err != nil {
+		return err
+	}
+
+	if !pub.hasParentHash(left(index), ph) && !pub.hasParentHash(right(index, pub.Size()), ph) {
+		return fmt.Errorf("mls.tree: Parent hash not verified at node %d", index)
+	}
+
+	return nil
+}
+
+// Whether the first non-blank node at or below index records the specified
+// parent hash
+func (pub TreeKEMPublicKey) hasParentHash(index NodeIndex, ph []byte) bool {
+	n := pub.Nodes[index]
+	switch {
+	case n.Blank() && level(index) == 0:
+		return false
+
+	case n.Blank():
+		return pub.hasParentHash(left(index), ph) || pub.hasParentHash(right(index, pub.Size()), ph)
+
+	case n.Node.Type() == NodeTypeParent:
+		return bytes.Equal(n.Node.Parent.ParentHash, ph)
+	}
+
+	var phe ParentHashExtension
+	found, err := n.Node.Leaf.Extensions.Find(&phe)
+	return found && err == nil && bytes.Equal(phe.ParentHash, ph)
+}
+
 func (pub TreeKEMPublicKey) Size() LeafCount {
 	return leafWidth(nodeCount(len(pub.Nodes)))
 }
@@ -1,12 +1,14 @@
 package mls
 
 import (
+	"bytes"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 )
 
-func newKeyPackage(t *testing.T) ([]byte, SignaturePrivateKey, *KeyPackage) {
+func newKeyPackage(t testing.TB) ([]byte, SignaturePrivateKey, *KeyPackage) {
 	secret := randomBytes(32)
 
 	initPriv, err := suite.hpke().Derive(secret)
@@ -61,6 +63,8 @@ func TestTreeKEM(t *testing.T) {
 		err = pub.Merge(adder, *path)
 		require.Nil(t, err)
 		require.True(t, privs[i].ConsistentPub(*pub))
+		require.Nil(t, pub.ParentHashValid())
+		require.Nil(t, pub.Validate())
 
 		overlap, pathSecret, ok := privs[i].SharedPathSecret(joiner)
 		require.True(t, ok)
@@ -81,6 +85,232 @@ func TestTreeKEM(t *testing.T) {
 	}
 }
 
+func TestTreeKEMValidate(t *testing.T) {
+	groupSize := 7
+	pub := NewTreeKEMPublicKey(suite)
+	sigPrivs := make([]SignaturePrivateKey, groupSize)
+	for i := 0; i < groupSize; i++ {
+		_, sigPriv, kp := newKeyPackage(t)
+		sigPrivs[i] = sigPriv
+		pub.AddLeaf(*kp)
+	}
+
+	// Populate the parent nodes, then add a member so that some leaves are
+	// unmerged
+	for _, from := range []LeafIndex{0, 5} {
+		_, _, err := pub.Encap(from, []byte{}, randomBytes(32), sigPrivs[from], nil)
+		require.Nil(t, err)
+	}
+
+	_, _, kp := newKeyPackage(t)
+	pub.AddLeaf(*kp)
+	pub.SetHashAll()
+	require.Nil(t, pub.Validate())
+
+	tamper := func(f func(tree *TreeKEMPublicKey)) {
+		tree := pub.Clone()
+		f(&tree)
+		require.Error(t, tree.Validate())
+	}
+
+	// Leaf with a bad signature
+	tamper(func(tree *TreeKEMPublicKey) {
+		sig := dup(tree.Nodes[2].Node.Leaf.Signature.Data)
+		sig[0] ^= 0xff
+		tree.Nodes[2].Node.Leaf.Signature.Data = sig
+	})
+
+	// Two leaves with the same KeyPackage
+	tamper(func(tree *TreeKEMPublicKey) {
+		tree.Nodes[2] = tree.Nodes[4].Clone()
+		tree.clearHashAll()
+	})
+
+	// Parent node replaced by someone who did not send a DirectPath
+	tamper(func(tree *TreeKEMPublicKey) {
+		tree.Nodes[3].Node.Parent.PublicKey = tree.Nodes[1].Node.Parent.PublicKey
+		tree.clearHashAll()
+	})
+
+	// Unmerged leaf that is not below the node
+	tamper(func(tree *TreeKEMPublicKey) {
+		tree.Nodes[1].Node.Parent.AddUnmerged(6)
+		tree.clearHashAll()
+	})
+
+	// Unmerged leaf missing from an intermediate node
+	tamper(func(tree *TreeKEMPublicKey) {
+		tree.Nodes[11].Node.Parent.UnmergedLeaves = []LeafIndex{}
+		tree.clearHashAll()
+	})
+
+	// Cached tree hash that doesn't match the contents
+	tamper(func(tree *TreeKEMPublicKey) {
+		tree.Nodes[7].Hash[0] ^= 0xff
+	})
+
+	// Node of the wrong type
+	tamper(func(tree *TreeKEMPublicKey) {
+		tree.Nodes[5] = tree.Nodes[4].Clone()
+		tree.clearHashAll()
+	})
+}
+
+func TestTreeKEMMergeParentHash(t *testing.T) {
+	pub := NewTreeKEMPublicKey(suite)
+	sigPrivs := make([]SignaturePrivateKey, 4)
+	for i := range sigPrivs {
+		_, sigPriv, kp := newKeyPackage(t)
+		sigPrivs[i] = sigPriv
+		pub.AddLeaf(*kp)
+	}
+
+	_, path, err := pub.Clone().Encap(1, []byte{}, randomBytes(32), sigPrivs[1], nil)
+	require.Nil(t, err)
+
+	// A path whose public keys don't match the leaf's parent hash is rejected
+	// without modifying the tree
+	forged := *path
+	forged.Steps = []DirectPathNode{path.Steps[1], path.Steps[0]}
+	before := pub.Clone()
+	require.Error(t, pub.Merge(1, forged))
+	require.True(t, pub.Equals(before))
+
+	require.Nil(t, pub.Merge(1, *path))
+	require.Nil(t, pub.ParentHashValid())
+}
+
+func TestTreeKEMParallelEncap(t *testing.T) {
+	// With no parent nodes set, each copath resolves to many leaves
+	pub := NewTreeKEMPublicKey(suite)
+	secrets := make([][]byte, 8)
+	sigPrivs := make([]SignaturePrivateKey, len(secrets))
+	for i := range secrets {
+		secret, sigPriv, kp := newKeyPackage(t)
+		secrets[i] = secret
+		sigPrivs[i] = sigPriv
+		pub.AddLeaf(*kp)
+	}
+
+	context := []byte("context")
+	serialPub := pub.Clone()
+	_, serialPath, err := serialPub.Encap(0, context, randomBytes(32), sigPrivs[0], nil)
+	require.Nil(t, err)
+
+	before := pub.Clone()
+	priv, path, err := pub.EncapWithWorkers(0, context, randomBytes(32), sigPrivs[0], nil, 4)
+	require.Nil(t, err)
+	require.Equal(t, len(serialPath.Steps), len(path.Steps))
+	for i := range path.Steps {
+		require.Equal(t, len(serialPath.Steps[i].EncryptedPathSecrets), len(path.Steps[i].EncryptedPathSecrets))
+	}
+
+	// Every other member can decrypt their part of the path
+	for i := 1; i < len(secrets); i++ {
+		other := NewTreeKEMPrivateKey(suite, before.Size(), LeafIndex(i), secrets[i])
+		require.Nil(t, other.Decap(0, before, context, *path))
+		require.True(t, other.Consistent(*priv))
+	}
+
+	// Encryption draws on the specified source of randomness
+	_, _, err = before.Clone().EncapWithRand(bytes.NewReader(nil), 0, context, randomBytes(32), sigPrivs[0], nil, 4)
+	require.Error(t, err)
+
+	priv, path, err = before.Clone().EncapWithRand(newTestRandom(t, 1), 0, context, randomBytes(32), sigPrivs[0], nil, 4)
+	require.Nil(t, err)
+	other := NewTreeKEMPrivateKey(suite, before.Size(), LeafIndex(1), secrets[1])
+	require.Nil(t, other.Decap(0, before, context, *path))
+	require.True(t, other.Consistent(*priv))
+}
+
+func requireHashesFresh(t *testing.T, pub TreeKEMPublicKey) {
+	fresh := pub.Clone()
+	fresh.clearHashAll()
+	require.Equal(t, fresh.RootHash(), pub.RootHash())
+}
+
+func TestTreeKEMHashCache(t *testing.T) {
+	pub := NewTreeKEMPublicKey(suite)
+	sigPrivs := make([]SignaturePrivateKey, 5)
+	for i := range sigPrivs {
+		_, sigPriv, kp := newKeyPackage(t)
+		sigPrivs[i] = sigPriv
+		pub.AddLeaf(*kp)
+		requireHashesFresh(t, *pub)
+	}
+
+	_, _, err := pub.Encap(4, []byte{}, randomBytes(32), sigPrivs[4], nil)
+	require.Nil(t, err)
+	requireHashesFresh(t, *pub)
+
+	pub.BlankPath(1)
+	requireHashesFresh(t, *pub)
+
+	_, _, kp := newKeyPackage(t)
+	pub.UpdateLeaf(3, *kp)
+	requireHashesFresh(t, *pub)
+
+	_, _, kp = newKeyPackage(t)
+	require.Equal(t, LeafIndex(1), pub.AddLeaf(*kp))
+	requireHashesFresh(t, *pub)
+
+	// Cloning an unhashed tree doesn't produce stale hashes
+	pub.clearHashAll()
+	clone := pub.Clone()
+	require.Nil(t, clone.SetHashAll())
+	requireHashesFresh(t, clone)
+}
+
+func newBenchmarkTree(b *testing.B, size int) (*TreeKEMPublicKey, []SignaturePrivateKey) {
+	pub := NewTreeKEMPublicKey(suite)
+	sigPrivs := make([]SignaturePrivateKey, size)
+	for i := range sigPrivs {
+		_, sigPriv, kp := newKeyPackage(b)
+		sigPrivs[i] = sigPriv
+		pub.AddLeaf(*kp)
+	}
+
+	require.Nil(b, pub.SetHashAll())
+	return pub, sigPrivs
+}
+
+var benchmarkTreeSizes = []int{16, 128, 1024}
+
+func BenchmarkTreeKEMMerge(b *testing.B) {
+	for _, size := range benchmarkTreeSizes {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			pub, sigPrivs := newBenchmarkTree(b, size)
+			_, path, err := pub.Clone().Encap(0, []byte{}, randomBytes(32), sigPrivs[0], nil)
+			require.Nil(b, err)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				err = pub.Merge(0, *path)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkTreeKEMEncap(b *testing.B) {
+	for _, size := range benchmarkTreeSizes {
+		b.Run(fmt.Sprintf("%d", size), func(b *testing.B) {
+			pub, sigPrivs := newBenchmarkTree(b, size)
+			leafSecret := randomBytes(32)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _, err := pub.Encap(0, []byte{}, leafSecret, sigPrivs[0], nil)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
 func generateRatchetTreeVectors(t *testing.T) []byte {
 	return nil // TODO(RLB)
 }